@@ -2,7 +2,9 @@ package jetflow
 
 import (
 	"context"
+	"encoding/json"
 	"reflect"
+	"time"
 
 	"github.com/pkg/errors"
 	"go.opentelemetry.io/otel"
@@ -46,9 +48,24 @@ func (c *Client) Call(ctx context.Context, call *Request) (res []byte, err error
 	spanID := span.SpanContext().SpanID().String()
 	call.TransactionID = TransactionIDFromContext(ctx, spanID)
 	call.RequestID = spanID
+	if policy, ok := RetryPolicyFromContext(ctx); ok && call.TransactionID == call.RequestID {
+		call.RetryPolicy = &policy
+	}
+	if key, ok := IdempotencyKeyFromContext(ctx); ok && call.TransactionID == call.RequestID {
+		call.IdempotencyKey = key
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		call.Timeout = time.Until(deadline)
+	}
+	call.TransactionTime = TransactionTimeFromContext(ctx)
+	call.OriginalTransactionID = OriginalTransactionIDFromContext(ctx)
 
 	log.Println("Client.Call:\n", call)
 
+	// Let other calls of the transaction to the calling operator run while
+	// it waits, so the called operator can call it back.
+	defer yield(ctx)()
+
 	replyChan, err := c.publisher.Publish(ctx, call)
 	if err != nil {
 		return nil, errors.Wrap(err, "dispatching request")
@@ -70,6 +87,51 @@ func (c *Client) Call(ctx context.Context, call *Request) (res []byte, err error
 	}
 }
 
+// Transaction calls fn with a context in which the calls of the client belong
+// to one transaction. The transaction is committed if fn returns nil and all
+// involved operators could be prepared. Otherwise, it is rolled back and the
+// error is returned. The calls in fn must not run concurrently.
+//
+// Transaction calls fn with ctx itself if ctx already belongs to a
+// transaction. The decision of the client is not logged, so operators that
+// were prepared when the client crashed are not recovered.
+func (c *Client) Transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(operationIDKey).(string); ok {
+		return fn(ctx)
+	}
+
+	ctx, span := otel.Tracer("client").Start(ctx, "jetflow.Client.Transaction")
+	defer span.End()
+
+	transactionID := span.SpanContext().SpanID().String()
+	operators := map[string]map[string]bool{}
+	ctx = ContextWithOperationID(ctx, transactionID)
+	ctx = ContextWithInvolvedOperators(ctx, operators)
+	ctx = ContextWithTransactionTime(ctx, time.Now().UnixNano())
+	ctx = contextWithFutures(ctx)
+
+	err := fn(ctx)
+	awaitFutures(ctx)
+	if err == nil && len(operators) > 0 && len(broadcast(ctx, c, MethodPrepare, operators, nil)) > 0 {
+		err = errors.Wrap(ErrConflict, "Failed to prepare")
+	}
+	if err == nil && ctx.Err() != nil {
+		err = errors.Wrap(ctx.Err(), "transaction aborted")
+	}
+
+	// The decision must not be canceled with the context of the caller.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), DefaultDeliveryTimeout)
+	method := MethodCommit
+	if err != nil {
+		method = MethodRollback
+	}
+	go func() {
+		defer cancel()
+		deliver(ctx, c, method, operators)
+	}()
+	return err
+}
+
 func (c *Client) Find(ctx context.Context, id string, operator interface{}) error {
 	value := reflect.ValueOf(operator)
 	if value.Kind() != reflect.Pointer {
@@ -95,3 +157,70 @@ func (c *Client) Find(ctx context.Context, id string, operator interface{}) erro
 
 	return nil
 }
+
+// Create creates the operator with the given id and sets operator to its
+// proxy, like Find. It fails with ErrAlreadyExists if the operator exists.
+func (c *Client) Create(ctx context.Context, id string, operator interface{}) error {
+	name, err := operatorTypeName(operator)
+	if err != nil {
+		return err
+	}
+	_, err = c.Call(ctx, &Request{
+		TypeName:   name,
+		InstanceID: id,
+		Method:     string(MethodCreate),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "creating %s %s", name, id)
+	}
+	return c.Find(ctx, id, operator)
+}
+
+// Exists reports whether the operator with the given id exists. The type of
+// the operator is determined like Find, but operator is not modified.
+func (c *Client) Exists(ctx context.Context, id string, operator interface{}) (bool, error) {
+	name, err := operatorTypeName(operator)
+	if err != nil {
+		return false, err
+	}
+	res, err := c.Call(ctx, &Request{
+		TypeName:   name,
+		InstanceID: id,
+		Method:     string(MethodExists),
+		ReadOnly:   true,
+	})
+	if err != nil {
+		return false, errors.Wrapf(err, "checking %s %s", name, id)
+	}
+	var exists bool
+	err = json.Unmarshal(res, &exists)
+	return exists, errors.Wrap(err, "unmarshalling exists")
+}
+
+// Delete deletes the operator with the given id. The type of the operator is
+// determined like Find. It fails with ErrNotFound if the operator does not
+// exist.
+func (c *Client) Delete(ctx context.Context, id string, operator interface{}) error {
+	name, err := operatorTypeName(operator)
+	if err != nil {
+		return err
+	}
+	_, err = c.Call(ctx, &Request{
+		TypeName:   name,
+		InstanceID: id,
+		Method:     string(MethodDelete),
+	})
+	return errors.Wrapf(err, "deleting %s %s", name, id)
+}
+
+// operatorTypeName returns the name of the interface that operator points to.
+func operatorTypeName(operator interface{}) (string, error) {
+	typ := reflect.TypeOf(operator)
+	if typ == nil || typ.Kind() != reflect.Pointer {
+		return "", errors.New("operator must be a pointer")
+	}
+	if typ.Elem().Kind() != reflect.Interface {
+		return "", errors.New("operator must be an interface")
+	}
+	return typ.Elem().Name(), nil
+}
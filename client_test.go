@@ -37,3 +37,33 @@ func TestClientFind(t *testing.T) {
 	require.NotNil(t, testType)
 	require.IsType(t, &TestTypeProxy{}, testType)
 }
+
+type publisherFunc func(context.Context, *jetflow.Request) (chan *jetflow.Response, error)
+
+func (f publisherFunc) Publish(ctx context.Context, req *jetflow.Request) (chan *jetflow.Response, error) {
+	return f(ctx, req)
+}
+
+func TestClientCallDeadline(t *testing.T) {
+	deadline := time.Now().Add(time.Minute)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	publisher := publisherFunc(func(ctx context.Context, req *jetflow.Request) (chan *jetflow.Response, error) {
+		require.InDelta(t, time.Minute, req.Timeout, float64(time.Second))
+
+		// The timeout is rebased on the clock of the receiver.
+		handleCtx, cancel := jetflow.ContextWithRequestDeadline(context.Background(), req)
+		defer cancel()
+		handleDeadline, ok := handleCtx.Deadline()
+		require.True(t, ok)
+		require.WithinDuration(t, deadline, handleDeadline, time.Second)
+
+		responses := make(chan *jetflow.Response, 1)
+		responses <- req.Response(ctx, nil, nil)
+		return responses, nil
+	})
+	client := jetflow.NewClient(jetflow.ProxyFactoryMapping{}, publisher)
+	_, err := client.Call(ctx, &jetflow.Request{TypeName: "TestType", InstanceID: "test"})
+	require.NoError(t, err)
+}
@@ -21,6 +21,55 @@ func ContextWithOperationID(ctx context.Context, operationID string) context.Con
 	return context.WithValue(ctx, operationIDKey, operationID)
 }
 
+// transactionTimeKey
+var transactionTimeKey ctxKey = "TRANSACTION_TIME"
+
+// TransactionTimeFromContext returns the time at which the transaction of the
+// context started in Unix nanoseconds, or 0 if it is unknown.
+func TransactionTimeFromContext(ctx context.Context) int64 {
+	transactionTime, _ := ctx.Value(transactionTimeKey).(int64)
+	return transactionTime
+}
+
+// ContextWithTransactionTime sets the time at which the transaction started
+// in Unix nanoseconds.
+func ContextWithTransactionTime(ctx context.Context, transactionTime int64) context.Context {
+	return context.WithValue(ctx, transactionTimeKey, transactionTime)
+}
+
+// idempotencyKeyKey
+var idempotencyKeyKey ctxKey = "IDEMPOTENCY_KEY"
+
+// ContextWithIdempotencyKey sets the key that identifies the calls made with
+// the context. Callers that retry a call use the same key, so an executor
+// WithDeduplication does not handle it twice.
+func ContextWithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyKey, key)
+}
+
+// IdempotencyKeyFromContext returns the idempotency key of the context, if
+// any.
+func IdempotencyKeyFromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(idempotencyKeyKey).(string)
+	return key, ok && key != ""
+}
+
+// originalTransactionIDKey
+var originalTransactionIDKey ctxKey = "ORIGINAL_TRANSACTION_ID"
+
+// OriginalTransactionIDFromContext returns the id of the first attempt of the
+// transaction of the context, or an empty string if it has none.
+func OriginalTransactionIDFromContext(ctx context.Context) string {
+	originalTransactionID, _ := ctx.Value(originalTransactionIDKey).(string)
+	return originalTransactionID
+}
+
+// ContextWithOriginalTransactionID sets the id of the first attempt of the
+// transaction, which is kept when the transaction is retried.
+func ContextWithOriginalTransactionID(ctx context.Context, originalTransactionID string) context.Context {
+	return context.WithValue(ctx, originalTransactionIDKey, originalTransactionID)
+}
+
 // involvedOperatorsKey
 var involvedOperatorsKey ctxKey = "INVOLVED_OPERATORS"
 
@@ -47,3 +96,13 @@ func ContextAddInvolvedOperator(ctx context.Context, name, id string) context.Co
 	instances[id] = true
 	return ContextWithInvolvedOperators(ctx, operators)
 }
+
+// ContextWithRequestDeadline returns a copy of ctx with the timeout of the
+// request, so the handling of a request stops when its caller gave up. The
+// timeout starts when the request is received.
+func ContextWithRequestDeadline(ctx context.Context, req *Request) (context.Context, context.CancelFunc) {
+	if req.Timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, req.Timeout)
+}
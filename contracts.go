@@ -2,6 +2,8 @@ package jetflow
 
 import (
 	"context"
+	"encoding/json"
+	"time"
 )
 
 // Operator is the minimal interface for all operators.
@@ -17,6 +19,48 @@ type OperatorHandler interface {
 	Handle(context.Context, OperatorClient, *Request) ([]byte, error)
 }
 
+// StatefulHandler is an OperatorHandler whose operator state can be
+// serialized, so it can be persisted and compared by a Storage. The handlers
+// that jetflowgen generates implement it.
+type StatefulHandler interface {
+	OperatorHandler
+	// MarshalState returns the state of the operator. Equal states must
+	// marshal to equal bytes, because storages compare them to detect
+	// writes.
+	MarshalState() ([]byte, error)
+	// UnmarshalState replaces the state of the operator by the state that
+	// MarshalState returned.
+	UnmarshalState([]byte) error
+}
+
+// StrictHandler is an OperatorHandler that tells whether its operator must be
+// created explicitly. Calls to a strict operator that was not created fail
+// with ErrNotFound.
+type StrictHandler interface {
+	OperatorHandler
+	Strict() bool
+}
+
+// ActivationHandler is an OperatorHandler that is notified when a Storage
+// loads its operator into memory or passivates it.
+type ActivationHandler interface {
+	OperatorHandler
+	OnActivate(context.Context) error
+	OnDeactivate(context.Context) error
+}
+
+// Activator is implemented by operators that want to be notified when they
+// are loaded into memory.
+type Activator interface {
+	OnActivate(context.Context) error
+}
+
+// Deactivator is implemented by operators that want to be notified when they
+// are removed from memory because they were idle.
+type Deactivator interface {
+	OnDeactivate(context.Context) error
+}
+
 //go:generate go run github.com/vektra/mockery/v2 --name OperatorClient --case underscore --with-expecter
 type OperatorClient interface {
 	Find(ctx context.Context, id string, operator interface{}) error
@@ -52,3 +96,124 @@ type Storage interface {
 	Commit(context.Context, *Request) error
 	Rollback(context.Context, *Request) error
 }
+
+// SnapshotStorage is a Storage that can serve read-only calls without
+// creating a version of the operator for the transaction.
+type SnapshotStorage interface {
+	Storage
+	// GetSnapshot returns the version of the operator of the transaction if
+	// it exists, or the committed version otherwise. The returned operator
+	// may be shared between transactions and must not be modified.
+	GetSnapshot(context.Context, *Request) (OperatorHandler, error)
+}
+
+// SerializableStorage is a SnapshotStorage that can validate the operators
+// that a transaction read when it is prepared. If Serializable reports true,
+// read-only calls within a transaction are not served from snapshots, so
+// their reads are validated too.
+type SerializableStorage interface {
+	SnapshotStorage
+	Serializable() bool
+}
+
+// LifecycleStorage is a Storage that can create, check and delete operators
+// in a transaction.
+//
+// Operators that are not strict exist implicitly: Exists reports true for
+// them, Create fails and Delete resets them to their initial state.
+type LifecycleStorage interface {
+	Storage
+	// Create creates the operator in the version of the transaction. It
+	// fails with ErrAlreadyExists if the operator exists.
+	Create(context.Context, *Request) error
+	// Exists reports whether the operator exists in the version of the
+	// transaction, or in the committed version if there is none.
+	Exists(context.Context, *Request) (bool, error)
+	// Delete deletes the operator in the version of the transaction. It fails
+	// with ErrNotFound if the operator does not exist.
+	Delete(context.Context, *Request) error
+}
+
+// RecoverableStorage is a Storage that can list its prepared operators, so an
+// Executor can resolve them when their coordinator never committed or rolled
+// them back.
+type RecoverableStorage interface {
+	Storage
+	// Prepared returns the prepare requests of the operators that were
+	// prepared before the given time and are not committed or rolled back.
+	Prepared(ctx context.Context, before time.Time) ([]*Request, error)
+}
+
+// Decision is the outcome of the two-phase commit of a transaction.
+type Decision struct {
+	TransactionID string `json:"o"`
+	// Outcome is either MethodCommit or MethodRollback.
+	Outcome   Method                     `json:"m"`
+	Operators map[string]map[string]bool `json:"p"`
+	Time      time.Time                  `json:"t"`
+	// Presumed is set for the rollbacks that Executor.Outcome logs for
+	// transactions without a decision. They are never completed, so the
+	// coordinator can not commit the transaction after one of its operators
+	// rolled it back, however late it decides.
+	Presumed bool `json:"a,omitempty"`
+}
+
+// DecisionLog durably records the decisions of the two-phase commits that
+// an Executor coordinates, so they survive a crash of the coordinator.
+//
+// Transactions without a decision are presumed to be rolled back, so only
+// commit decisions must be logged before they are sent to the operators.
+type DecisionLog interface {
+	// Log records the decision. It fails with ErrDecided if a decision for
+	// the transaction was already logged.
+	Log(context.Context, Decision) error
+	// Decision returns the decision for the transaction, or false if none
+	// was logged or it was completed.
+	Decision(ctx context.Context, transactionID string) (Decision, bool, error)
+	// Complete forgets the decision once all involved operators applied it.
+	Complete(ctx context.Context, transactionID string) error
+	// Pending returns the decisions that were logged before the given time
+	// and are not completed.
+	Pending(ctx context.Context, before time.Time) ([]Decision, error)
+}
+
+// Change is a new committed version of an operator, as passed to a
+// CommitHook.
+type Change struct {
+	TypeName      string `json:"n"`
+	InstanceID    string `json:"i"`
+	Version       uint64 `json:"v"`
+	TransactionID string `json:"o"`
+	// State is the committed state, or nil if the operator was deleted.
+	State json.RawMessage `json:"s"`
+	// PreviousState is the state of the previous version, so consumers can
+	// compute the difference. It is nil if the operator did not exist.
+	PreviousState json.RawMessage `json:"p,omitempty"`
+}
+
+// CommitHook is called synchronously by a Storage after it committed a new
+// version of an operator. The versions of an operator increase with every
+// commit, also after it was passivated or a durable storage restarted, so
+// consumers can use them to order changes. The transaction id identifies a
+// change, so consumers can use it to deduplicate changes.
+type CommitHook func(context.Context, Change)
+
+// StateRecord is the committed state of an operator instance, as returned by
+// StatefulHandler.MarshalState.
+type StateRecord struct {
+	TypeName   string          `json:"n"`
+	InstanceID string          `json:"i"`
+	State      json.RawMessage `json:"s"`
+}
+
+// ExportableStorage is a Storage whose committed operator states can be
+// exported and imported in bulk, without going through transactions.
+type ExportableStorage interface {
+	Storage
+	// Export calls fn with the committed state of every operator of the
+	// given types, or of all types if none are given.
+	Export(ctx context.Context, typeNames []string, fn func(StateRecord) error) error
+	// Import stores the state as the committed state of the operator. It
+	// fails if the operator already exists.
+	Import(context.Context, StateRecord) error
+}
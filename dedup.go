@@ -0,0 +1,88 @@
+package jetflow
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// deduplicator remembers the responses of recently handled requests, so
+// duplicates of a request get the same response.
+type deduplicator struct {
+	retention time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*dedupEntry
+	purged  time.Time
+}
+
+type dedupEntry struct {
+	key string
+	// done is closed once the response is set.
+	done     chan struct{}
+	response *Response
+	handled  time.Time
+}
+
+func newDeduplicator(retention time.Duration) *deduplicator {
+	return &deduplicator{
+		retention: retention,
+		entries:   map[string]*dedupEntry{},
+		purged:    time.Now(),
+	}
+}
+
+// start returns the entry of the request with the given key and whether the
+// request is a duplicate. Duplicates wait until the entry is done, the
+// caller of the first request must call finish.
+func (d *deduplicator) start(key string) (*dedupEntry, bool) {
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if now.Sub(d.purged) > d.retention {
+		d.purge(now)
+	}
+
+	entry, ok := d.entries[key]
+	if ok && (entry.handled.IsZero() || now.Sub(entry.handled) <= d.retention) {
+		return entry, true
+	}
+	entry = &dedupEntry{key: key, done: make(chan struct{})}
+	d.entries[key] = entry
+	return entry, false
+}
+
+// finish sets the response of the entry and releases its duplicates. The
+// response is forgotten if its error is transient, so a later duplicate is
+// handled again.
+func (d *deduplicator) finish(entry *dedupEntry, response *Response) {
+	d.mu.Lock()
+	entry.response = response
+	entry.handled = time.Now()
+	if transient(response.Error) && d.entries[entry.key] == entry {
+		delete(d.entries, entry.key)
+	}
+	d.mu.Unlock()
+	close(entry.done)
+}
+
+// purge forgets the responses that are older than the retention window.
+func (d *deduplicator) purge(now time.Time) {
+	for key, entry := range d.entries {
+		if !entry.handled.IsZero() && now.Sub(entry.handled) > d.retention {
+			delete(d.entries, key)
+		}
+	}
+	d.purged = now
+}
+
+// transient returns whether handling the request again may succeed.
+func transient(err error) bool {
+	return errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, ErrConflict)
+}
@@ -0,0 +1,58 @@
+package jetflow
+
+import (
+	"context"
+	"time"
+
+	"github.com/mathieupost/jetflow/log"
+)
+
+// DefaultDeliveryTimeout is the time in which commit and rollback decisions
+// are sent again until all involved operators acknowledged them.
+const DefaultDeliveryTimeout = time.Minute
+
+// deliveryBackoff is the backoff between the attempts to deliver a decision.
+// It does not depend on the RetryPolicy of the executor, so a policy without
+// backoff, like NoRetry, does not send the decision in a tight loop.
+var deliveryBackoff = RetryPolicy{
+	InitialBackoff: 10 * time.Millisecond,
+	MaxBackoff:     time.Second,
+	Multiplier:     2,
+	Jitter:         0.5,
+}
+
+// deliver sends a request with the method to the operators with the client
+// until all of them succeeded, waiting between the attempts according to the
+// deliveryBackoff. It reports false if the context is done before that.
+func deliver(ctx context.Context, client OperatorClient, method Method, operators map[string]map[string]bool) bool {
+	pending := operators
+	for attempt := 1; ; attempt++ {
+		pending = broadcast(ctx, client, method, pending, nil)
+		if len(pending) == 0 {
+			return true
+		}
+
+		select {
+		case <-time.After(deliveryBackoff.Backoff(attempt)):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// deliver sends the method to the operators until all of them acknowledged it
+// or the delivery timeout of the executor expired.
+func (w *Executor) deliver(ctx context.Context, method Method, operators map[string]map[string]bool) bool {
+	ctx, cancel := context.WithTimeout(ctx, w.deliveryTimeout)
+	defer cancel()
+	return deliver(ctx, w.client, method, operators)
+}
+
+// rollback sends the rollback to the operators. Operators that did not
+// acknowledge it within the delivery timeout stay prepared until their
+// Recover asks for the outcome, which is then presumed to be a rollback.
+func (w *Executor) rollback(ctx context.Context, transactionID string, operators map[string]map[string]bool) {
+	if !w.deliver(ctx, MethodRollback, operators) {
+		log.Println("Executor rollback not acknowledged:", transactionID)
+	}
+}
@@ -0,0 +1,160 @@
+package jetflow
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrNotFound is returned for calls to a strict operator that was not
+	// created or that was deleted.
+	ErrNotFound = errors.New("operator not found")
+	// ErrAlreadyExists is returned when creating an operator that exists.
+	ErrAlreadyExists = errors.New("operator already exists")
+	// ErrConflict is returned when a transaction conflicts with another
+	// transaction, for example because it could not prepare an operator.
+	ErrConflict = errors.New("transaction conflict")
+	// ErrPanic is returned for calls to an operator that panicked.
+	ErrPanic = errors.New("operator panicked")
+	// ErrDecided is returned by a DecisionLog when a decision for the
+	// transaction was already logged.
+	ErrDecided = errors.New("transaction already decided")
+)
+
+// Codes of the errors of the framework.
+const (
+	CodeNotFound      = "not_found"
+	CodeAlreadyExists = "already_exists"
+	CodeConflict      = "conflict"
+	CodeTimeout       = "timeout"
+	CodeCanceled      = "canceled"
+	CodePanic         = "panic"
+)
+
+// Error is an error with a code and structured details. It keeps its
+// identity when it is sent in a Response: errors.Is reports whether two
+// Errors have the same code, and errors.As returns the details on the
+// calling side.
+//
+// Details are sent as JSON, so numbers are received as float64.
+type Error struct {
+	Code    string
+	Message string
+	Details map[string]interface{}
+}
+
+// NewError returns an Error with the code and message and registers it, like
+// RegisterError.
+func NewError(code, message string) *Error {
+	err := &Error{Code: code, Message: message}
+	RegisterError(code, err)
+	return err
+}
+
+// Error implements error.
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is reports whether target is an Error with the same code.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// WithDetails returns a copy of the error with the details.
+func (e *Error) WithDetails(details map[string]interface{}) *Error {
+	err := *e
+	err.Details = details
+	return &err
+}
+
+// registry maps the codes of the errors that keep their identity when a
+// Response is sent over a transport to their error, and back.
+var registry = struct {
+	sync.RWMutex
+	errors map[string]error
+	codes  map[error]string
+}{
+	errors: map[string]error{},
+	codes:  map[error]string{},
+}
+
+func init() {
+	RegisterError(CodeNotFound, ErrNotFound)
+	RegisterError(CodeAlreadyExists, ErrAlreadyExists)
+	RegisterError(CodeConflict, ErrConflict)
+	RegisterError(CodeTimeout, context.DeadlineExceeded)
+	RegisterError(CodeCanceled, context.Canceled)
+	RegisterError(CodePanic, ErrPanic)
+}
+
+// RegisterError registers a sentinel error with a code, so errors that wrap
+// it can be checked with errors.Is after they were received in a Response.
+// Both sides of the transport must register the error, typically in a
+// package level variable. Registering a code again replaces its error.
+func RegisterError(code string, err error) {
+	registry.Lock()
+	defer registry.Unlock()
+	if previous, ok := registry.errors[code]; ok {
+		delete(registry.codes, previous)
+	}
+	registry.errors[code] = err
+	registry.codes[err] = code
+}
+
+// errorCode returns the code and details of the error that err wraps, if any.
+func errorCode(err error) (string, map[string]interface{}) {
+	var typed *Error
+	if errors.As(err, &typed) {
+		return typed.Code, typed.Details
+	}
+
+	registry.RLock()
+	defer registry.RUnlock()
+	for target, code := range registry.codes {
+		if errors.Is(err, target) {
+			return code, nil
+		}
+	}
+	return "", nil
+}
+
+// remoteError is an error received in a Response. It wraps the error with
+// the code of the response, so it can be checked with errors.Is.
+type remoteError struct {
+	message string
+	err     error
+}
+
+func newRemoteError(message, code string, details map[string]interface{}) error {
+	if code == "" {
+		return errors.New(message)
+	}
+
+	registry.RLock()
+	target, ok := registry.errors[code]
+	registry.RUnlock()
+
+	typed, isTyped := target.(*Error)
+	switch {
+	case !ok:
+		// Keep the code and details of errors that are not registered.
+		target = &Error{Code: code, Message: message, Details: details}
+	case isTyped && details != nil:
+		target = typed.WithDetails(details)
+	}
+	return &remoteError{message, target}
+}
+
+// Error implements error.
+func (e *remoteError) Error() string {
+	return e.message
+}
+
+// Unwrap returns the error of the code of the response.
+func (e *remoteError) Unwrap() error {
+	return e.err
+}
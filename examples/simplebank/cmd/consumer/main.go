@@ -6,8 +6,10 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/mathieupost/jetflow"
+	"github.com/mathieupost/jetflow/storage/decisionlog"
 	"github.com/mathieupost/jetflow/storage/memory"
 	"github.com/mathieupost/jetflow/tracing"
 	"github.com/mathieupost/jetflow/transport/jetstream"
@@ -73,7 +75,16 @@ func main() {
 	handlerFactory := gen.HandlerFactoryMapping()
 	storage := memory.NewStorage(handlerFactory)
 
-	executor := jetflow.NewExecutor(storage, client)
+	decisions, err := decisionlog.NewKVLog(ctx, js, "DECISIONS")
+	if err != nil {
+		log.Fatal("initializing decision log", err.Error())
+	}
+
+	executor := jetflow.NewExecutor(storage, client,
+		jetflow.WithDecisionLog(decisions),
+		jetflow.WithDeduplication(time.Minute),
+	)
+	executor.StartRecovery(ctx, time.Minute, time.Minute)
 	jetstream.NewConsumer(ctx, consumerID, js, executor)
 
 	log.Println("Consumer started")
@@ -118,7 +118,7 @@ func main() {
 		errStr := ""
 		if err != nil {
 			errStr = err.Error()
-			w.WriteHeader(http.StatusInternalServerError)
+			w.WriteHeader(errorStatus(err))
 			log.Println(action, id1, errStr)
 			return
 		}
@@ -151,7 +151,9 @@ func main() {
 				amount := r.Context().Value("amount").(int)
 				balance1, balance2, err := user.TransferBalance(r.Context(), user2, amount)
 				if err != nil {
-					log.Fatal(r.URL.Path, err.Error())
+					log.Println(r.URL.Path, err.Error())
+					http.Error(w, err.Error(), errorStatus(err))
+					return
 				}
 				fmt.Fprintf(w, "{balance1:%d,balance2:%d}", balance1, balance2)
 			})
@@ -161,6 +163,22 @@ func main() {
 	log.Fatal(http.ListenAndServe(":8080", r))
 }
 
+// errorStatus returns the HTTP status code for an error of a call.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, types.ErrInsufficientBalance), errors.Is(err, types.ErrNegativeAmount):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, jetflow.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, jetflow.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func Operator[O jetflow.Operator](client jetflow.OperatorClient, param string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
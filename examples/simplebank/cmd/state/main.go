@@ -0,0 +1,98 @@
+// Command state exports the committed operator states of a storage to a
+// JSON-lines file, or bulk-loads such a file into an empty storage.
+//
+//	state -dir data -export users.jsonl -types User
+//	state -nats localhost -bucket operators -import users.jsonl
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	natsjetstream "github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mathieupost/jetflow"
+	"github.com/mathieupost/jetflow/storage/dump"
+	"github.com/mathieupost/jetflow/storage/file"
+	"github.com/mathieupost/jetflow/storage/jetstreamkv"
+
+	"github.com/mathieupost/jetflow/examples/simplebank/types/gen"
+)
+
+func main() {
+	exportPath := flag.String("export", "", "file to export the committed states to")
+	importPath := flag.String("import", "", "file to import the committed states from")
+	types := flag.String("types", "", "comma separated operator types to export (default all)")
+	dir := flag.String("dir", "", "directory of a file storage")
+	natsHost := flag.String("nats", "", "NATS host of a JetStream key-value storage")
+	bucket := flag.String("bucket", "jetflow", "bucket of the JetStream key-value storage")
+	flag.Parse()
+
+	if (*exportPath == "") == (*importPath == "") {
+		log.Fatal("exactly one of -export and -import is required")
+	}
+
+	ctx := context.Background()
+	mapping := gen.HandlerFactoryMapping()
+
+	var storage jetflow.ExportableStorage
+	switch {
+	case *dir != "":
+		s, err := file.NewStorage(mapping, *dir)
+		if err != nil {
+			log.Fatal("opening file storage: ", err.Error())
+		}
+		defer s.Close()
+		storage = s
+	case *natsHost != "":
+		nc, err := nats.Connect(*natsHost)
+		if err != nil {
+			log.Fatal("connecting to NATS: ", err.Error())
+		}
+		defer nc.Close()
+		js, err := natsjetstream.New(nc)
+		if err != nil {
+			log.Fatal("initializing JetStream instance: ", err.Error())
+		}
+		s, err := jetstreamkv.NewStorage(ctx, mapping, js, *bucket)
+		if err != nil {
+			log.Fatal("opening key-value storage: ", err.Error())
+		}
+		storage = s
+	default:
+		log.Fatal("one of -dir and -nats is required")
+	}
+
+	if *exportPath != "" {
+		var typeNames []string
+		if *types != "" {
+			typeNames = strings.Split(*types, ",")
+		}
+		f, err := os.Create(*exportPath)
+		if err != nil {
+			log.Fatal("creating export file: ", err.Error())
+		}
+		defer f.Close()
+		count, err := dump.Export(ctx, storage, typeNames, f)
+		if err != nil {
+			log.Fatal("exporting: ", err.Error())
+		}
+		log.Printf("Exported %d operators", count)
+		return
+	}
+
+	f, err := os.Open(*importPath)
+	if err != nil {
+		log.Fatal("opening import file: ", err.Error())
+	}
+	defer f.Close()
+	count, err := dump.Import(ctx, storage, mapping, f)
+	if err != nil {
+		log.Fatal("importing: ", err.Error())
+	}
+	log.Printf("Imported %d operators", count)
+}
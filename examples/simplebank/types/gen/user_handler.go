@@ -13,7 +13,12 @@ import (
 	types "github.com/mathieupost/jetflow/examples/simplebank/types"
 )
 
-var _ jetflow.OperatorHandler = (*UserHandler)(nil)
+var (
+	_ jetflow.StatefulHandler   = (*UserHandler)(nil)
+	_ jetflow.ActivationHandler = (*UserHandler)(nil)
+	_ jetflow.StrictHandler     = (*UserHandler)(nil)
+	_ jetflow.VersionedHandler  = (*UserHandler)(nil)
+)
 
 type UserHandler struct {
 	instance types.User
@@ -88,3 +93,68 @@ func (o *UserHandler) Handle(ctx context.Context, client jetflow.OperatorClient,
 		return nil, errors.Errorf("unknown method %s", call.Method)
 	}
 }
+
+// MarshalState implements jetflow.StatefulHandler.
+//
+// The state of the User is marshalled as JSON, so an
+// implementation with unexported fields implements json.Marshaler and
+// json.Unmarshaler.
+func (o *UserHandler) MarshalState() ([]byte, error) {
+	data, err := json.Marshal(o.instance)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshalling User state")
+	}
+	return jetflow.VersionState(o.StateVersion(), data)
+}
+
+// UnmarshalState implements jetflow.StatefulHandler.
+//
+// States of older versions are migrated before they are unmarshalled.
+func (o *UserHandler) UnmarshalState(data []byte) error {
+	state, err := jetflow.MigrateState(o, data)
+	if err != nil {
+		return errors.Wrap(err, "migrating User state")
+	}
+	err = json.Unmarshal(state, o.instance)
+	return errors.Wrap(err, "unmarshalling User state")
+}
+
+// StateVersion implements jetflow.VersionedHandler.
+func (o *UserHandler) StateVersion() int {
+	return 2
+}
+
+// Migrations implements jetflow.VersionedHandler.
+func (o *UserHandler) Migrations() map[int]jetflow.Migration {
+	return map[int]jetflow.Migration{
+		1: types.MigrateUserV1,
+	}
+}
+
+// Strict implements jetflow.StrictHandler.
+func (o *UserHandler) Strict() bool {
+	return false
+}
+
+// OnActivate implements jetflow.ActivationHandler.
+//
+// It calls OnActivate on the User if it implements jetflow.Activator.
+func (o *UserHandler) OnActivate(ctx context.Context) error {
+	activator, ok := o.instance.(jetflow.Activator)
+	if !ok {
+		return nil
+	}
+	return errors.Wrap(activator.OnActivate(ctx), "activating User")
+}
+
+// OnDeactivate implements jetflow.ActivationHandler.
+//
+// It calls OnDeactivate on the User if it implements
+// jetflow.Deactivator.
+func (o *UserHandler) OnDeactivate(ctx context.Context) error {
+	deactivator, ok := o.instance.(jetflow.Deactivator)
+	if !ok {
+		return nil
+	}
+	return errors.Wrap(deactivator.OnDeactivate(ctx), "deactivating User")
+}
@@ -80,6 +80,19 @@ func (u *UserProxy) TransferBalance(
 	return result.Res0, result.Res1, nil
 }
 
+// TransferBalanceAsync calls TransferBalance asynchronously.
+// The Future must be awaited before the transaction ends.
+func (u *UserProxy) TransferBalanceAsync(
+	ctx context.Context,
+	u2 types.User,
+	amount int,
+) *jetflow.Future[User_TransferBalance_Result] {
+	return jetflow.Async(ctx, func(ctx context.Context) (result User_TransferBalance_Result, err error) {
+		result.Res0, result.Res1, err = u.TransferBalance(ctx, u2, amount)
+		return
+	})
+}
+
 type User_AddBalance_Args struct {
 	Amount int
 }
@@ -126,6 +139,18 @@ func (u *UserProxy) AddBalance(
 	return result.Res0, nil
 }
 
+// AddBalanceAsync calls AddBalance asynchronously.
+// The Future must be awaited before the transaction ends.
+func (u *UserProxy) AddBalanceAsync(
+	ctx context.Context,
+	amount int,
+) *jetflow.Future[User_AddBalance_Result] {
+	return jetflow.Async(ctx, func(ctx context.Context) (result User_AddBalance_Result, err error) {
+		result.Res0, err = u.AddBalance(ctx, amount)
+		return
+	})
+}
+
 type User_GetBalance_Result struct {
 	Res0 int
 }
@@ -137,6 +162,7 @@ func (u *UserProxy) GetBalance(
 		TypeName:   "User",
 		InstanceID: u.id,
 		Method:     "GetBalance",
+		ReadOnly:   true,
 	}
 
 	var res []byte
@@ -156,6 +182,17 @@ func (u *UserProxy) GetBalance(
 	return result.Res0, nil
 }
 
+// GetBalanceAsync calls GetBalance asynchronously.
+// The Future must be awaited before the transaction ends.
+func (u *UserProxy) GetBalanceAsync(
+	ctx context.Context,
+) *jetflow.Future[User_GetBalance_Result] {
+	return jetflow.Async(ctx, func(ctx context.Context) (result User_GetBalance_Result, err error) {
+		result.Res0, err = u.GetBalance(ctx)
+		return
+	})
+}
+
 // MarshalJSON implements json.Marshaler.
 func (u UserProxy) MarshalJSON() ([]byte, error) {
 	return json.Marshal(u.id)
@@ -4,12 +4,16 @@ import (
 	"context"
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 
 	"github.com/mathieupost/jetflow"
 	"github.com/mathieupost/jetflow/mocks"
+	"github.com/mathieupost/jetflow/storage/memory"
+
+	"github.com/mathieupost/jetflow/examples/simplebank/types"
 )
 
 func TestTransferBalance(t *testing.T) {
@@ -34,3 +38,65 @@ func TestTransferBalance(t *testing.T) {
 	_, err = handler.Handle(ctx, client, call)
 	require.NoError(t, err)
 }
+
+func TestUnmarshalStateV1(t *testing.T) {
+	ctx := context.Background()
+	v1 := []byte(`{"id":"user1","balance":10}`)
+
+	// The version 1 state is migrated when it is unmarshalled.
+	handler := NewUserHandler("user1").(*UserHandler)
+	require.NoError(t, handler.UnmarshalState(v1))
+	state, err := handler.MarshalState()
+	require.NoError(t, err)
+	require.JSONEq(t, `{"$v":2,"$s":{"id":"user1","balance":10,"currency":"EUR"}}`, string(state))
+
+	// Storages upgrade the state they load, so reading the migrated
+	// operator does not write it.
+	storage := memory.NewStorage(HandlerFactoryMapping())
+	err = storage.Import(ctx, jetflow.StateRecord{TypeName: "User", InstanceID: "user1", State: v1})
+	require.NoError(t, err)
+	call := &jetflow.Request{
+		TransactionID: "tx",
+		TypeName:      "User",
+		InstanceID:    "user1",
+		Method:        "GetBalance",
+	}
+	operator, err := storage.Get(ctx, call)
+	require.NoError(t, err)
+	res, err := operator.Handle(ctx, nil, call)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"Res0":10}`, string(res))
+	require.NoError(t, storage.Prepare(ctx, call))
+	prepared, err := storage.Prepared(ctx, time.Now())
+	require.NoError(t, err)
+	require.Empty(t, prepared)
+}
+
+func TestTransferBalanceInsufficient(t *testing.T) {
+	ctx := context.Background()
+	client := mocks.NewOperatorClient(t)
+	proxy := NewUserProxy("user2", client)
+	handler := NewUserHandler("user1")
+
+	args := User_TransferBalance_Args{
+		U2:     proxy.(*UserProxy),
+		Amount: 2000000,
+	}
+	data, err := json.Marshal(args)
+	require.NoError(t, err)
+	call := &jetflow.Request{
+		Method: "TransferBalance",
+		Args:   data,
+	}
+	_, err = handler.Handle(ctx, client, call)
+
+	// The error keeps its identity and details when it is sent back.
+	data, err = json.Marshal(call.Response(ctx, nil, err))
+	require.NoError(t, err)
+	var res jetflow.Response
+	require.NoError(t, json.Unmarshal(data, &res))
+	require.ErrorIs(t, res.Error, types.ErrInsufficientBalance)
+	var typed *jetflow.Error
+	require.ErrorAs(t, res.Error, &typed)
+	require.Equal(t, 2000000.0, typed.Details["amount"])
+}
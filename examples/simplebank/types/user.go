@@ -2,27 +2,39 @@ package types
 
 import (
 	"context"
+	"encoding/json"
 
 	"github.com/mathieupost/jetflow"
 	"github.com/pkg/errors"
 )
 
+var (
+	// ErrInsufficientBalance is returned when a user transfers more than its
+	// balance. Its details contain the balance and the amount.
+	ErrInsufficientBalance = jetflow.NewError("insufficient_balance", "insufficient balance")
+	// ErrNegativeAmount is returned for negative amounts.
+	ErrNegativeAmount = jetflow.NewError("negative_amount", "amount cannot be negative")
+)
+
+//jetflow:version 2
 type User interface {
 	jetflow.Operator // Inherit the ID() string method of jetflow.Operator.
 	TransferBalance(ctx context.Context, u2 User, amount int) (int, int, error)
 	AddBalance(ctx context.Context, amount int) (int, error)
+	//jetflow:readonly
 	GetBalance(ctx context.Context) (int, error)
 }
 
 func NewUser(id string) User {
-	return &user{id: id, balance: 1000000}
+	return &user{id: id, balance: 1000000, currency: "EUR"}
 }
 
 var _ jetflow.Operator = (*user)(nil)
 
 type user struct {
-	id      string
-	balance int
+	id       string
+	balance  int
+	currency string
 }
 
 // ID implements jetflow.Operator interface.
@@ -30,13 +42,52 @@ func (u *user) ID() string {
 	return u.id
 }
 
+// userState is the persisted state of a user.
+type userState struct {
+	ID       string `json:"id"`
+	Balance  int    `json:"balance"`
+	Currency string `json:"currency"`
+}
+
+// MigrateUserV1 upgrades the state of a user from version 1, which had no
+// currency, to version 2.
+func MigrateUserV1(state json.RawMessage) (json.RawMessage, error) {
+	var user map[string]interface{}
+	err := json.Unmarshal(state, &user)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshalling user state")
+	}
+	user["currency"] = "EUR"
+	return json.Marshal(user)
+}
+
+// MarshalJSON implements json.Marshaler, so the state of the user can be
+// stored.
+func (u *user) MarshalJSON() ([]byte, error) {
+	return json.Marshal(userState{u.id, u.balance, u.currency})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (u *user) UnmarshalJSON(data []byte) error {
+	var state userState
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+	u.id, u.balance, u.currency = state.ID, state.Balance, state.Currency
+	return nil
+}
+
 func (u *user) TransferBalance(ctx context.Context, u2 User, amount int) (int, int, error) {
 	if amount < 0 {
-		return 0, 0, errors.New("amount cannot be negative")
+		return 0, 0, ErrNegativeAmount
 	}
 
 	if u.balance < amount {
-		return 0, 0, errors.New("insufficient balance")
+		return 0, 0, ErrInsufficientBalance.WithDetails(map[string]interface{}{
+			"balance": u.balance,
+			"amount":  amount,
+		})
 	}
 
 	res, err := u2.AddBalance(ctx, amount)
@@ -51,7 +102,7 @@ func (u *user) TransferBalance(ctx context.Context, u2 User, amount int) (int, i
 
 func (u *user) AddBalance(ctx context.Context, amount int) (int, error) {
 	if amount < 0 {
-		return 0, errors.New("amount cannot be negative")
+		return 0, ErrNegativeAmount
 	}
 
 	u.balance += amount
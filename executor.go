@@ -2,31 +2,144 @@ package jetflow
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"runtime/debug"
 	"sync"
-	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/mathieupost/jetflow/log"
 )
 
 type Executor struct {
-	client  OperatorClient
-	storage Storage
+	client    OperatorClient
+	storage   Storage
+	decisions DecisionLog
+	dedup     *deduplicator
+	retry     RetryPolicy
+	turns     *turns
+
+	syncCommit      bool
+	deliveryTimeout time.Duration
+	presumedTTL     time.Duration
+}
+
+type ExecutorOption func(*Executor)
+
+// WithDecisionLog makes the executor log the decisions of the two-phase
+// commits it coordinates before sending them to the involved operators, so
+// Recover can send them again after a crash.
+func WithDecisionLog(log DecisionLog) ExecutorOption {
+	return func(w *Executor) {
+		w.decisions = log
+	}
+}
+
+// WithRetryPolicy sets the policy for retrying transactions that were
+// aborted. Defaults to DefaultRetryPolicy.
+func WithRetryPolicy(policy RetryPolicy) ExecutorOption {
+	return func(w *Executor) {
+		w.retry = policy
+	}
+}
+
+// WithDeduplication makes the executor remember the responses of the
+// requests it handled for the retention window. Duplicates of a request, for
+// example because it was redelivered, or retried by its caller with the same
+// IdempotencyKey, get the same response without handling the request again.
+// Responses with a context error or ErrConflict are not remembered, so the
+// request is handled again when it is retried.
+func WithDeduplication(retention time.Duration) ExecutorOption {
+	return func(w *Executor) {
+		w.dedup = newDeduplicator(retention)
+	}
+}
+
+// WithDeliveryTimeout sets the time in which commit and rollback decisions
+// are sent again until all involved operators acknowledged them. Decisions
+// that are not acknowledged by then stay pending for Recover. Defaults to
+// DefaultDeliveryTimeout.
+func WithDeliveryTimeout(timeout time.Duration) ExecutorOption {
+	return func(w *Executor) {
+		w.deliveryTimeout = timeout
+	}
+}
+
+// WithPresumedRollbackTTL sets the time after which Recover completes the
+// rollbacks that Outcome presumed, so the decision log does not grow without
+// bound. It must be longer than the time in which a coordinator can still log
+// the commit of a transaction, that is, longer than the longest running
+// transaction. Defaults to DefaultPresumedRollbackTTL.
+func WithPresumedRollbackTTL(ttl time.Duration) ExecutorOption {
+	return func(w *Executor) {
+		w.presumedTTL = ttl
+	}
+}
+
+// WithSyncCommit makes the initial request of a transaction wait until all
+// involved operators acknowledged the commit before it replies, so the caller
+// reads its own writes.
+func WithSyncCommit() ExecutorOption {
+	return func(w *Executor) {
+		w.syncCommit = true
+	}
 }
 
-func NewExecutor(storage Storage, client OperatorClient) *Executor {
+func NewExecutor(storage Storage, client OperatorClient, opts ...ExecutorOption) *Executor {
 	w := &Executor{
 		client:  client,
 		storage: storage,
+		retry:   DefaultRetryPolicy,
+		turns:   newTurns(),
+
+		deliveryTimeout: DefaultDeliveryTimeout,
+		presumedTTL:     DefaultPresumedRollbackTTL,
+	}
+	for _, opt := range opts {
+		opt(w)
 	}
 
 	return w
 }
 
 func (w *Executor) Handle(ctx context.Context, req *Request) *Response {
+	ctx, cancel := ContextWithRequestDeadline(ctx, req)
+	defer cancel()
+
+	if w.dedup == nil {
+		return w.dispatch(ctx, req)
+	}
+
+	key := req.TransactionID + "." + req.RequestID
+	if req.IdempotencyKey != "" {
+		key = req.TypeName + "." + req.InstanceID + "." + req.IdempotencyKey
+	}
+	entry, duplicate := w.dedup.start(key)
+	if duplicate {
+		select {
+		case <-entry.done:
+			// Duplicates with an idempotency key have their own request
+			// id, which the caller needs to match the response.
+			response := *entry.response
+			response.RequestID = req.RequestID
+			return &response
+		case <-ctx.Done():
+			return req.Response(ctx, nil, errors.Wrap(ctx.Err(), "waiting for duplicate"))
+		}
+	}
+	response := w.dispatch(ctx, req)
+	w.dedup.finish(entry, response)
+	return response
+}
+
+// dispatch handles the request based on its method.
+func (w *Executor) dispatch(ctx context.Context, req *Request) *Response {
 	switch req.Method {
 	case string(MethodPrepare):
 		err := w.storage.Prepare(ctx, req)
@@ -37,6 +150,9 @@ func (w *Executor) Handle(ctx context.Context, req *Request) *Response {
 	case string(MethodRollback):
 		err := w.storage.Rollback(ctx, req)
 		return req.Response(ctx, nil, err)
+	case string(MethodOutcome):
+		outcome, err := w.Outcome(ctx, req.TransactionID)
+		return req.Response(ctx, []byte(outcome), err)
 	default:
 		return w.handleCall(ctx, req)
 	}
@@ -44,13 +160,45 @@ func (w *Executor) Handle(ctx context.Context, req *Request) *Response {
 
 func (w *Executor) handleCall(ctx context.Context, call *Request) *Response {
 	originalRequestID := call.RequestID
+	policy := w.retryPolicy(ctx, call)
+
+	// The time of the transaction is kept for its retries, so they are not
+	// younger than the transactions they conflict with.
+	if call.TransactionTime == 0 {
+		call.TransactionTime = time.Now().UnixNano()
+	}
+	ctx = ContextWithTransactionTime(ctx, call.TransactionTime)
+
+	// The id of the first attempt is kept for the retries as well, so the
+	// Mailbox recognizes the calls of the retries as calls of the same
+	// transaction.
+	if call.OriginalTransactionID == "" {
+		call.OriginalTransactionID = call.TransactionID
+	}
+	ctx = ContextWithOriginalTransactionID(ctx, call.OriginalTransactionID)
+
+	ctx, span := otel.Tracer("").Start(ctx, "jetflow.Executor.handleCall")
+	defer span.End()
 
-	retryEnabled := false
 	retryCount := 0
 	for {
 		res, success := w.try(ctx, call)
 
-		if !success && retryEnabled {
+		if !success && policy.retry(retryCount+1, res.Error) {
+			backoff := policy.Backoff(retryCount + 1)
+			span.AddEvent("retry", trace.WithAttributes(
+				attribute.Int("jetflow.attempt", retryCount+1),
+				attribute.String("jetflow.error", res.Error.Error()),
+				attribute.Int64("jetflow.backoff_ms", backoff.Milliseconds()),
+			))
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				res.Error = errors.Wrap(ctx.Err(), "waiting for retry")
+				res.RequestID = originalRequestID
+				return res
+			}
+
 			// Create a new transaction id for the retry. Otherwise, the retry
 			// may use the old state of the involved operators.
 			transactionID := fmt.Sprintf("%s-%d", originalRequestID, retryCount)
@@ -65,11 +213,24 @@ func (w *Executor) handleCall(ctx context.Context, call *Request) *Response {
 
 		}
 
+		span.SetAttributes(attribute.Int("jetflow.retries", retryCount))
 		res.RequestID = originalRequestID
 		return res
 	}
 }
 
+// retryPolicy returns the RetryPolicy for the call. The policy of the context
+// or the call overrides the policy of the executor.
+func (w *Executor) retryPolicy(ctx context.Context, call *Request) RetryPolicy {
+	if policy, ok := RetryPolicyFromContext(ctx); ok {
+		return policy
+	}
+	if call.RetryPolicy != nil {
+		return *call.RetryPolicy
+	}
+	return w.retry
+}
+
 func (w *Executor) try(ctx context.Context, call *Request) (*Response, bool) {
 	log.Println("Executor.processRequest\n", call)
 
@@ -80,7 +241,7 @@ func (w *Executor) try(ctx context.Context, call *Request) (*Response, bool) {
 
 	// The initial request has the same id as the operation.
 	isInitialRequest := call.TransactionID == call.RequestID
-	if isInitialRequest {
+	if isInitialRequest && len(response.InvolvedOperators) > 0 {
 		ctx, span := otel.Tracer("").Start(ctx, "jetflow.Executor.2pc")
 		defer span.End()
 
@@ -89,64 +250,136 @@ func (w *Executor) try(ctx context.Context, call *Request) (*Response, bool) {
 
 		// Try to prepare all involved operators.
 		if success {
-			prepared := w.broadcast(ctx, MethodPrepare, operators)
-			success = prepared
-			if !prepared {
-				response.Error = errors.New("Failed to prepare")
+			coordinator := &Address{call.TypeName, call.InstanceID}
+			failed := broadcast(ctx, w.client, MethodPrepare, operators, coordinator)
+			success = len(failed) == 0
+			if !success {
+				response.Error = errors.Wrap(ErrConflict, "Failed to prepare")
 			}
 		}
 
-		// Rollback and retry if we either got an error or if we could not
-		// prepare all involved operators.
-		if !success {
-			go w.broadcast(ctx, MethodRollback, operators)
+		// Abort the transaction if the caller gave up in the meantime.
+		if success && ctx.Err() != nil {
+			success = false
+			response.Error = errors.Wrap(ctx.Err(), "transaction aborted")
+		}
+
+		// The decision is sent after the request is handled, so it must not
+		// be canceled with the context of the request.
+		ctx = context.WithoutCancel(ctx)
 
+		// Log the commit decision before sending it, so it is not lost if
+		// the coordinator crashes.
+		if success {
+			decision := Decision{
+				TransactionID: call.TransactionID,
+				Outcome:       MethodCommit,
+				Operators:     operators,
+				Time:          time.Now(),
+			}
+			err := w.logDecision(ctx, decision)
+			if err == nil && w.syncCommit {
+				if !w.complete(ctx, decision) {
+					// The transaction is committed, but not all operators
+					// applied it yet.
+					log.Println("Executor commit not acknowledged:", call.TransactionID)
+				}
+				return response, true
+			}
+			if err == nil {
+				go w.complete(ctx, decision)
+				return response, true
+			}
+			response.Error = errors.Wrap(err, "logging commit")
+			if errors.Is(err, ErrDecided) {
+				// An operator asked for the outcome before the commit was
+				// logged, so the transaction is rolled back. The presumed
+				// rollback is kept in the log, so it is not completed.
+				go w.rollback(ctx, call.TransactionID, operators)
+			}
+			// Otherwise the commit may have been logged, so the operators
+			// stay prepared until Recover resolves them.
 			return response, false
-		} else {
-			go w.broadcast(ctx, MethodCommit, operators)
 		}
+
+		// Rollback and retry if we either got an error or if we could not
+		// prepare all involved operators. Rollbacks are not logged, because
+		// transactions without a decision are presumed to be rolled back.
+		go w.rollback(ctx, call.TransactionID, operators)
+
+		return response, false
 	}
 
 	return response, true
 }
 
-func (w *Executor) broadcast(ctx context.Context, method Method, operators map[string]map[string]bool) bool {
-	ctx, span := otel.Tracer("").Start(ctx, "jetflow.Executor.broadcast."+string(method))
+// broadcast sends a request with the method to all operators with the client
+// and returns the operators that did not succeed.
+func broadcast(ctx context.Context, client OperatorClient, method Method, operators map[string]map[string]bool, coordinator *Address) map[string]map[string]bool {
+	ctx, span := otel.Tracer("").Start(ctx, "jetflow.broadcast."+string(method))
 	defer span.End()
 
-	var success atomic.Bool
-	success.Store(true)
+	var mu sync.Mutex
+	failed := map[string]map[string]bool{}
 	var wg sync.WaitGroup
 	for name, instances := range operators {
 		for id := range instances {
 			request := &Request{
-				TypeName:   name,
-				InstanceID: id,
-				Method:     string(method),
+				TypeName:    name,
+				InstanceID:  id,
+				Method:      string(method),
+				Coordinator: coordinator,
 			}
 			wg.Add(1)
-			go func() {
-				_, err := w.client.Call(ctx, request)
+			go func(name, id string) {
+				_, err := client.Call(ctx, request)
 				if err != nil {
-					println("Executor.broadcast error:", err.Error())
-					success.Store(false)
+					println("broadcast error:", err.Error())
+					mu.Lock()
+					if failed[name] == nil {
+						failed[name] = map[string]bool{}
+					}
+					failed[name][id] = true
+					mu.Unlock()
 				}
 				wg.Done()
-			}()
+			}(name, id)
 		}
 	}
 	wg.Wait()
-	return success.Load()
+	return failed
 }
 
 func (w *Executor) handle(ctx context.Context, call *Request) *Response {
 	// (mis)use the context to keep track of the involved operators.
 	involvedOperators := map[string]map[string]bool{}
 	ctx = ContextWithInvolvedOperators(ctx, involvedOperators)
-	ContextAddInvolvedOperator(ctx, call.TypeName, call.InstanceID)
+	ctx = contextWithFutures(ctx)
+
+	switch Method(call.Method) {
+	case MethodCreate, MethodExists, MethodDelete:
+		return w.handleLifecycle(ctx, call)
+	}
 
-	operator, err := w.storage.Get(ctx, call)
+	var operator OperatorHandler
+	var err error
+	var turn *turn
+	snapshots, ok := w.storage.(SnapshotStorage)
+	if call.ReadOnly && ok && !w.validatesRead(call) {
+		// Read-only calls are served from the committed state, so the
+		// operator does not take part in the two-phase commit.
+		operator, err = snapshots.GetSnapshot(ctx, call)
+	} else {
+		ContextAddInvolvedOperator(ctx, call.TypeName, call.InstanceID)
+		// The calls of the transaction share the version of the operator,
+		// so they take turns.
+		turn = w.turns.take(call)
+		operator, err = w.storage.Get(ctx, call)
+	}
 	if err != nil {
+		if turn != nil {
+			w.turns.done(call, turn)
+		}
 		err = errors.Wrap(err, "getting operator")
 		return call.Response(ctx, nil, err)
 	}
@@ -158,7 +391,15 @@ func (w *Executor) handle(ctx context.Context, call *Request) *Response {
 		(*operatorspan).End()
 	}()
 
-	res, err := operator.Handle(ctx, w.client, call)
+	operatorctx := ctx
+	if turn != nil {
+		operatorctx = contextWithTurn(ctx, turn)
+	}
+	res, err := w.handleOperator(operatorctx, operator, call, operatorspan)
+	if turn != nil {
+		w.turns.done(call, turn)
+	}
+	awaitFutures(ctx)
 	if err != nil {
 		log.Println("Executor handle call error:", err)
 		err = errors.Wrap(err, "handle operator call")
@@ -167,3 +408,62 @@ func (w *Executor) handle(ctx context.Context, call *Request) *Response {
 
 	return call.Response(ctx, res, nil)
 }
+
+// validatesRead reports whether the read-only call must take part in the
+// two-phase commit, because it is made within a transaction and the storage
+// validates the operators that a transaction read.
+func (w *Executor) validatesRead(call *Request) bool {
+	serializable, ok := w.storage.(SerializableStorage)
+	isInitialRequest := call.TransactionID == call.RequestID
+	return ok && serializable.Serializable() && !isInitialRequest
+}
+
+// handleOperator calls the operator and turns a panic of the operator into an
+// ErrPanic, so the transaction is rolled back instead of crashing the process.
+// The stack of the panic is recorded in the span of the operator.
+func (w *Executor) handleOperator(ctx context.Context, operator OperatorHandler, call *Request, span *trace.Span) (res []byte, err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		stack := string(debug.Stack())
+		err = errors.Wrapf(ErrPanic, "%s.%s: %v", call.TypeName, call.Method, r)
+		(*span).RecordError(err, trace.WithAttributes(
+			attribute.String("exception.stacktrace", stack),
+		))
+		(*span).SetStatus(codes.Error, err.Error())
+		log.Println("Executor operator panic:", err, "\n", stack)
+	}()
+	return operator.Handle(ctx, w.client, call)
+}
+
+// handleLifecycle creates, checks or deletes the operator of the call.
+func (w *Executor) handleLifecycle(ctx context.Context, call *Request) *Response {
+	storage, ok := w.storage.(LifecycleStorage)
+	if !ok {
+		err := errors.Errorf("storage does not support %s", call.Method)
+		return call.Response(ctx, nil, err)
+	}
+
+	switch Method(call.Method) {
+	case MethodExists:
+		// Checking the existence does not modify the operator, so it does
+		// not take part in the two-phase commit.
+		exists, err := storage.Exists(ctx, call)
+		if err != nil {
+			err = errors.Wrap(err, "checking operator")
+			return call.Response(ctx, nil, err)
+		}
+		res, err := json.Marshal(exists)
+		return call.Response(ctx, res, errors.Wrap(err, "marshalling exists"))
+	case MethodCreate:
+		ContextAddInvolvedOperator(ctx, call.TypeName, call.InstanceID)
+		err := storage.Create(ctx, call)
+		return call.Response(ctx, nil, errors.Wrap(err, "creating operator"))
+	default:
+		ContextAddInvolvedOperator(ctx, call.TypeName, call.InstanceID)
+		err := storage.Delete(ctx, call)
+		return call.Response(ctx, nil, errors.Wrap(err, "deleting operator"))
+	}
+}
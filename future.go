@@ -0,0 +1,133 @@
+package jetflow
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Future is the result of a call that runs asynchronously with Async.
+type Future[T any] struct {
+	done      chan struct{}
+	value     T
+	err       error
+	operators map[string]map[string]bool
+}
+
+// Async runs the call in a new goroutine and returns a Future for its result,
+// so several calls of a transaction can be in flight at once.
+//
+// The call keeps track of its own involved operators. They are added to the
+// transaction when the Future is awaited. Futures that are not awaited, or
+// whose Await gave up, are waited for when the operator call or the
+// Client.Transaction that started them returns, so their operators still
+// take part in the two-phase commit.
+//
+// Calls of a transaction to the same operator instance take turns, so they
+// can not modify it at the same time. A call gives up its turn while it waits
+// for a call or a Future, so the operator can be called back.
+func Async[T any](ctx context.Context, call func(ctx context.Context) (T, error)) *Future[T] {
+	f := &Future[T]{
+		done:      make(chan struct{}),
+		operators: map[string]map[string]bool{},
+	}
+	if futures, ok := ctx.Value(futuresKey).(*futures); ok {
+		futures.add(f)
+	}
+
+	ctx = ContextWithInvolvedOperators(ctx, f.operators)
+	// The span and the turn of the operator are shared with the other
+	// calls, so the asynchronous call does not end the span or give up the
+	// turn while it waits.
+	ctx = context.WithValue(ctx, "SPAN", nil)
+	ctx = context.WithValue(ctx, turnKey, nil)
+
+	go func() {
+		defer close(f.done)
+		f.value, f.err = call(ctx)
+	}()
+	return f
+}
+
+// Await waits for the result of the call and adds its involved operators to
+// those of the context. If the context is done first, the operators are added
+// once the call returns, as for futures that are not awaited.
+func (f *Future[T]) Await(ctx context.Context) (T, error) {
+	resume := yield(ctx)
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		resume()
+		var zero T
+		return zero, errors.Wrap(ctx.Err(), "awaiting future")
+	}
+	resume()
+
+	for name, instances := range f.operators {
+		for id := range instances {
+			ContextAddInvolvedOperator(ctx, name, id)
+		}
+	}
+	return f.value, f.err
+}
+
+// wait implements awaitable.
+func (f *Future[T]) wait() map[string]map[string]bool {
+	<-f.done
+	return f.operators
+}
+
+// awaitable is a Future of any type.
+type awaitable interface {
+	// wait waits until the call is done and returns its involved operators.
+	wait() map[string]map[string]bool
+}
+
+// futuresKey
+var futuresKey ctxKey = "FUTURES"
+
+// futures are the futures that were started with a context.
+type futures struct {
+	mu      sync.Mutex
+	pending []awaitable
+}
+
+func (fs *futures) add(f awaitable) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.pending = append(fs.pending, f)
+}
+
+// contextWithFutures returns a copy of ctx that keeps track of the futures
+// that are started with it, so awaitFutures can wait for them.
+func contextWithFutures(ctx context.Context) context.Context {
+	return context.WithValue(ctx, futuresKey, &futures{})
+}
+
+// awaitFutures waits for the futures that were started with the context,
+// including the futures that they started, and adds their involved operators
+// to those of the context.
+func awaitFutures(ctx context.Context) {
+	fs, ok := ctx.Value(futuresKey).(*futures)
+	if !ok {
+		return
+	}
+	for {
+		fs.mu.Lock()
+		pending := fs.pending
+		fs.pending = nil
+		fs.mu.Unlock()
+		if len(pending) == 0 {
+			return
+		}
+
+		for _, f := range pending {
+			for name, instances := range f.wait() {
+				for id := range instances {
+					ContextAddInvolvedOperator(ctx, name, id)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package jetflow_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mathieupost/jetflow"
+)
+
+func TestFuture(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	operators := map[string]map[string]bool{}
+	ctx = jetflow.ContextWithInvolvedOperators(ctx, operators)
+
+	// The calls are in flight at once, and each of them involves an operator.
+	started, release := make(chan struct{}), make(chan struct{})
+	var futures []*jetflow.Future[string]
+	for i := 0; i < 3; i++ {
+		id := fmt.Sprint(i)
+		futures = append(futures, jetflow.Async(ctx, func(ctx context.Context) (string, error) {
+			jetflow.ContextAddInvolvedOperator(ctx, "TestType", id)
+			started <- struct{}{}
+			<-release
+			return id, nil
+		}))
+	}
+	for range futures {
+		<-started
+	}
+	require.Empty(t, operators)
+	close(release)
+
+	// Awaiting the futures adds their involved operators to the transaction.
+	for i, future := range futures {
+		id, err := future.Await(ctx)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprint(i), id)
+	}
+	require.Equal(t, map[string]map[string]bool{
+		"TestType": {"0": true, "1": true, "2": true},
+	}, operators)
+}
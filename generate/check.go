@@ -0,0 +1,108 @@
+package generate
+
+import (
+	"go/ast"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// implementation is a struct type of the package that can implement an
+// operator.
+type implementation struct {
+	// unexported are the names of the unexported fields.
+	unexported []string
+	// methods are the names of the methods of the type.
+	methods map[string]bool
+}
+
+// implementationOf returns the implementation with the name, and adds it if
+// it was not parsed yet.
+func (p *Parser) implementationOf(name string) *implementation {
+	impl, ok := p.implementations[name]
+	if !ok {
+		impl = &implementation{methods: map[string]bool{}}
+		p.implementations[name] = impl
+	}
+	return impl
+}
+
+// parseStruct registers the unexported fields of the struct type.
+func (p *Parser) parseStruct(name string, t *ast.StructType) {
+	impl := p.implementationOf(name)
+	for _, field := range t.Fields.List {
+		for _, n := range field.Names {
+			if !n.IsExported() && n.Name != "_" {
+				impl.unexported = append(impl.unexported, n.Name)
+			}
+		}
+	}
+}
+
+// parseMethod registers the method with its receiver type.
+func (p *Parser) parseMethod(f *ast.FuncDecl) {
+	recv := f.Recv.List[0].Type
+	if star, ok := recv.(*ast.StarExpr); ok {
+		recv = star.X
+	}
+	if ident, ok := recv.(*ast.Ident); ok {
+		p.implementationOf(ident.Name).methods[f.Name.Name] = true
+	}
+}
+
+// parseConstructor registers the type that a New<Type> function returns,
+// for example &user{} for NewUser.
+func (p *Parser) parseConstructor(f *ast.FuncDecl) {
+	typeName, ok := strings.CutPrefix(f.Name.Name, "New")
+	if !ok || f.Body == nil {
+		return
+	}
+	ast.Inspect(f.Body, func(n ast.Node) bool {
+		ret, ok := n.(*ast.ReturnStmt)
+		if !ok || len(ret.Results) != 1 {
+			return true
+		}
+		expr := ret.Results[0]
+		if unary, ok := expr.(*ast.UnaryExpr); ok {
+			expr = unary.X
+		}
+		if lit, ok := expr.(*ast.CompositeLit); ok {
+			if ident, ok := lit.Type.(*ast.Ident); ok {
+				p.constructors[typeName] = ident.Name
+			}
+		}
+		return true
+	})
+}
+
+// checkState returns an error for operators whose state would be lost,
+// because their implementation has unexported fields but does not implement
+// json.Marshaler and json.Unmarshaler. Their state is marshalled as JSON, so
+// it would always be {} and writes would never be stored.
+func (p *Parser) checkState() error {
+	names := make([]string, 0, len(p.state.Types))
+	for name := range p.state.Types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		implName, ok := p.constructors[name]
+		if !ok {
+			continue
+		}
+		impl, ok := p.implementations[implName]
+		if !ok || len(impl.unexported) == 0 {
+			continue
+		}
+		if impl.methods["MarshalJSON"] && impl.methods["UnmarshalJSON"] {
+			continue
+		}
+		return errors.Errorf(
+			"%s has unexported fields %s that are not stored: implement json.Marshaler and json.Unmarshaler on %s",
+			implName, strings.Join(impl.unexported, ", "), implName,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package generate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckState(t *testing.T) {
+	const operator = `package types
+
+type Counter interface {
+	Increment() (int, error)
+}
+
+func NewCounter(id string) Counter {
+	return &counter{id: id}
+}
+
+type counter struct {
+	id    string
+	count int
+}
+
+func (c *counter) Increment() (int, error) {
+	c.count++
+	return c.count, nil
+}
+`
+	const codec = `package types
+
+func (c *counter) MarshalJSON() ([]byte, error) { return nil, nil }
+
+func (c *counter) UnmarshalJSON(data []byte) error { return nil }
+`
+
+	parse := func(t *testing.T, files ...string) *Parser {
+		dir := t.TempDir()
+		p := newParser("types")
+		for i, content := range files {
+			path := filepath.Join(dir, string(rune('a'+i))+".go")
+			require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+			p.ParseFile(path)
+		}
+		for len(p.queue) > 0 {
+			p.queue[0]()
+			p.queue = p.queue[1:]
+		}
+		return p
+	}
+
+	t.Run("UnexportedFields", func(t *testing.T) {
+		err := parse(t, operator).checkState()
+		require.ErrorContains(t, err, "counter has unexported fields id, count")
+	})
+
+	t.Run("Marshaler", func(t *testing.T) {
+		require.NoError(t, parse(t, operator, codec).checkState())
+	})
+}
@@ -10,6 +10,9 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -18,17 +21,30 @@ import (
 type Parser struct {
 	state *State
 	queue []func()
+
+	// implementations are the state codecs of the types that implement
+	// the operators.
+	implementations map[string]*implementation
+	// constructors map the operator types to the types that their
+	// New<Type> function returns.
+	constructors map[string]string
 }
 
-func ParsePackage(path string) {
-	state := &State{
-		Package: determineModuleImportPath(path),
-		Types:   map[string]*Type{},
-	}
-	parser := Parser{
-		state: state,
-		queue: []func(){},
+func newParser(pkg string) *Parser {
+	return &Parser{
+		state: &State{
+			Package: pkg,
+			Types:   map[string]*Type{},
+		},
+		queue:           []func(){},
+		implementations: map[string]*implementation{},
+		constructors:    map[string]string{},
 	}
+}
+
+func ParsePackage(path string) {
+	parser := newParser(determineModuleImportPath(path))
+	state := parser.state
 
 	// List all files in the directory.
 	files, err := ioutil.ReadDir(path)
@@ -48,6 +64,11 @@ func ParsePackage(path string) {
 		parser.queue = parser.queue[1:]
 	}
 
+	err = parser.checkState()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// fmt.Println(state)
 
 	w := NewWriter(state, filepath.Join(path, "gen"))
@@ -76,6 +97,15 @@ func (p *Parser) ParseFile(path string) {
 	state := p.state
 
 	for _, decl := range node.Decls {
+		if f, ok := decl.(*ast.FuncDecl); ok {
+			if f.Recv != nil {
+				p.parseMethod(f)
+				continue
+			}
+			p.parseMigration(f.Name.Name)
+			p.parseConstructor(f)
+			continue
+		}
 		if g, ok := decl.(*ast.GenDecl); ok {
 			fmt.Printf("GenDecl: %T, %v\n", g, g)
 			for _, spec := range g.Specs {
@@ -83,11 +113,25 @@ func (p *Parser) ParseFile(path string) {
 				case *ast.TypeSpec:
 					fmt.Printf(" TypeSpec: %T, %v\n", s.Type, s)
 					switch t := s.Type.(type) {
+					case *ast.StructType:
+						p.parseStruct(s.Name.Name, t)
 					case *ast.InterfaceType:
 						name := s.Name.Name
 						typ := &Type{
-							Name:    name,
-							Methods: []*Method{},
+							Name:         name,
+							Strict:       hasDirective(g.Doc, directiveStrict) || hasDirective(s.Doc, directiveStrict),
+							Methods:      []*Method{},
+							StateVersion: 1,
+						}
+						version, ok := directiveValue(g.Doc, directiveVersion)
+						if !ok {
+							version, ok = directiveValue(s.Doc, directiveVersion)
+						}
+						if ok {
+							typ.StateVersion, err = strconv.Atoi(version)
+							if err != nil || typ.StateVersion < 1 {
+								log.Fatalf("invalid state version %q of %s", version, name)
+							}
 						}
 						state.Types[name] = typ
 
@@ -103,6 +147,7 @@ func (p *Parser) ParseFile(path string) {
 									name := m.Names[0].Name
 									method := &Method{
 										Name:       name,
+										ReadOnly:   hasDirective(m.Doc, directiveReadOnly),
 										Parameters: []*Parameter{},
 										Results:    []*Parameter{},
 									}
@@ -161,6 +206,73 @@ func (p *Parser) ParseFile(path string) {
 	}
 }
 
+// directiveReadOnly marks an operator method that does not modify the state
+// of the operator, so calls to it can be served from the committed state.
+const directiveReadOnly = "jetflow:readonly"
+
+// directiveStrict marks an operator type whose instances must be created
+// explicitly before they can be called.
+const directiveStrict = "jetflow:strict"
+
+// directiveVersion sets the version of the state of an operator type, for
+// example //jetflow:version 2. States of older versions are upgraded by the
+// functions Migrate<Type>V<version> of the package.
+const directiveVersion = "jetflow:version"
+
+// migrationPattern matches the names of migration functions.
+var migrationPattern = regexp.MustCompile(`^Migrate([A-Z]\w*)V([0-9]+)$`)
+
+// parseMigration registers the function as a migration of the state of its
+// type if its name matches Migrate<Type>V<version>.
+func (p *Parser) parseMigration(name string) {
+	match := migrationPattern.FindStringSubmatch(name)
+	if match == nil {
+		return
+	}
+	version, err := strconv.Atoi(match[2])
+	if err != nil {
+		return
+	}
+	// The type may be declared in a file that is parsed later.
+	p.queue = append(p.queue, func() {
+		typ, ok := p.state.Types[match[1]]
+		if !ok {
+			return
+		}
+		typ.Migrations = append(typ.Migrations, version)
+		sort.Ints(typ.Migrations)
+	})
+}
+
+// directiveValue returns the value of the //directive value comment in the
+// comment group.
+func directiveValue(doc *ast.CommentGroup, directive string) (string, bool) {
+	if doc == nil {
+		return "", false
+	}
+	for _, c := range doc.List {
+		value, ok := strings.CutPrefix(strings.TrimSpace(c.Text), "//"+directive+" ")
+		if ok {
+			return strings.TrimSpace(value), true
+		}
+	}
+	return "", false
+}
+
+// hasDirective reports whether the comment group contains the //directive
+// comment.
+func hasDirective(doc *ast.CommentGroup, directive string) bool {
+	if doc == nil {
+		return false
+	}
+	for _, c := range doc.List {
+		if strings.TrimSpace(c.Text) == "//"+directive {
+			return true
+		}
+	}
+	return false
+}
+
 func determineModuleImportPath(dirPath string) string {
 	// Look for the go.mod file in the current directory and parent directories
 	modFilePath := filepath.Join(dirPath, "go.mod")
@@ -7,11 +7,19 @@ type State struct {
 
 type Type struct {
 	Name    string
+	Strict  bool
 	Methods []*Method
+
+	// StateVersion is the version of the state of the operator.
+	StateVersion int
+	// Migrations are the state versions that have a migration function to
+	// the next version.
+	Migrations []int
 }
 
 type Method struct {
 	Name       string
+	ReadOnly   bool
 	Parameters []*Parameter
 	Results    []*Parameter
 }
@@ -0,0 +1,142 @@
+package jetflow
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+)
+
+// Mailbox is a RequestHandler that handles the calls to an operator instance
+// one at a time, like the mailbox of an actor, while calls to different
+// instances are handled in parallel. Calls to operators that are used by many
+// transactions then wait for their turn instead of aborting in Prepare.
+//
+// Calls of the transaction that is handled by the instance, including its
+// retries, do not wait, so an operator can be called back by the operators
+// it calls. Transactions are identified by the TransactionID of their first
+// attempt, which their retries keep as OriginalTransactionID. Read-only calls
+// and the calls of the two-phase commit do not wait either.
+//
+// The next call is handled as soon as the previous one returned, which can be
+// before its transaction is committed. Storages that wait for prepared
+// operators, or WithSyncCommit, prevent that it aborts because of that.
+type Mailbox struct {
+	handler RequestHandler
+	timeout time.Duration
+
+	mu    sync.Mutex
+	boxes map[string]*mailbox
+}
+
+// mailbox is the mailbox of an operator instance.
+type mailbox struct {
+	// turn holds a value while a call is handled.
+	turn chan struct{}
+	// transaction is the id of the first attempt of the transaction of the
+	// call that is handled.
+	transaction string
+	// waiting is the number of calls that wait for their turn.
+	waiting int
+}
+
+// NewMailbox returns a Mailbox for the calls to the handler. Calls that wait
+// longer than the timeout for their turn fail with ErrConflict, so two
+// transactions that call each other's operators do not wait forever.
+func NewMailbox(handler RequestHandler, timeout time.Duration) *Mailbox {
+	return &Mailbox{
+		handler: handler,
+		timeout: timeout,
+		boxes:   map[string]*mailbox{},
+	}
+}
+
+// Handle implements RequestHandler.
+func (m *Mailbox) Handle(ctx context.Context, req *Request) *Response {
+	switch Method(req.Method) {
+	case MethodPrepare, MethodCommit, MethodRollback, MethodOutcome:
+		return m.handler.Handle(ctx, req)
+	}
+	if req.ReadOnly {
+		return m.handler.Handle(ctx, req)
+	}
+
+	key := req.TypeName + "." + req.InstanceID
+	transaction := req.originalTransactionID()
+	box, reentrant := m.wait(key, transaction)
+	if reentrant {
+		return m.handler.Handle(ctx, req)
+	}
+
+	err := m.acquire(ctx, key, box, transaction)
+	if err != nil {
+		return req.Response(ctx, nil, err)
+	}
+	defer m.release(key, box)
+
+	return m.handler.Handle(ctx, req)
+}
+
+// wait returns the mailbox of the operator and registers the call as waiting
+// for it, unless the call belongs to the transaction that is handled.
+func (m *Mailbox) wait(key string, transaction string) (*mailbox, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	box, ok := m.boxes[key]
+	if !ok {
+		box = &mailbox{turn: make(chan struct{}, 1)}
+		m.boxes[key] = box
+	}
+	if len(box.turn) > 0 && box.transaction == transaction {
+		return box, true
+	}
+	box.waiting++
+	return box, false
+}
+
+// acquire waits until it is the turn of the transaction.
+func (m *Mailbox) acquire(ctx context.Context, key string, box *mailbox, transaction string) error {
+	ctx, span := otel.Tracer("").Start(ctx, "jetflow.Mailbox.acquire")
+	defer span.End()
+
+	timer := time.NewTimer(m.timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case box.turn <- struct{}{}:
+	case <-timer.C:
+		err = errors.Wrapf(ErrConflict, "waiting for %s", key)
+	case <-ctx.Done():
+		err = errors.Wrapf(ctx.Err(), "waiting for %s", key)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	box.waiting--
+	if err != nil {
+		m.remove(key, box)
+		return err
+	}
+	box.transaction = transaction
+	return nil
+}
+
+// release gives the turn to the next call.
+func (m *Mailbox) release(key string, box *mailbox) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	box.transaction = ""
+	<-box.turn
+	m.remove(key, box)
+}
+
+// remove removes the mailbox once no call uses it. The caller must hold mu.
+func (m *Mailbox) remove(key string, box *mailbox) {
+	if box.waiting == 0 && len(box.turn) == 0 {
+		delete(m.boxes, key)
+	}
+}
@@ -0,0 +1,110 @@
+package jetflow_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mathieupost/jetflow"
+)
+
+// handlerFunc is a RequestHandler that calls the function.
+type handlerFunc func(context.Context, *jetflow.Request) *jetflow.Response
+
+func (f handlerFunc) Handle(ctx context.Context, req *jetflow.Request) *jetflow.Response {
+	return f(ctx, req)
+}
+
+func TestMailbox(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	request := func(id string, transactionID string) *jetflow.Request {
+		return &jetflow.Request{
+			TransactionID: transactionID,
+			RequestID:     transactionID,
+			TypeName:      "TestType",
+			InstanceID:    id,
+		}
+	}
+
+	// handle handles the requests concurrently and returns the maximum number
+	// of requests that were handled at the same time.
+	handle := func(t *testing.T, requests ...*jetflow.Request) int32 {
+		var running, maxRunning atomic.Int32
+		mailbox := jetflow.NewMailbox(handlerFunc(func(ctx context.Context, req *jetflow.Request) *jetflow.Response {
+			n := running.Add(1)
+			for {
+				max := maxRunning.Load()
+				if n <= max || maxRunning.CompareAndSwap(max, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			running.Add(-1)
+			return req.Response(ctx, nil, nil)
+		}), time.Second)
+
+		done := make(chan *jetflow.Response)
+		for _, req := range requests {
+			go func(req *jetflow.Request) {
+				done <- mailbox.Handle(ctx, req)
+			}(req)
+		}
+		for range requests {
+			require.NoError(t, (<-done).Error)
+		}
+		return maxRunning.Load()
+	}
+
+	t.Run("SameInstance", func(t *testing.T) {
+		require.Equal(t, int32(1), handle(t, request("op", "1"), request("op", "2"), request("op", "3")))
+	})
+
+	t.Run("DifferentInstances", func(t *testing.T) {
+		require.Equal(t, int32(3), handle(t, request("op1", "1"), request("op2", "2"), request("op3", "3")))
+	})
+
+	t.Run("Bypass", func(t *testing.T) {
+		readOnly := request("op", "2")
+		readOnly.ReadOnly = true
+		commit := request("op", "3")
+		commit.Method = string(jetflow.MethodCommit)
+		require.Equal(t, int32(3), handle(t, request("op", "1"), readOnly, commit))
+	})
+
+	t.Run("Reentrant", func(t *testing.T) {
+		// The operator is called back by a retry of the transaction that it
+		// handles, which has a new transaction id.
+		var mailbox *jetflow.Mailbox
+		mailbox = jetflow.NewMailbox(handlerFunc(func(ctx context.Context, req *jetflow.Request) *jetflow.Response {
+			if req.Method == "callback" {
+				return req.Response(ctx, nil, nil)
+			}
+			callback := request("op", "retry")
+			callback.OriginalTransactionID = req.TransactionID
+			callback.Method = "callback"
+			return mailbox.Handle(ctx, callback)
+		}), time.Second)
+
+		res := mailbox.Handle(ctx, request("op", "tx"))
+		require.NoError(t, res.Error)
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		release := make(chan struct{})
+		mailbox := jetflow.NewMailbox(handlerFunc(func(ctx context.Context, req *jetflow.Request) *jetflow.Response {
+			<-release
+			return req.Response(ctx, nil, nil)
+		}), 20*time.Millisecond)
+
+		go mailbox.Handle(ctx, request("op", "1"))
+		time.Sleep(10 * time.Millisecond)
+		res := mailbox.Handle(ctx, request("op", "2"))
+		require.ErrorIs(t, res.Error, jetflow.ErrConflict)
+		close(release)
+	})
+}
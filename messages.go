@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -14,8 +15,22 @@ const (
 	MethodPrepare  Method = "__PREPARE__"
 	MethodCommit   Method = "__COMMIT__"
 	MethodRollback Method = "__ROLLBACK__"
+
+	MethodCreate Method = "__CREATE__"
+	MethodExists Method = "__EXISTS__"
+	MethodDelete Method = "__DELETE__"
+
+	// MethodOutcome asks the coordinator of a transaction whether it was
+	// committed or rolled back.
+	MethodOutcome Method = "__OUTCOME__"
 )
 
+// Address identifies an operator instance.
+type Address struct {
+	TypeName   string `json:"n"`
+	InstanceID string `json:"i"`
+}
+
 type Request struct {
 	TransactionID string `json:"o"`
 	RequestID     string `json:"r"`
@@ -24,6 +39,49 @@ type Request struct {
 	InstanceID string `json:"i"`
 	Method     string `json:"m"`
 	Args       []byte `json:"a"`
+
+	// ReadOnly is set for calls to methods that do not modify the operator.
+	ReadOnly bool `json:"ro,omitempty"`
+
+	// Coordinator is the operator whose executor coordinates the two-phase
+	// commit. It is set on prepare requests, so a participant can ask it for
+	// the outcome of the transaction.
+	Coordinator *Address `json:"c,omitempty"`
+
+	// RetryPolicy overrides the RetryPolicy of the executor for the
+	// transaction. It is only used for the initial request.
+	RetryPolicy *RetryPolicy `json:"rp,omitempty"`
+
+	// IdempotencyKey identifies the initial request of a transaction across
+	// the retries of its caller. Executors WithDeduplication handle requests
+	// with the same key once. It is set with ContextWithIdempotencyKey.
+	IdempotencyKey string `json:"k,omitempty"`
+
+	// Timeout is the time that was left until the deadline of the context
+	// of the caller when the request was sent, or 0 if it has none. It is
+	// relative, so the clocks of the caller and the receiver do not need to
+	// be in sync.
+	Timeout time.Duration `json:"to,omitempty"`
+
+	// OriginalTransactionID is the TransactionID of the first attempt of the
+	// transaction. It is kept when the transaction is retried with a new
+	// TransactionID, so the calls of all attempts can be recognized as calls
+	// of the same transaction.
+	OriginalTransactionID string `json:"ot,omitempty"`
+
+	// TransactionTime is the time at which the transaction started in Unix
+	// nanoseconds. It is kept when the transaction is retried, so storages
+	// can resolve conflicts in favor of older transactions.
+	TransactionTime int64 `json:"t,omitempty"`
+}
+
+// originalTransactionID returns the id of the first attempt of the
+// transaction of the request.
+func (r *Request) originalTransactionID() string {
+	if r.OriginalTransactionID != "" {
+		return r.OriginalTransactionID
+	}
+	return r.TransactionID
 }
 
 // String returns a string representation of the request.
@@ -55,14 +113,18 @@ type jsonResponse struct {
 	RequestID         string                     `json:"r"`
 	InvolvedOperators map[string]map[string]bool `json:"o"`
 
-	Values []byte `json:"v"`
-	Error  string `json:"e"`
+	Values  []byte                 `json:"v"`
+	Error   string                 `json:"e"`
+	Code    string                 `json:"c,omitempty"`
+	Details map[string]interface{} `json:"d,omitempty"`
 }
 
 func (r Response) MarshalJSON() ([]byte, error) {
-	var rerr string
+	var rerr, code string
+	var details map[string]interface{}
 	if r.Error != nil {
 		rerr = r.Error.Error()
+		code, details = errorCode(r.Error)
 	}
 
 	res := jsonResponse{
@@ -70,6 +132,8 @@ func (r Response) MarshalJSON() ([]byte, error) {
 		r.InvolvedOperators,
 		r.Values,
 		rerr,
+		code,
+		details,
 	}
 
 	data, err := json.Marshal(res)
@@ -87,7 +151,7 @@ func (r *Response) UnmarshalJSON(data []byte) error {
 
 	var rerr error
 	if res.Error != "" {
-		rerr = errors.New(res.Error)
+		rerr = newRemoteError(res.Error, res.Code, res.Details)
 	}
 
 	*r = Response{
@@ -0,0 +1,69 @@
+package jetflow_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mathieupost/jetflow"
+)
+
+func TestResponseJSON(t *testing.T) {
+	test := func(t *testing.T, err error) error {
+		data, marshalErr := json.Marshal(jetflow.Response{RequestID: "req_id", Error: err})
+		require.NoError(t, marshalErr)
+		var res jetflow.Response
+		require.NoError(t, json.Unmarshal(data, &res))
+		require.Equal(t, "req_id", res.RequestID)
+		return res.Error
+	}
+
+	t.Run("NotFound", func(t *testing.T) {
+		err := test(t, errors.Wrap(jetflow.ErrNotFound, "getting operator"))
+		require.ErrorIs(t, err, jetflow.ErrNotFound)
+		require.EqualError(t, err, "getting operator: operator not found")
+	})
+
+	t.Run("Framework", func(t *testing.T) {
+		err := test(t, errors.Wrap(jetflow.ErrConflict, "Failed to prepare"))
+		require.ErrorIs(t, err, jetflow.ErrConflict)
+		err = test(t, errors.Wrap(context.DeadlineExceeded, "transaction aborted"))
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.EqualError(t, err, "transaction aborted: context deadline exceeded")
+	})
+
+	t.Run("Typed", func(t *testing.T) {
+		errInsufficient := jetflow.NewError("test_insufficient", "insufficient")
+		sent := errInsufficient.WithDetails(map[string]interface{}{"balance": 1})
+		err := test(t, errors.Wrap(sent, "handle operator call"))
+		require.ErrorIs(t, err, errInsufficient)
+		require.EqualError(t, err, "handle operator call: insufficient")
+
+		var typed *jetflow.Error
+		require.ErrorAs(t, err, &typed)
+		require.Equal(t, "test_insufficient", typed.Code)
+		require.Equal(t, map[string]interface{}{"balance": 1.0}, typed.Details)
+		require.Nil(t, errInsufficient.Details)
+	})
+
+	t.Run("Unregistered", func(t *testing.T) {
+		// The code of an unregistered Error is kept.
+		sent := &jetflow.Error{Code: "test_unregistered", Message: "unregistered"}
+		err := test(t, sent)
+		require.ErrorIs(t, err, sent)
+		require.NotErrorIs(t, err, jetflow.ErrConflict)
+	})
+
+	t.Run("Other", func(t *testing.T) {
+		err := test(t, errors.New("failed"))
+		require.NotErrorIs(t, err, jetflow.ErrNotFound)
+		require.EqualError(t, err, "failed")
+	})
+
+	t.Run("NoError", func(t *testing.T) {
+		require.NoError(t, test(t, nil))
+	})
+}
@@ -0,0 +1,189 @@
+package jetflow
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+
+	"github.com/mathieupost/jetflow/log"
+)
+
+// DefaultPresumedRollbackTTL is the time after which presumed rollbacks are
+// completed by Recover.
+const DefaultPresumedRollbackTTL = time.Hour
+
+// Outcome returns MethodCommit or MethodRollback for a transaction that this
+// executor coordinates. A transaction without a decision is presumed to be
+// rolled back, and the rollback is logged so the coordinator can no longer
+// commit it. The presumed rollback is completed by Recover once it is older
+// than the presumed rollback TTL of the executor.
+func (w *Executor) Outcome(ctx context.Context, transactionID string) (Method, error) {
+	ctx, span := otel.Tracer("").Start(ctx, "jetflow.Executor.Outcome")
+	defer span.End()
+
+	if w.decisions == nil {
+		return "", errors.New("executor has no decision log")
+	}
+
+	for {
+		decision, ok, err := w.decisions.Decision(ctx, transactionID)
+		if err != nil {
+			return "", errors.Wrap(err, "loading decision")
+		}
+		if ok {
+			return decision.Outcome, nil
+		}
+
+		err = w.decisions.Log(ctx, Decision{
+			TransactionID: transactionID,
+			Outcome:       MethodRollback,
+			Time:          time.Now(),
+			Presumed:      true,
+		})
+		if errors.Is(err, ErrDecided) {
+			// The coordinator logged its decision in the meantime.
+			continue
+		}
+		if err != nil {
+			return "", errors.Wrap(err, "logging rollback")
+		}
+		return MethodRollback, nil
+	}
+}
+
+// StartRecovery calls Recover every interval until the context is done,
+// starting right away. Transactions are only recovered once they are older
+// than age, which should be longer than the longest running transaction.
+func (w *Executor) StartRecovery(ctx context.Context, interval, age time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			err := w.Recover(ctx, time.Now().Add(-age))
+			if err != nil {
+				log.Println("Executor.Recover error:", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Recover completes the transactions that were decided or prepared before
+// the given time and were not completed, for example because their
+// coordinator crashed.
+//
+// Pending decisions in the decision log are sent to their operators again,
+// except for presumed rollbacks, which have no operators. They are completed
+// once they are older than the presumed rollback TTL.
+// Operators that are prepared in a RecoverableStorage ask the coordinator of
+// their transaction for its outcome and apply it.
+func (w *Executor) Recover(ctx context.Context, before time.Time) error {
+	ctx, span := otel.Tracer("").Start(ctx, "jetflow.Executor.Recover")
+	defer span.End()
+
+	if w.decisions != nil {
+		decisions, err := w.decisions.Pending(ctx, before)
+		if err != nil {
+			return errors.Wrap(err, "loading pending decisions")
+		}
+		var wg sync.WaitGroup
+		for _, decision := range decisions {
+			if decision.Presumed {
+				// Kept so the coordinator can not commit, until it can
+				// no longer try to.
+				if time.Since(decision.Time) > w.presumedTTL {
+					err := w.decisions.Complete(ctx, decision.TransactionID)
+					if err != nil {
+						log.Println("Executor completing presumed rollback:", decision.TransactionID, err)
+					}
+				}
+				continue
+			}
+			wg.Add(1)
+			go func(decision Decision) {
+				defer wg.Done()
+				w.complete(ctx, decision)
+			}(decision)
+		}
+		wg.Wait()
+	}
+
+	storage, ok := w.storage.(RecoverableStorage)
+	if !ok {
+		return nil
+	}
+	prepared, err := storage.Prepared(ctx, before)
+	if err != nil {
+		return errors.Wrap(err, "loading prepared operators")
+	}
+	for _, request := range prepared {
+		err = w.resolve(ctx, request)
+		if err != nil {
+			log.Println("Executor.Recover", request, err)
+		}
+	}
+
+	return nil
+}
+
+// logDecision logs the decision if the executor has a decision log.
+func (w *Executor) logDecision(ctx context.Context, decision Decision) error {
+	if w.decisions == nil {
+		return nil
+	}
+	return errors.Wrap(w.decisions.Log(ctx, decision), "logging decision")
+}
+
+// complete delivers the decision to the involved operators and completes it
+// once all of them applied it. Otherwise it stays pending for Recover. It
+// reports whether all operators applied the decision.
+func (w *Executor) complete(ctx context.Context, decision Decision) bool {
+	ctx = ContextWithOperationID(ctx, decision.TransactionID)
+	if !w.deliver(ctx, decision.Outcome, decision.Operators) {
+		return false
+	}
+	if w.decisions == nil {
+		return true
+	}
+	err := w.decisions.Complete(ctx, decision.TransactionID)
+	if err != nil {
+		log.Println("Executor completing decision:", decision.TransactionID, err)
+	}
+	return true
+}
+
+// resolve asks the coordinator of a prepared operator for the outcome of the
+// transaction and applies it to the storage.
+func (w *Executor) resolve(ctx context.Context, prepared *Request) error {
+	if prepared.Coordinator == nil {
+		return errors.New("unknown coordinator")
+	}
+
+	ctx = ContextWithOperationID(ctx, prepared.TransactionID)
+	res, err := w.client.Call(ctx, &Request{
+		TypeName:   prepared.Coordinator.TypeName,
+		InstanceID: prepared.Coordinator.InstanceID,
+		Method:     string(MethodOutcome),
+	})
+	if err != nil {
+		return errors.Wrap(err, "asking outcome")
+	}
+
+	request := *prepared
+	request.Method = string(res)
+	switch Method(res) {
+	case MethodCommit:
+		return errors.Wrap(w.storage.Commit(ctx, &request), "committing")
+	case MethodRollback:
+		return errors.Wrap(w.storage.Rollback(ctx, &request), "rolling back")
+	default:
+		return errors.Errorf("unknown outcome %q", res)
+	}
+}
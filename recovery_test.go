@@ -0,0 +1,127 @@
+package jetflow_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mathieupost/jetflow"
+	"github.com/mathieupost/jetflow/storage/decisionlog"
+	"github.com/mathieupost/jetflow/storage/memory"
+	"github.com/mathieupost/jetflow/storage/storagetest"
+)
+
+// executorClient sends calls directly to an executor.
+type executorClient struct {
+	executor *jetflow.Executor
+}
+
+func (c *executorClient) Find(ctx context.Context, id string, operator interface{}) error {
+	return nil
+}
+
+func (c *executorClient) Call(ctx context.Context, call *jetflow.Request) ([]byte, error) {
+	call.TransactionID = jetflow.TransactionIDFromContext(ctx, call.RequestID)
+	res := c.executor.Handle(ctx, call)
+	return res.Values, res.Error
+}
+
+func TestRecover(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	storage := memory.NewStorage(storagetest.Mapping())
+	decisions, err := decisionlog.NewDirLog(t.TempDir())
+	require.NoError(t, err)
+	client := &executorClient{}
+	executor := jetflow.NewExecutor(storage, client, jetflow.WithDecisionLog(decisions))
+	client.executor = executor
+
+	// Prepare two operators as if their coordinator crashed before it sent
+	// the decision.
+	coordinator := &jetflow.Address{TypeName: "TestType", InstanceID: "coordinator"}
+	prepare := func(trID, opID string) {
+		call := storagetest.Request(trID, opID)
+		operator, err := storage.Get(ctx, call)
+		require.NoError(t, err)
+		_, err = operator.Handle(ctx, nil, call)
+		require.NoError(t, err)
+		call.Coordinator = coordinator
+		require.NoError(t, storage.Prepare(ctx, call))
+	}
+	prepare("committed", "op1")
+	prepare("undecided", "op2")
+	err = decisions.Log(ctx, jetflow.Decision{
+		TransactionID: "committed",
+		Outcome:       jetflow.MethodCommit,
+		Operators:     map[string]map[string]bool{"TestType": {"op1": true}},
+		Time:          time.Now(),
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, executor.Recover(ctx, time.Now().Add(time.Second)))
+
+	// The logged decision is committed and completed.
+	operator, err := storage.GetSnapshot(ctx, storagetest.Request("read", "op1"))
+	require.NoError(t, err)
+	require.Equal(t, 2, storagetest.Field(t, operator))
+	_, ok, err := decisions.Decision(ctx, "committed")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// The transaction without a decision is presumed to be rolled back, so
+	// its coordinator can no longer commit it.
+	operator, err = storage.GetSnapshot(ctx, storagetest.Request("read", "op2"))
+	require.NoError(t, err)
+	require.Equal(t, 1, storagetest.Field(t, operator))
+	outcome, err := executor.Outcome(ctx, "undecided")
+	require.NoError(t, err)
+	require.Equal(t, jetflow.MethodRollback, outcome)
+	err = decisions.Log(ctx, jetflow.Decision{TransactionID: "undecided", Outcome: jetflow.MethodCommit})
+	require.ErrorIs(t, err, jetflow.ErrDecided)
+
+	// The presumed rollback is kept by later recoveries.
+	require.NoError(t, executor.Recover(ctx, time.Now().Add(time.Second)))
+	err = decisions.Log(ctx, jetflow.Decision{TransactionID: "undecided", Outcome: jetflow.MethodCommit})
+	require.ErrorIs(t, err, jetflow.ErrDecided)
+
+	prepared, err := storage.Prepared(ctx, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	require.Empty(t, prepared)
+}
+
+func TestRecoverPresumedRollbacks(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	decisions, err := decisionlog.NewDirLog(t.TempDir())
+	require.NoError(t, err)
+	executor := jetflow.NewExecutor(
+		memory.NewStorage(storagetest.Mapping()), &executorClient{},
+		jetflow.WithDecisionLog(decisions),
+		jetflow.WithPresumedRollbackTTL(50*time.Millisecond),
+	)
+
+	for _, transactionID := range []string{"1", "2", "3"} {
+		outcome, err := executor.Outcome(ctx, transactionID)
+		require.NoError(t, err)
+		require.Equal(t, jetflow.MethodRollback, outcome)
+	}
+	pending, err := decisions.Pending(ctx, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	require.Len(t, pending, 3)
+
+	// The presumed rollbacks are kept until they are older than the TTL.
+	require.NoError(t, executor.Recover(ctx, time.Now().Add(time.Second)))
+	pending, err = decisions.Pending(ctx, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	require.Len(t, pending, 3)
+
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, executor.Recover(ctx, time.Now().Add(time.Second)))
+	pending, err = decisions.Pending(ctx, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	require.Empty(t, pending)
+}
@@ -0,0 +1,97 @@
+package jetflow
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RetryPolicy decides whether and when the executor retries a transaction
+// that was aborted, for example because an operator could not be prepared.
+//
+// A RetryPolicy in the context of a Client call is sent along with the
+// request, except for Retryable, and overrides the policy of the executor.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first
+	// one. Transactions are not retried if it is 1 or less.
+	MaxAttempts int `json:"a"`
+	// InitialBackoff is the time to wait before the first retry.
+	InitialBackoff time.Duration `json:"i"`
+	// MaxBackoff limits the time to wait before a retry.
+	MaxBackoff time.Duration `json:"m"`
+	// Multiplier is the factor by which the backoff grows after every retry.
+	Multiplier float64 `json:"x"`
+	// Jitter is the fraction of the backoff that is randomized, between 0
+	// and 1, so concurrent transactions that conflict do not retry at the
+	// same time again.
+	Jitter float64 `json:"j"`
+	// Retryable reports whether a transaction that failed with the error is
+	// retried. If it is nil, DefaultRetryable is used.
+	Retryable func(error) bool `json:"-"`
+}
+
+// DefaultRetryPolicy is the RetryPolicy of an executor without
+// WithRetryPolicy.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 10 * time.Millisecond,
+	MaxBackoff:     time.Second,
+	Multiplier:     2,
+	Jitter:         0.5,
+}
+
+// NoRetry is a RetryPolicy that never retries.
+var NoRetry = RetryPolicy{MaxAttempts: 1}
+
+// DefaultRetryable reports whether the error can be resolved by retrying the
+// transaction. Only conflicts with other transactions are retried, because
+// other errors, such as the errors of operators, fail again.
+func DefaultRetryable(err error) bool {
+	return errors.Is(err, ErrConflict)
+}
+
+// retry reports whether a transaction that failed with err in the given
+// attempt, starting at 1, is retried.
+func (p RetryPolicy) retry(attempt int, err error) bool {
+	if attempt >= p.MaxAttempts {
+		return false
+	}
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return DefaultRetryable(err)
+}
+
+// Backoff returns the time to wait before the retry after the given attempt,
+// starting at 1.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	backoff := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+	jitter := math.Max(0, math.Min(p.Jitter, 1))
+	backoff -= backoff * jitter * rand.Float64()
+	return time.Duration(backoff)
+}
+
+// retryPolicyKey
+var retryPolicyKey ctxKey = "RETRY_POLICY"
+
+// ContextWithRetryPolicy overrides the RetryPolicy of the executor for the
+// calls made with the context.
+func ContextWithRetryPolicy(ctx context.Context, policy RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryPolicyKey, policy)
+}
+
+// RetryPolicyFromContext returns the RetryPolicy of the context, if any.
+func RetryPolicyFromContext(ctx context.Context) (RetryPolicy, bool) {
+	policy, ok := ctx.Value(retryPolicyKey).(RetryPolicy)
+	return policy, ok
+}
@@ -0,0 +1,50 @@
+package jetflow_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mathieupost/jetflow"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := jetflow.RetryPolicy{
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+		Multiplier:     2,
+	}
+	require.Equal(t, 10*time.Millisecond, policy.Backoff(1))
+	require.Equal(t, 20*time.Millisecond, policy.Backoff(2))
+	require.Equal(t, 40*time.Millisecond, policy.Backoff(3))
+	require.Equal(t, 50*time.Millisecond, policy.Backoff(4))
+
+	// The jitter only shortens the backoff.
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		backoff := policy.Backoff(2)
+		require.GreaterOrEqual(t, backoff, 10*time.Millisecond)
+		require.LessOrEqual(t, backoff, 20*time.Millisecond)
+	}
+}
+
+func TestRetryPolicyContext(t *testing.T) {
+	ctx := context.Background()
+	_, ok := jetflow.RetryPolicyFromContext(ctx)
+	require.False(t, ok)
+
+	ctx = jetflow.ContextWithRetryPolicy(ctx, jetflow.NoRetry)
+	policy, ok := jetflow.RetryPolicyFromContext(ctx)
+	require.True(t, ok)
+	require.Equal(t, 1, policy.MaxAttempts)
+}
+
+func TestDefaultRetryable(t *testing.T) {
+	require.True(t, jetflow.DefaultRetryable(errors.Wrap(jetflow.ErrConflict, "base outdated")))
+	require.False(t, jetflow.DefaultRetryable(errors.New("insufficient balance")))
+	require.False(t, jetflow.DefaultRetryable(errors.Wrap(context.Canceled, "waiting for retry")))
+	require.False(t, jetflow.DefaultRetryable(jetflow.ErrPanic))
+}
@@ -0,0 +1,185 @@
+// Package cdc publishes the changes that are committed by a jetflow.Storage,
+// so other systems can react to them without polling.
+package cdc
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/pkg/errors"
+
+	"github.com/mathieupost/jetflow"
+	"github.com/mathieupost/jetflow/log"
+)
+
+// JetStreamSink publishes committed changes to a JetStream stream. Every
+// change is published to the subject <stream>.<type name>.<instance id>,
+// where the instance id is base64 encoded.
+//
+// The hook stores every change in a durable outbox before the commit
+// returns, and a separate goroutine publishes the changes in commit order.
+// A change that can not be stored is kept in memory and stored again before
+// it is published, so it is only lost if the process stops in the meantime.
+// A change stays in the outbox until JetStream acknowledged it, also across
+// restarts, so changes are delivered at least once. The message id is
+// derived from the operator and the transaction, so JetStream discards
+// duplicates within the duplicate window of the stream.
+type JetStreamSink struct {
+	js            jetstream.JetStream
+	stream        string
+	retryInterval time.Duration
+	outbox        *outbox
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type Option func(*JetStreamSink)
+
+// WithRetryInterval sets the time to wait before publishing a change again
+// after it failed. Defaults to one second.
+func WithRetryInterval(interval time.Duration) Option {
+	return func(s *JetStreamSink) {
+		s.retryInterval = interval
+	}
+}
+
+// NewJetStreamSink binds to the stream with the given name and creates it if
+// it does not exist yet. The outbox is kept in dir, and the changes that it
+// still contains are published right away.
+func NewJetStreamSink(ctx context.Context, js jetstream.JetStream, stream, dir string, opts ...Option) (*JetStreamSink, error) {
+	_, err := js.Stream(ctx, stream)
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		_, err = js.CreateStream(ctx, jetstream.StreamConfig{
+			Name:     stream,
+			Subjects: []string{stream + ".>"},
+		})
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "binding stream")
+	}
+
+	outbox, err := openOutbox(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening outbox")
+	}
+
+	s := &JetStreamSink{
+		js:            js,
+		stream:        stream,
+		retryInterval: time.Second,
+		outbox:        outbox,
+		done:          make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	var publishCtx context.Context
+	publishCtx, s.cancel = context.WithCancel(context.Background())
+	go s.run(publishCtx)
+
+	return s, nil
+}
+
+// Close stops publishing and closes the outbox. Changes that were not
+// published yet are published when the sink is created again.
+func (s *JetStreamSink) Close() error {
+	s.cancel()
+	<-s.done
+	return errors.Wrap(s.outbox.close(), "closing outbox")
+}
+
+// Hook returns the jetflow.CommitHook that stores the changes in the outbox.
+// It blocks the commit until the change is stored, not until it is
+// published.
+func (s *JetStreamSink) Hook() jetflow.CommitHook {
+	return func(ctx context.Context, change jetflow.Change) {
+		err := s.outbox.append(change)
+		if err != nil {
+			// The change is stored again before it is published.
+			log.Println("storing change", change.TypeName, change.InstanceID, err)
+		}
+	}
+}
+
+// Subject returns the subject to which the changes of the operator are
+// published.
+func (s *JetStreamSink) Subject(typeName, instanceID string) string {
+	return s.stream + "." + typeName + "." + base64.RawURLEncoding.EncodeToString([]byte(instanceID))
+}
+
+// run publishes the changes in the outbox until the context is done.
+func (s *JetStreamSink) run(ctx context.Context) {
+	defer close(s.done)
+	for {
+		err := s.outbox.flush()
+		var changes []json.RawMessage
+		var offset int64
+		if err == nil {
+			changes, offset, err = s.outbox.pending()
+		}
+		if err == nil {
+			err = s.publish(ctx, changes)
+		}
+		if err == nil && len(changes) > 0 {
+			err = s.outbox.advance(offset)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Println("publishing changes", err)
+			select {
+			case <-time.After(s.retryInterval):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		if len(changes) > 0 {
+			continue
+		}
+		select {
+		case <-s.outbox.added:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// publish publishes the changes in order. A change is published again until
+// JetStream acknowledged it or the context is done.
+func (s *JetStreamSink) publish(ctx context.Context, changes []json.RawMessage) error {
+	for _, data := range changes {
+		var change jetflow.Change
+		err := json.Unmarshal(data, &change)
+		if err != nil {
+			log.Println("unmarshalling change", err)
+			continue
+		}
+		subject := s.Subject(change.TypeName, change.InstanceID)
+		msgID := subject + "." + change.TransactionID
+
+		for {
+			_, err = s.js.Publish(ctx, subject, data, jetstream.WithMsgID(msgID))
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Println("publishing change", msgID, err)
+			select {
+			case <-time.After(s.retryInterval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
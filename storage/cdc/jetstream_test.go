@@ -0,0 +1,165 @@
+package cdc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mathieupost/jetflow"
+	"github.com/mathieupost/jetflow/storage/memory"
+	"github.com/mathieupost/jetflow/storage/storagetest"
+)
+
+func TestJetStreamSink(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	js := initJetStream(t)
+
+	sink, err := NewJetStreamSink(ctx, js, "CHANGES", t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() { sink.Close() })
+	s := memory.NewStorage(storagetest.Mapping(), memory.WithCommitHook(sink.Hook()))
+
+	for _, trID := range []string{"1", "2"} {
+		call := storagetest.Request(trID, "op")
+		operator, err := s.Get(ctx, call)
+		require.NoError(t, err)
+		operator.Handle(ctx, nil, call)
+		require.NoError(t, s.Prepare(ctx, call))
+		require.NoError(t, s.Commit(ctx, call))
+	}
+
+	// Publishing a change again is deduplicated by JetStream.
+	sink.Hook()(ctx, jetflow.Change{TypeName: "TestType", InstanceID: "op", Version: 2, TransactionID: "2"})
+
+	require.Eventually(t, func() bool {
+		sink.outbox.mu.Lock()
+		defer sink.outbox.mu.Unlock()
+		return sink.outbox.size == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	changes := fetch(t, ctx, js, sink, 2)
+	require.Equal(t, uint64(1), changes[0].Version)
+	require.Equal(t, "1", changes[0].TransactionID)
+	require.JSONEq(t, "1", string(changes[0].PreviousState))
+	require.JSONEq(t, "2", string(changes[0].State))
+	require.Equal(t, uint64(2), changes[1].Version)
+	require.Equal(t, "2", changes[1].TransactionID)
+	require.JSONEq(t, "3", string(changes[1].State))
+}
+
+func TestJetStreamSinkOutbox(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	js := initJetStream(t)
+
+	// A change that was stored but not published before a crash, followed
+	// by a torn write.
+	dir := t.TempDir()
+	outbox, err := openOutbox(dir)
+	require.NoError(t, err)
+	require.NoError(t, outbox.append(jetflow.Change{TypeName: "TestType", InstanceID: "op", Version: 1, TransactionID: "1"}))
+	_, err = outbox.file.WriteAt([]byte(`{"n":"Test`), outbox.size)
+	require.NoError(t, err)
+	require.NoError(t, outbox.close())
+
+	sink, err := NewJetStreamSink(ctx, js, "CHANGES", dir)
+	require.NoError(t, err)
+	t.Cleanup(func() { sink.Close() })
+	sink.Hook()(ctx, jetflow.Change{TypeName: "TestType", InstanceID: "op", Version: 2, TransactionID: "2"})
+
+	changes := fetch(t, ctx, js, sink, 2)
+	require.Equal(t, "1", changes[0].TransactionID)
+	require.Equal(t, "2", changes[1].TransactionID)
+}
+
+func TestJetStreamSinkWriteFailure(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	js := initJetStream(t)
+
+	sink, err := NewJetStreamSink(ctx, js, "CHANGES", t.TempDir(), WithRetryInterval(10*time.Millisecond))
+	require.NoError(t, err)
+	t.Cleanup(func() { sink.Close() })
+
+	// The outbox can not be written, for example because the disk is full.
+	sink.outbox.mu.Lock()
+	file := sink.outbox.file
+	sink.outbox.file, err = os.Open(file.Name())
+	sink.outbox.mu.Unlock()
+	require.NoError(t, err)
+	sink.Hook()(ctx, jetflow.Change{TypeName: "TestType", InstanceID: "op", Version: 1, TransactionID: "1"})
+	sink.Hook()(ctx, jetflow.Change{TypeName: "TestType", InstanceID: "op", Version: 2, TransactionID: "2"})
+
+	// The changes are kept until they can be written, and published in order.
+	time.Sleep(50 * time.Millisecond)
+	sink.outbox.mu.Lock()
+	require.Len(t, sink.outbox.unwritten, 2)
+	sink.outbox.file.Close()
+	sink.outbox.file = file
+	sink.outbox.mu.Unlock()
+
+	changes := fetch(t, ctx, js, sink, 2)
+	require.Equal(t, "1", changes[0].TransactionID)
+	require.Equal(t, "2", changes[1].TransactionID)
+}
+
+// fetch waits until the stream contains n changes of the operator op and
+// returns them.
+func fetch(t *testing.T, ctx context.Context, js jetstream.JetStream, sink *JetStreamSink, n int) []jetflow.Change {
+	stream, err := js.Stream(ctx, "CHANGES")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		info, err := stream.Info(ctx)
+		require.NoError(t, err)
+		return info.State.Msgs == uint64(n)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	consumer, err := stream.OrderedConsumer(ctx, jetstream.OrderedConsumerConfig{
+		FilterSubjects: []string{sink.Subject("TestType", "op")},
+	})
+	require.NoError(t, err)
+	batch, err := consumer.Fetch(n)
+	require.NoError(t, err)
+
+	changes := []jetflow.Change{}
+	for msg := range batch.Messages() {
+		var change jetflow.Change
+		require.NoError(t, json.Unmarshal(msg.Data(), &change))
+		changes = append(changes, change)
+	}
+	require.NoError(t, batch.Error())
+	require.Len(t, changes, n)
+	return changes
+}
+
+func initJetStream(t *testing.T) jetstream.JetStream {
+	// Setup a NATS server with JetStream enabled.
+	opts := server.Options{
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		Port:      server.RANDOM_PORT,
+	}
+	s, err := server.NewServer(&opts)
+	require.NoError(t, err)
+	err = server.Run(s)
+	require.NoError(t, err)
+	t.Cleanup(s.Shutdown)
+
+	nc, err := nats.Connect(fmt.Sprintf("0.0.0.0:%d", opts.Port))
+	require.NoError(t, err)
+	t.Cleanup(nc.Close)
+
+	js, err := jetstream.New(nc)
+	require.NoError(t, err)
+
+	return js
+}
@@ -0,0 +1,203 @@
+package cdc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/mathieupost/jetflow"
+)
+
+const (
+	outboxFileName = "outbox.log"
+	cursorFileName = "cursor"
+)
+
+// outbox is a durable queue of changes. Changes are appended to a log file,
+// and the offset of the first change that was not published yet is kept in a
+// cursor file, so changes are published again after a restart until they are
+// acknowledged.
+type outbox struct {
+	dir string
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	cursor int64
+	// unwritten are the changes that were appended but could not be written
+	// to the log yet. They are written before any later change, so the
+	// order is kept.
+	unwritten [][]byte
+	// added is signalled when a change is appended.
+	added chan struct{}
+}
+
+// openOutbox opens the outbox in dir. A torn write at the end of the log is
+// cut off, so new changes are not appended after it.
+func openOutbox(dir string) (*outbox, error) {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating directory")
+	}
+
+	o := &outbox{dir: dir, added: make(chan struct{}, 1)}
+	data, err := os.ReadFile(o.path(outboxFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "reading outbox")
+	}
+	o.size = int64(bytes.LastIndexByte(data, '\n') + 1)
+
+	cursor, err := os.ReadFile(o.path(cursorFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "reading cursor")
+	}
+	if len(cursor) == 8 {
+		o.cursor = int64(binary.BigEndian.Uint64(cursor))
+	}
+	if o.cursor > o.size {
+		// The outbox was truncated before the cursor was reset.
+		o.cursor = 0
+	}
+
+	o.file, err = os.OpenFile(o.path(outboxFileName), os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening outbox")
+	}
+	err = o.file.Truncate(o.size)
+	if err != nil {
+		o.file.Close()
+		return nil, errors.Wrap(err, "truncating outbox")
+	}
+	return o, nil
+}
+
+// append adds the change to the outbox. If it can not be written to the log,
+// it is kept in memory and written again by flush, and the error is
+// returned.
+func (o *outbox) append(change jetflow.Change) error {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return errors.Wrap(err, "marshalling change")
+	}
+	data = append(data, '\n')
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.unwritten = append(o.unwritten, data)
+	err = o.write()
+
+	select {
+	case o.added <- struct{}{}:
+	default:
+	}
+	return err
+}
+
+// flush writes the changes that could not be written before.
+func (o *outbox) flush() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.write()
+}
+
+// write durably writes the unwritten changes to the log in order. It must be
+// called with the lock held.
+func (o *outbox) write() error {
+	for len(o.unwritten) > 0 {
+		data := o.unwritten[0]
+		_, err := o.file.WriteAt(data, o.size)
+		if err != nil {
+			return errors.Wrap(err, "writing change")
+		}
+		err = o.file.Sync()
+		if err != nil {
+			return errors.Wrap(err, "syncing outbox")
+		}
+		o.size += int64(len(data))
+		o.unwritten = o.unwritten[1:]
+	}
+	o.unwritten = nil
+	return nil
+}
+
+// pending returns the changes after the cursor and the offset after them.
+func (o *outbox) pending() ([]json.RawMessage, int64, error) {
+	o.mu.Lock()
+	cursor, size := o.cursor, o.size
+	o.mu.Unlock()
+	if cursor == size {
+		return nil, cursor, nil
+	}
+
+	file, err := os.Open(o.path(outboxFileName))
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "opening outbox")
+	}
+	defer file.Close()
+
+	var changes []json.RawMessage
+	reader := bufio.NewReader(io.NewSectionReader(file, cursor, size-cursor))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "reading outbox")
+		}
+		changes = append(changes, bytes.TrimSuffix(line, []byte{'\n'}))
+	}
+	return changes, size, nil
+}
+
+// advance moves the cursor to the offset after the published changes. The
+// outbox is emptied once all changes are published.
+func (o *outbox) advance(offset int64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if offset == o.size {
+		err := o.file.Truncate(0)
+		if err != nil {
+			return errors.Wrap(err, "truncating outbox")
+		}
+		o.size = 0
+		offset = 0
+	}
+
+	cursor := binary.BigEndian.AppendUint64(nil, uint64(offset))
+	err := os.WriteFile(o.path(cursorFileName)+".tmp", cursor, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "writing cursor")
+	}
+	err = os.Rename(o.path(cursorFileName)+".tmp", o.path(cursorFileName))
+	if err != nil {
+		return errors.Wrap(err, "renaming cursor")
+	}
+	o.cursor = offset
+	return nil
+}
+
+// close writes the changes that could not be written before and closes the
+// log.
+func (o *outbox) close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	err := o.write()
+	if err != nil {
+		o.file.Close()
+		return err
+	}
+	return o.file.Close()
+}
+
+func (o *outbox) path(name string) string {
+	return filepath.Join(o.dir, name)
+}
@@ -0,0 +1,99 @@
+package decisionlog
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mathieupost/jetflow"
+)
+
+func TestDirLog(t *testing.T) {
+	log, err := NewDirLog(t.TempDir())
+	require.NoError(t, err)
+	testDecisionLog(t, log)
+}
+
+func TestKVLog(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	log, err := NewKVLog(ctx, initJetStream(t), "decisions")
+	require.NoError(t, err)
+	testDecisionLog(t, log)
+}
+
+func testDecisionLog(t *testing.T, log jetflow.DecisionLog) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	commit := jetflow.Decision{
+		TransactionID: "tx1",
+		Outcome:       jetflow.MethodCommit,
+		Operators:     map[string]map[string]bool{"TestType": {"op": true}},
+		Time:          now,
+	}
+	_, ok, err := log.Decision(ctx, "tx1")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Only the first decision is logged.
+	require.NoError(t, log.Log(ctx, commit))
+	rollback := commit
+	rollback.Outcome = jetflow.MethodRollback
+	require.ErrorIs(t, log.Log(ctx, rollback), jetflow.ErrDecided)
+
+	decision, ok, err := log.Decision(ctx, "tx1")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, jetflow.MethodCommit, decision.Outcome)
+	require.Equal(t, commit.Operators, decision.Operators)
+
+	// Only decisions logged before the given time are pending.
+	later := jetflow.Decision{TransactionID: "tx2", Outcome: jetflow.MethodRollback, Time: now.Add(time.Minute)}
+	require.NoError(t, log.Log(ctx, later))
+	pending, err := log.Pending(ctx, now.Add(time.Second))
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	require.Equal(t, "tx1", pending[0].TransactionID)
+
+	// Completed decisions are forgotten.
+	require.NoError(t, log.Complete(ctx, "tx1"))
+	_, ok, err = log.Decision(ctx, "tx1")
+	require.NoError(t, err)
+	require.False(t, ok)
+	pending, err = log.Pending(ctx, now.Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	require.Equal(t, "tx2", pending[0].TransactionID)
+}
+
+func initJetStream(t *testing.T) jetstream.JetStream {
+	// Setup a NATS server with JetStream enabled.
+	opts := server.Options{
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		Port:      server.RANDOM_PORT,
+	}
+	s, err := server.NewServer(&opts)
+	require.NoError(t, err)
+	err = server.Run(s)
+	require.NoError(t, err)
+	t.Cleanup(s.Shutdown)
+
+	nc, err := nats.Connect(fmt.Sprintf("0.0.0.0:%d", opts.Port))
+	require.NoError(t, err)
+	t.Cleanup(nc.Close)
+
+	js, err := jetstream.New(nc)
+	require.NoError(t, err)
+
+	return js
+}
@@ -0,0 +1,129 @@
+// Package decisionlog implements jetflow.DecisionLog, which an Executor uses
+// to durably record the outcome of the two-phase commits it coordinates.
+package decisionlog
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mathieupost/jetflow"
+)
+
+// DirLog is a jetflow.DecisionLog that stores every decision in its own file.
+// It can only be shared by executors on the same machine.
+type DirLog struct {
+	dir string
+}
+
+var _ jetflow.DecisionLog = (*DirLog)(nil)
+
+// NewDirLog creates a DirLog in dir. The directory is created if it does not
+// exist.
+func NewDirLog(dir string) (*DirLog, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating directory")
+	}
+	return &DirLog{dir: dir}, nil
+}
+
+// Log implements jetflow.DecisionLog.
+func (d *DirLog) Log(ctx context.Context, decision jetflow.Decision) error {
+	data, err := json.Marshal(decision)
+	if err != nil {
+		return errors.Wrap(err, "marshalling decision")
+	}
+
+	// Write the decision to a temporary file first, so the decision file is
+	// either complete or missing.
+	path := d.path(decision.TransactionID)
+	tmp, err := os.CreateTemp(d.dir, "*.tmp")
+	if err != nil {
+		return errors.Wrap(err, "creating decision")
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "writing decision")
+	}
+
+	// Linking fails if the decision file exists, so only the first decision
+	// is logged.
+	err = os.Link(tmp.Name(), path)
+	if errors.Is(err, os.ErrExist) {
+		return jetflow.ErrDecided
+	}
+	return errors.Wrap(err, "linking decision")
+}
+
+// Decision implements jetflow.DecisionLog.
+func (d *DirLog) Decision(ctx context.Context, transactionID string) (jetflow.Decision, bool, error) {
+	decision, err := d.read(d.path(transactionID))
+	if errors.Is(err, os.ErrNotExist) {
+		return decision, false, nil
+	}
+	return decision, err == nil, err
+}
+
+// Complete implements jetflow.DecisionLog.
+func (d *DirLog) Complete(ctx context.Context, transactionID string) error {
+	err := os.Remove(d.path(transactionID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return errors.Wrap(err, "removing decision")
+}
+
+// Pending implements jetflow.DecisionLog.
+func (d *DirLog) Pending(ctx context.Context, before time.Time) ([]jetflow.Decision, error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading directory")
+	}
+
+	var decisions []jetflow.Decision
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		decision, err := d.read(filepath.Join(d.dir, entry.Name()))
+		if errors.Is(err, os.ErrNotExist) {
+			// Completed in the meantime.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if decision.Time.Before(before) {
+			decisions = append(decisions, decision)
+		}
+	}
+	return decisions, nil
+}
+
+func (d *DirLog) read(path string) (jetflow.Decision, error) {
+	var decision jetflow.Decision
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return decision, errors.Wrap(err, "reading decision")
+	}
+	err = json.Unmarshal(data, &decision)
+	return decision, errors.Wrap(err, "unmarshalling decision")
+}
+
+func (d *DirLog) path(transactionID string) string {
+	return filepath.Join(d.dir, base64.RawURLEncoding.EncodeToString([]byte(transactionID)))
+}
@@ -0,0 +1,109 @@
+package decisionlog
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/pkg/errors"
+
+	"github.com/mathieupost/jetflow"
+)
+
+// KVLog is a jetflow.DecisionLog that stores the decisions in a JetStream
+// Key-Value bucket, so it can be shared by all executors.
+type KVLog struct {
+	kv jetstream.KeyValue
+}
+
+var _ jetflow.DecisionLog = (*KVLog)(nil)
+
+// NewKVLog binds to the Key-Value bucket with the given name and creates it
+// if it does not exist yet.
+func NewKVLog(ctx context.Context, js jetstream.JetStream, bucket string) (*KVLog, error) {
+	kv, err := js.KeyValue(ctx, bucket)
+	if errors.Is(err, jetstream.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(ctx, jetstream.KeyValueConfig{
+			Bucket: bucket,
+		})
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "binding key-value bucket")
+	}
+	return &KVLog{kv: kv}, nil
+}
+
+// Log implements jetflow.DecisionLog.
+func (l *KVLog) Log(ctx context.Context, decision jetflow.Decision) error {
+	data, err := json.Marshal(decision)
+	if err != nil {
+		return errors.Wrap(err, "marshalling decision")
+	}
+	// Creating fails if the key exists, so only the first decision is
+	// logged.
+	_, err = l.kv.Create(ctx, key(decision.TransactionID), data)
+	if errors.Is(err, jetstream.ErrKeyExists) {
+		return jetflow.ErrDecided
+	}
+	return errors.Wrap(err, "creating decision")
+}
+
+// Decision implements jetflow.DecisionLog.
+func (l *KVLog) Decision(ctx context.Context, transactionID string) (jetflow.Decision, bool, error) {
+	decision, err := l.get(ctx, key(transactionID))
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return decision, false, nil
+	}
+	return decision, err == nil, err
+}
+
+// Complete implements jetflow.DecisionLog.
+func (l *KVLog) Complete(ctx context.Context, transactionID string) error {
+	err := l.kv.Purge(ctx, key(transactionID))
+	return errors.Wrap(err, "purging decision")
+}
+
+// Pending implements jetflow.DecisionLog.
+func (l *KVLog) Pending(ctx context.Context, before time.Time) ([]jetflow.Decision, error) {
+	keys, err := l.kv.Keys(ctx)
+	if errors.Is(err, jetstream.ErrNoKeysFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "listing decisions")
+	}
+
+	var decisions []jetflow.Decision
+	for _, key := range keys {
+		decision, err := l.get(ctx, key)
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			// Completed in the meantime.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if decision.Time.Before(before) {
+			decisions = append(decisions, decision)
+		}
+	}
+	return decisions, nil
+}
+
+func (l *KVLog) get(ctx context.Context, key string) (jetflow.Decision, error) {
+	var decision jetflow.Decision
+	entry, err := l.kv.Get(ctx, key)
+	if err != nil {
+		return decision, errors.Wrap(err, "getting decision")
+	}
+	err = json.Unmarshal(entry.Value(), &decision)
+	return decision, errors.Wrap(err, "unmarshalling decision")
+}
+
+// key encodes the transaction id, so it only contains characters that are
+// valid in a key.
+func key(transactionID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(transactionID))
+}
@@ -0,0 +1,74 @@
+// Package dump streams the committed operator states of a storage to and
+// from JSON-lines files, one jetflow.StateRecord per line.
+package dump
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/mathieupost/jetflow"
+)
+
+// Export writes the committed states of the operators of the given types to
+// w. It returns the number of exported operators.
+func Export(ctx context.Context, storage jetflow.ExportableStorage, typeNames []string, w io.Writer) (int, error) {
+	writer := bufio.NewWriter(w)
+	encoder := json.NewEncoder(writer)
+
+	count := 0
+	err := storage.Export(ctx, typeNames, func(record jetflow.StateRecord) error {
+		count++
+		return errors.Wrapf(encoder.Encode(record), "encoding %s.%s", record.TypeName, record.InstanceID)
+	})
+	if err != nil {
+		return count, errors.Wrap(err, "exporting states")
+	}
+
+	return count, errors.Wrap(writer.Flush(), "flushing states")
+}
+
+// Import reads the states from r and stores them as committed states. Each
+// state is validated by unmarshalling it into an operator created by the
+// factory of its type. It returns the number of imported operators.
+func Import(ctx context.Context, storage jetflow.ExportableStorage, mapping jetflow.HandlerFactoryMapping, r io.Reader) (int, error) {
+	decoder := json.NewDecoder(bufio.NewReader(r))
+
+	count := 0
+	for {
+		var record jetflow.StateRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, errors.Wrapf(err, "decoding record %d", count+1)
+		}
+
+		err = validate(mapping, record)
+		if err != nil {
+			return count, errors.Wrapf(err, "validating %s.%s", record.TypeName, record.InstanceID)
+		}
+
+		err = storage.Import(ctx, record)
+		if err != nil {
+			return count, errors.Wrapf(err, "importing %s.%s", record.TypeName, record.InstanceID)
+		}
+		count++
+	}
+}
+
+func validate(mapping jetflow.HandlerFactoryMapping, record jetflow.StateRecord) error {
+	factory, ok := mapping[record.TypeName]
+	if !ok {
+		return errors.Errorf("unknown operator type %s", record.TypeName)
+	}
+	handler, ok := factory(record.InstanceID).(jetflow.StatefulHandler)
+	if !ok {
+		return errors.Errorf("operator type %s is not a StatefulHandler", record.TypeName)
+	}
+	return handler.UnmarshalState(record.State)
+}
@@ -0,0 +1,58 @@
+package dump
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mathieupost/jetflow/storage/memory"
+	"github.com/mathieupost/jetflow/storage/storagetest"
+)
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	source := memory.NewStorage(storagetest.Mapping())
+	for _, id := range []string{"a", "b", "c"} {
+		call := storagetest.Request("1", id)
+		operator, err := source.Get(ctx, call)
+		require.NoError(t, err)
+		operator.Handle(ctx, nil, call)
+		require.NoError(t, source.Prepare(ctx, call))
+		require.NoError(t, source.Commit(ctx, call))
+	}
+
+	var buf bytes.Buffer
+	count, err := Export(ctx, source, nil, &buf)
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+	require.Equal(t, 3, strings.Count(buf.String(), "\n"))
+
+	target := memory.NewStorage(storagetest.Mapping())
+	count, err = Import(ctx, target, storagetest.Mapping(), &buf)
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+
+	operator, err := target.Get(ctx, storagetest.Request("2", "b"))
+	require.NoError(t, err)
+	require.Equal(t, 2, storagetest.Field(t, operator))
+}
+
+func TestImportInvalid(t *testing.T) {
+	ctx := context.Background()
+	target := memory.NewStorage(storagetest.Mapping())
+
+	t.Run("UnknownType", func(t *testing.T) {
+		r := strings.NewReader(`{"n":"OtherType","i":"a","s":{}}` + "\n")
+		_, err := Import(ctx, target, storagetest.Mapping(), r)
+		require.ErrorContains(t, err, "unknown operator type")
+	})
+
+	t.Run("InvalidState", func(t *testing.T) {
+		r := strings.NewReader(`{"n":"TestType","i":"a","s":"field"}` + "\n")
+		_, err := Import(ctx, target, storagetest.Mapping(), r)
+		require.ErrorContains(t, err, "validating TestType.a")
+	})
+}
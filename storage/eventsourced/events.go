@@ -0,0 +1,253 @@
+package eventsourced
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/mathieupost/jetflow"
+)
+
+// Event is a committed call to an operator.
+type Event struct {
+	Seq           uint64
+	TransactionID string
+	Method        string
+	Args          []byte
+	// Calls are the responses to the calls that the operator made while
+	// handling the event, in order.
+	Calls []jetflow.Response
+	// Failed is set if the operator returned an error.
+	Failed bool
+}
+
+// Events returns the committed events of the operator after the given
+// sequence number, in order.
+func (s *Storage) Events(ctx context.Context, typeName, id string, after uint64) ([]Event, error) {
+	rows, err := s.db.QueryContext(ctx, s.query(`SELECT seq, transaction_id, method, args, calls, failed FROM %s
+		WHERE type_name = ? AND instance_id = ? AND seq > ?
+		ORDER BY seq`, s.eventsTable),
+		typeName, id, after,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying events")
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		var event Event
+		var calls []byte
+		err = rows.Scan(&event.Seq, &event.TransactionID, &event.Method, &event.Args, &calls, &event.Failed)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning event")
+		}
+		if len(calls) > 0 {
+			err = json.Unmarshal(calls, &event.Calls)
+			if err != nil {
+				return nil, errors.Wrapf(err, "unmarshalling calls of event %d", event.Seq)
+			}
+		}
+		events = append(events, event)
+	}
+
+	return events, errors.Wrap(rows.Err(), "querying events")
+}
+
+// rebuild returns the state of the operator after the event with the given
+// sequence number.
+func (s *Storage) rebuild(ctx context.Context, typeName, id string, seq uint64) ([]byte, error) {
+	handler, err := s.newHandler(typeName, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start from the cached state or the latest snapshot, whichever is newer.
+	operatorKey := typeName + "." + id
+	s.mu.Lock()
+	c, ok := s.committed[operatorKey]
+	s.mu.Unlock()
+	if ok && c.seq == seq {
+		return c.state, nil
+	}
+	var from uint64
+	var state []byte
+	if ok && c.seq < seq {
+		from, state = c.seq, c.state
+	}
+	snapshotSeq, snapshotState, err := s.loadSnapshot(ctx, typeName, id)
+	if err != nil {
+		return nil, err
+	}
+	if snapshotSeq > from && snapshotSeq <= seq {
+		from, state = snapshotSeq, snapshotState
+	}
+	if state != nil {
+		err = handler.UnmarshalState(state)
+		if err != nil {
+			return nil, errors.Wrap(err, "unmarshalling snapshot")
+		}
+	}
+
+	events, err := s.Events(ctx, typeName, id, from)
+	if err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		if event.Seq > seq {
+			break
+		}
+		err = replay(ctx, handler, typeName, id, event)
+		if err != nil {
+			return nil, errors.Wrapf(err, "replaying event %d", event.Seq)
+		}
+	}
+
+	state, err = handler.MarshalState()
+	if err != nil {
+		return nil, errors.Wrap(err, "marshalling state")
+	}
+
+	s.mu.Lock()
+	if c, ok := s.committed[operatorKey]; !ok || c.seq < seq {
+		s.committed[operatorKey] = &committed{seq: seq, state: state}
+	}
+	s.mu.Unlock()
+
+	return state, nil
+}
+
+// replay handles the event again, with the recorded responses to the calls
+// that the operator made.
+func replay(ctx context.Context, handler jetflow.OperatorHandler, typeName, id string, event Event) error {
+	client := &replayClient{calls: event.Calls}
+	_, err := handler.Handle(ctx, client, &jetflow.Request{
+		TransactionID: event.TransactionID,
+		TypeName:      typeName,
+		InstanceID:    id,
+		Method:        event.Method,
+		Args:          event.Args,
+	})
+	if client.err != nil {
+		return client.err
+	}
+	if err != nil && !event.Failed {
+		return err
+	}
+	if len(client.calls) > 0 {
+		return errors.Errorf("%d recorded calls were not made", len(client.calls))
+	}
+	return nil
+}
+
+func (s *Storage) loadSnapshot(ctx context.Context, typeName, id string) (uint64, []byte, error) {
+	var seq uint64
+	var state []byte
+	err := s.db.QueryRowContext(ctx, s.query(`SELECT seq, state FROM %s
+		WHERE type_name = ? AND instance_id = ?`, s.snapshotsTable),
+		typeName, id,
+	).Scan(&seq, &state)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil, nil
+	}
+	return seq, state, errors.Wrap(err, "loading snapshot")
+}
+
+func (s *Storage) storeSnapshot(ctx context.Context, tx *sql.Tx, typeName, id string, seq uint64, state []byte) error {
+	_, err := tx.ExecContext(ctx, s.dialect.Bind(s.dialect.Upsert(s.snapshotsTable,
+		[]string{"type_name", "instance_id", "seq", "state"},
+		[]string{"type_name", "instance_id"},
+	)),
+		typeName, id, seq, state,
+	)
+	return errors.Wrap(err, "storing snapshot")
+}
+
+func marshalCalls(calls []jetflow.Response) ([]byte, error) {
+	if len(calls) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(calls)
+	return data, errors.Wrap(err, "marshalling calls")
+}
+
+var _ jetflow.OperatorHandler = (*eventHandler)(nil)
+
+// eventHandler records the calls to the operator of a transaction as events.
+type eventHandler struct {
+	handler jetflow.StatefulHandler
+
+	mu     sync.Mutex
+	events []Event
+}
+
+// Handle implements jetflow.OperatorHandler.
+func (h *eventHandler) Handle(ctx context.Context, client jetflow.OperatorClient, call *jetflow.Request) ([]byte, error) {
+	recorder := &recordingClient{OperatorClient: client}
+	res, err := h.handler.Handle(ctx, recorder, call)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, Event{
+		TransactionID: call.TransactionID,
+		Method:        call.Method,
+		Args:          call.Args,
+		Calls:         recorder.calls,
+		Failed:        err != nil,
+	})
+
+	return res, err
+}
+
+// Unwrap returns the handler of the operator.
+func (h *eventHandler) Unwrap() jetflow.OperatorHandler {
+	return h.handler
+}
+
+// result returns the state of the operator and the recorded events.
+func (h *eventHandler) result() ([]byte, []Event, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state, err := h.handler.MarshalState()
+	return state, h.events, err
+}
+
+// recordingClient records the responses to the calls that an operator makes.
+type recordingClient struct {
+	jetflow.OperatorClient
+
+	mu    sync.Mutex
+	calls []jetflow.Response
+}
+
+func (c *recordingClient) Call(ctx context.Context, call *jetflow.Request) ([]byte, error) {
+	res, err := c.OperatorClient.Call(ctx, call)
+	c.mu.Lock()
+	c.calls = append(c.calls, jetflow.Response{Values: res, Error: err})
+	c.mu.Unlock()
+	return res, err
+}
+
+// replayClient returns the recorded responses instead of calling the
+// operators again.
+type replayClient struct {
+	calls []jetflow.Response
+	err   error
+}
+
+func (c *replayClient) Call(ctx context.Context, call *jetflow.Request) ([]byte, error) {
+	if len(c.calls) == 0 {
+		c.err = errors.Errorf("call to %s(%s).%s was not recorded", call.TypeName, call.InstanceID, call.Method)
+		return nil, c.err
+	}
+	res := c.calls[0]
+	c.calls = c.calls[1:]
+	return res.Values, res.Error
+}
+
+func (c *replayClient) Find(ctx context.Context, id string, operator interface{}) error {
+	return errors.New("operators cannot be found while replaying events")
+}
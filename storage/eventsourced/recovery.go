@@ -0,0 +1,43 @@
+package eventsourced
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mathieupost/jetflow"
+)
+
+var _ jetflow.RecoverableStorage = (*Storage)(nil)
+
+// Prepared implements jetflow.RecoverableStorage.
+func (s *Storage) Prepared(ctx context.Context, before time.Time) ([]*jetflow.Request, error) {
+	rows, err := s.db.QueryContext(ctx, s.query(`SELECT type_name, instance_id, transaction_id, coordinator, coordinator_id FROM %s
+		WHERE prepared_at < ?`, s.preparedTable),
+		before.UnixNano(),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying prepared operators")
+	}
+	defer rows.Close()
+
+	var prepared []*jetflow.Request
+	for rows.Next() {
+		request := &jetflow.Request{Method: string(jetflow.MethodPrepare)}
+		var coordinator, coordinatorID sql.NullString
+		err = rows.Scan(&request.TypeName, &request.InstanceID, &request.TransactionID, &coordinator, &coordinatorID)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning prepared operator")
+		}
+		if coordinator.Valid {
+			request.Coordinator = &jetflow.Address{
+				TypeName:   coordinator.String,
+				InstanceID: coordinatorID.String,
+			}
+		}
+		prepared = append(prepared, request)
+	}
+	return prepared, errors.Wrap(rows.Err(), "querying prepared operators")
+}
@@ -0,0 +1,453 @@
+// Package eventsourced implements a jetflow.Storage that persists the calls
+// to the operators as events, instead of their states, using database/sql.
+//
+// Every call that a transaction made to an operator is recorded together
+// with the results of the calls that the operator made while handling it.
+// The state of an operator is rebuilt by replaying its events through its
+// handler, starting from the latest snapshot. The results of the calls to
+// other operators are replayed from the events, so the handlers must be
+// deterministic given their state, the arguments and those results.
+//
+// Prepared events are stored in a separate table, whose primary key allows
+// a single prepared transaction per operator. The events of an operator are
+// only inserted by the transaction that prepared it, so its commit can not
+// conflict.
+//
+// The queries use the PostgreSQL dialect by default, see WithDialect.
+package eventsourced
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+
+	"github.com/mathieupost/jetflow"
+	sqlstorage "github.com/mathieupost/jetflow/storage/sql"
+)
+
+var _ jetflow.Storage = (*Storage)(nil)
+
+type Storage struct {
+	typeHandlerMapping jetflow.HandlerFactoryMapping
+	db                 *sql.DB
+	eventsTable        string
+	snapshotsTable     string
+	preparedTable      string
+	dialect            sqlstorage.Dialect
+	snapshotInterval   uint64
+
+	mu        sync.Mutex
+	versions  map[string]*version
+	committed map[string]*committed
+}
+
+// version is the state of an operator for a single transaction.
+type version struct {
+	base      uint64
+	baseState []byte
+	handler   *eventHandler
+}
+
+// committed is the cached state of the last committed event of an operator.
+type committed struct {
+	seq   uint64
+	state []byte
+}
+
+type Option func(*Storage)
+
+// WithTables sets the names of the tables in which the events and snapshots
+// are stored. Defaults to jetflow_events and jetflow_snapshots. The prepared
+// events are stored in the events table name with a _prepared suffix.
+func WithTables(events, snapshots string) Option {
+	return func(s *Storage) {
+		s.eventsTable = events
+		s.snapshotsTable = snapshots
+	}
+}
+
+// WithDialect sets the dialect of the database. Defaults to
+// sqlstorage.PostgreSQL.
+func WithDialect(dialect sqlstorage.Dialect) Option {
+	return func(s *Storage) {
+		s.dialect = dialect
+	}
+}
+
+// WithSnapshotInterval sets the number of events after which a snapshot of
+// the operator state is stored, which bounds the number of events that are
+// replayed. Defaults to 100.
+func WithSnapshotInterval(events uint64) Option {
+	return func(s *Storage) {
+		s.snapshotInterval = events
+	}
+}
+
+// NewStorage creates the event and snapshot tables in db if they do not
+// exist yet.
+func NewStorage(ctx context.Context, mapping jetflow.HandlerFactoryMapping, db *sql.DB, opts ...Option) (*Storage, error) {
+	s := &Storage{
+		typeHandlerMapping: mapping,
+		db:                 db,
+		eventsTable:        "jetflow_events",
+		snapshotsTable:     "jetflow_snapshots",
+		dialect:            sqlstorage.PostgreSQL,
+		snapshotInterval:   100,
+		versions:           map[string]*version{},
+		committed:          map[string]*committed{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.preparedTable = s.eventsTable + "_prepared"
+	for _, table := range []string{s.eventsTable, s.snapshotsTable} {
+		err := sqlstorage.ValidateTableName(table)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %[1]s (
+		type_name      TEXT NOT NULL,
+		instance_id    TEXT NOT NULL,
+		seq            BIGINT NOT NULL,
+		transaction_id TEXT NOT NULL,
+		method         TEXT NOT NULL,
+		args           %[2]s,
+		calls          %[2]s,
+		failed         BOOLEAN NOT NULL,
+		PRIMARY KEY (type_name, instance_id, seq)
+	)`, s.eventsTable, s.dialect.Blob))
+	if err != nil {
+		return nil, errors.Wrap(err, "creating events table")
+	}
+	_, err = db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %[1]s (
+		type_name   TEXT NOT NULL,
+		instance_id TEXT NOT NULL,
+		seq         BIGINT NOT NULL,
+		state       %[2]s NOT NULL,
+		PRIMARY KEY (type_name, instance_id)
+	)`, s.snapshotsTable, s.dialect.Blob))
+	if err != nil {
+		return nil, errors.Wrap(err, "creating snapshots table")
+	}
+	_, err = db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %[1]s (
+		type_name      TEXT NOT NULL,
+		instance_id    TEXT NOT NULL,
+		transaction_id TEXT NOT NULL,
+		base           BIGINT NOT NULL,
+		events         %[2]s NOT NULL,
+		state          %[2]s NOT NULL,
+		prepared_at    BIGINT NOT NULL,
+		coordinator    TEXT,
+		coordinator_id TEXT,
+		PRIMARY KEY (type_name, instance_id)
+	)`, s.preparedTable, s.dialect.Blob))
+	if err != nil {
+		return nil, errors.Wrap(err, "creating prepared table")
+	}
+
+	return s, nil
+}
+
+func (s *Storage) Get(ctx context.Context, call *jetflow.Request) (jetflow.OperatorHandler, error) {
+	ctx, span := otel.Tracer("").Start(ctx, "eventsourced.Storage.Get")
+	defer span.End()
+
+	versionKey := call.TypeName + "." + call.InstanceID + "." + call.TransactionID
+
+	seq, err := s.lastSeq(ctx, call.TypeName, call.InstanceID)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading last event")
+	}
+
+	s.mu.Lock()
+	v, ok := s.versions[versionKey]
+	s.mu.Unlock()
+	if ok {
+		// Check if the version is not yet outdated because of a
+		// new committed version.
+		if v.base != seq {
+			return nil, errors.Wrap(jetflow.ErrConflict, "outdated version")
+		}
+		return v.handler, nil
+	}
+
+	// Create the operator version for the current request from the
+	// committed state.
+	state, err := s.rebuild(ctx, call.TypeName, call.InstanceID, seq)
+	if err != nil {
+		return nil, errors.Wrap(err, "rebuilding committed state")
+	}
+	handler, err := s.newHandler(call.TypeName, call.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	err = handler.UnmarshalState(state)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshalling committed state")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok = s.versions[versionKey]
+	if ok {
+		// Created by a concurrent call of the same transaction.
+		return v.handler, nil
+	}
+	v = &version{
+		base:      seq,
+		baseState: state,
+		handler:   &eventHandler{handler: handler},
+	}
+	s.versions[versionKey] = v
+
+	return v.handler, nil
+}
+
+func (s *Storage) Prepare(ctx context.Context, call *jetflow.Request) error {
+	ctx, span := otel.Tracer("").Start(ctx, "eventsourced.Storage.Prepare")
+	defer span.End()
+
+	operatorKey := call.TypeName + "." + call.InstanceID
+	versionKey := operatorKey + "." + call.TransactionID
+
+	s.mu.Lock()
+	v, ok := s.versions[versionKey]
+	s.mu.Unlock()
+	if !ok {
+		return errors.Wrapf(jetflow.ErrConflict, "request operator does not exist for %s", versionKey)
+	}
+
+	state, events, err := v.handler.result()
+	if err != nil {
+		return errors.Wrap(err, "marshalling state")
+	}
+	if bytes.Equal(state, v.baseState) {
+		// Operator was not written
+		return nil
+	}
+
+	data, err := json.Marshal(events)
+	if err != nil {
+		return errors.Wrap(err, "marshalling events")
+	}
+
+	var coordinator, coordinatorID sql.NullString
+	if call.Coordinator != nil {
+		coordinator = sql.NullString{String: call.Coordinator.TypeName, Valid: true}
+		coordinatorID = sql.NullString{String: call.Coordinator.InstanceID, Valid: true}
+	}
+
+	// The primary key only allows one prepared transaction per operator.
+	res, err := s.db.ExecContext(ctx, s.dialect.Bind(s.dialect.InsertIgnore(s.preparedTable,
+		[]string{"type_name", "instance_id", "transaction_id", "base", "events", "state", "prepared_at", "coordinator", "coordinator_id"},
+		[]string{"type_name", "instance_id"},
+	)),
+		call.TypeName, call.InstanceID, call.TransactionID, v.base, data, state,
+		time.Now().UnixNano(), coordinator, coordinatorID,
+	)
+	if err != nil {
+		return errors.Wrap(err, "storing prepared events")
+	}
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "storing prepared events")
+	}
+	if inserted == 0 {
+		transactionID, _, err := s.loadPrepared(ctx, s.db, call.TypeName, call.InstanceID)
+		if err != nil {
+			return errors.Wrap(err, "loading prepared events")
+		}
+		if transactionID != call.TransactionID {
+			// Already prepared by another request.
+			return errors.Wrap(jetflow.ErrConflict, "already prepared")
+		}
+		return nil
+	}
+
+	// No events can be committed while the operator is prepared, so the
+	// version only has to be checked once.
+	seq, err := s.lastSeq(ctx, call.TypeName, call.InstanceID)
+	if err == nil && v.base != seq {
+		// A new version is already committed.
+		err = errors.Wrap(jetflow.ErrConflict, "base outdated")
+	}
+	if err != nil {
+		s.deletePrepared(ctx, s.db, call)
+		return errors.Wrap(err, "checking committed version")
+	}
+
+	return nil
+}
+
+func (s *Storage) Commit(ctx context.Context, call *jetflow.Request) error {
+	ctx, span := otel.Tracer("").Start(ctx, "eventsourced.Storage.Commit")
+	defer span.End()
+
+	operatorKey := call.TypeName + "." + call.InstanceID
+	versionKey := operatorKey + "." + call.TransactionID
+
+	s.mu.Lock()
+	// Delete the transaction version.
+	delete(s.versions, versionKey)
+	s.mu.Unlock()
+
+	// The events are inserted and the prepared events deleted in one
+	// database transaction, so a failed commit can be retried.
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	transactionID, p, err := s.loadPrepared(ctx, tx, call.TypeName, call.InstanceID)
+	if err != nil {
+		return errors.Wrap(err, "loading prepared events")
+	}
+	if transactionID != call.TransactionID {
+		// The transaction did not write the operator, or the commit was
+		// applied before and is sent again because its acknowledgement
+		// was lost. Either way there is nothing left to apply.
+		return nil
+	}
+
+	seq := p.base
+	for _, event := range p.events {
+		seq++
+		calls, err := marshalCalls(event.Calls)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, s.query(`INSERT INTO %s
+			(type_name, instance_id, seq, transaction_id, method, args, calls, failed)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, s.eventsTable),
+			call.TypeName, call.InstanceID, seq, call.TransactionID,
+			event.Method, event.Args, calls, event.Failed,
+		)
+		if err != nil {
+			return errors.Wrap(err, "inserting event")
+		}
+	}
+
+	if s.snapshotInterval > 0 && seq/s.snapshotInterval > p.base/s.snapshotInterval {
+		err = s.storeSnapshot(ctx, tx, call.TypeName, call.InstanceID, seq, p.state)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.deletePrepared(ctx, tx, call)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to commit")
+	}
+
+	s.mu.Lock()
+	s.committed[operatorKey] = &committed{seq: seq, state: p.state}
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *Storage) Rollback(ctx context.Context, call *jetflow.Request) error {
+	ctx, span := otel.Tracer("").Start(ctx, "eventsourced.Storage.Rollback")
+	defer span.End()
+
+	operatorKey := call.TypeName + "." + call.InstanceID
+	versionKey := operatorKey + "." + call.TransactionID
+
+	// Cleanup version.
+	s.mu.Lock()
+	delete(s.versions, versionKey)
+	s.mu.Unlock()
+
+	// Unprepare if needed.
+	return s.deletePrepared(ctx, s.db, call)
+}
+
+// preparedEvents are the events that a transaction prepared for an operator.
+type preparedEvents struct {
+	base   uint64
+	events []Event
+	state  []byte
+}
+
+// queryer is implemented by *sql.DB and *sql.Tx.
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// loadPrepared returns the id of the transaction that prepared the operator
+// and its events. The id is empty if the operator is not prepared.
+func (s *Storage) loadPrepared(ctx context.Context, q queryer, typeName, id string) (string, *preparedEvents, error) {
+	var transactionID string
+	var events []byte
+	p := &preparedEvents{}
+	err := q.QueryRowContext(ctx, s.query(`SELECT transaction_id, base, events, state FROM %s
+		WHERE type_name = ? AND instance_id = ?`, s.preparedTable),
+		typeName, id,
+	).Scan(&transactionID, &p.base, &events, &p.state)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	err = json.Unmarshal(events, &p.events)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "unmarshalling events")
+	}
+	return transactionID, p, nil
+}
+
+// deletePrepared deletes the events that the transaction of the call
+// prepared for the operator, if any.
+func (s *Storage) deletePrepared(ctx context.Context, q queryer, call *jetflow.Request) error {
+	_, err := q.ExecContext(ctx, s.query(`DELETE FROM %s
+		WHERE type_name = ? AND instance_id = ? AND transaction_id = ?`, s.preparedTable),
+		call.TypeName, call.InstanceID, call.TransactionID,
+	)
+	return errors.Wrap(err, "deleting prepared events")
+}
+
+// query fills in the table name and the placeholders of the dialect.
+func (s *Storage) query(format, table string) string {
+	return s.dialect.Bind(fmt.Sprintf(format, table))
+}
+
+// lastSeq returns the sequence number of the last committed event of the
+// operator, or 0 if it has none.
+func (s *Storage) lastSeq(ctx context.Context, typeName, id string) (uint64, error) {
+	var seq sql.NullInt64
+	err := s.db.QueryRowContext(ctx, s.query(`SELECT MAX(seq) FROM %s
+		WHERE type_name = ? AND instance_id = ?`, s.eventsTable),
+		typeName, id,
+	).Scan(&seq)
+	return uint64(seq.Int64), err
+}
+
+// newHandler creates a new instance of the operator using its factory.
+func (s *Storage) newHandler(typeName, id string) (jetflow.StatefulHandler, error) {
+	factory, ok := s.typeHandlerMapping[typeName]
+	if !ok {
+		return nil, errors.Errorf("unknown operator type %s", typeName)
+	}
+	handler, ok := factory(id).(jetflow.StatefulHandler)
+	if !ok {
+		return nil, errors.Errorf("operator type %s is not a StatefulHandler", typeName)
+	}
+	return handler, nil
+}
@@ -0,0 +1,157 @@
+package eventsourced
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+
+	"github.com/mathieupost/jetflow"
+	sqlstorage "github.com/mathieupost/jetflow/storage/sql"
+	"github.com/mathieupost/jetflow/storage/storagetest"
+)
+
+func TestPrepare(t *testing.T) {
+	db := openDB(t)
+	storagetest.TestPrepare(t, func(t *testing.T, mapping jetflow.HandlerFactoryMapping) jetflow.Storage {
+		s, err := NewStorage(context.Background(), mapping, db)
+		require.NoError(t, err)
+		return s
+	})
+}
+
+func TestRecovery(t *testing.T) {
+	db := openDB(t)
+	storagetest.TestRecovery(t, func(t *testing.T, mapping jetflow.HandlerFactoryMapping) jetflow.Storage {
+		s, err := NewStorage(context.Background(), mapping, db)
+		require.NoError(t, err)
+		return s
+	})
+}
+
+func TestReplay(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+
+	mapping := jetflow.HandlerFactoryMapping{
+		"TestType": func(id string) jetflow.OperatorHandler {
+			return &callingHandler{storagetest.NewTestTypeHandler(id).(*storagetest.TestTypeHandler)}
+		},
+	}
+	s, err := NewStorage(ctx, mapping, db, WithSnapshotInterval(2), WithDialect(sqlstorage.SQLite))
+	require.NoError(t, err)
+
+	// Every call adds the response of a call to another operator, which is
+	// not called again when the events are replayed.
+	client := &countingClient{}
+	for i, trID := range []string{"1", "2", "3"} {
+		call := storagetest.Request(trID, "op")
+		operator, err := s.Get(ctx, call)
+		require.NoError(t, err)
+		_, err = operator.Handle(ctx, client, call)
+		require.NoError(t, err)
+		require.NoError(t, s.Prepare(ctx, call))
+		require.NoError(t, s.Commit(ctx, call))
+		require.Equal(t, i+1, client.calls)
+	}
+
+	events, err := s.Events(ctx, "TestType", "op", 0)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	require.Equal(t, uint64(3), events[2].Seq)
+	require.Equal(t, "3", events[2].TransactionID)
+	require.Len(t, events[2].Calls, 1)
+
+	seq, _, err := s.loadSnapshot(ctx, "TestType", "op")
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), seq)
+
+	// A new storage rebuilds the state from the snapshot and the events.
+	s, err = NewStorage(ctx, mapping, db, WithSnapshotInterval(2), WithDialect(sqlstorage.SQLite))
+	require.NoError(t, err)
+	operator, err := s.Get(ctx, storagetest.Request("4", "op"))
+	require.NoError(t, err)
+	require.Equal(t, 1+1+2+3, storagetest.Field(t, operator))
+	require.Equal(t, 3, client.calls)
+}
+
+func TestPrepareConflict(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+
+	s1, err := NewStorage(ctx, storagetest.Mapping(), db)
+	require.NoError(t, err)
+	s2, err := NewStorage(ctx, storagetest.Mapping(), db)
+	require.NoError(t, err)
+
+	// Both consumers write a version of the same operator.
+	call1 := storagetest.Request("1", "op")
+	operator, err := s1.Get(ctx, call1)
+	require.NoError(t, err)
+	operator.Handle(ctx, nil, call1)
+
+	call2 := storagetest.Request("2", "op")
+	operator, err = s2.Get(ctx, call2)
+	require.NoError(t, err)
+	operator.Handle(ctx, nil, call2)
+
+	// Only the first prepare succeeds, so the commit can not conflict.
+	require.NoError(t, s1.Prepare(ctx, call1))
+	require.ErrorIs(t, s2.Prepare(ctx, call2), jetflow.ErrConflict)
+	require.NoError(t, s2.Rollback(ctx, call2))
+	require.NoError(t, s1.Commit(ctx, call1))
+
+	operator, err = s2.Get(ctx, storagetest.Request("3", "op"))
+	require.NoError(t, err)
+	require.Equal(t, 2, storagetest.Field(t, operator))
+}
+
+func TestTableNames(t *testing.T) {
+	_, err := NewStorage(context.Background(), storagetest.Mapping(), openDB(t), WithTables("events", "snapshots --"))
+	require.ErrorContains(t, err, "invalid table name")
+}
+
+// callingHandler adds the response of a call to another operator to the
+// field of the TestType.
+type callingHandler struct {
+	*storagetest.TestTypeHandler
+}
+
+func (h *callingHandler) Handle(ctx context.Context, client jetflow.OperatorClient, call *jetflow.Request) ([]byte, error) {
+	res, err := client.Call(ctx, &jetflow.Request{TypeName: "Other", InstanceID: "other", Method: "Count"})
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(string(res))
+	if err != nil {
+		return nil, err
+	}
+	return h.TestTypeHandler.Handle(ctx, client, &jetflow.Request{Args: make([]byte, n)})
+}
+
+// Unwrap returns the TestTypeHandler.
+func (h *callingHandler) Unwrap() jetflow.OperatorHandler {
+	return h.TestTypeHandler
+}
+
+// countingClient responds to every call with the number of calls so far.
+type countingClient struct {
+	jetflow.OperatorClient
+	calls int
+}
+
+func (c *countingClient) Call(ctx context.Context, call *jetflow.Request) ([]byte, error) {
+	c.calls++
+	return []byte(strconv.Itoa(c.calls)), nil
+}
+
+func openDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "jetflow.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
@@ -0,0 +1,31 @@
+package file
+
+import (
+	"context"
+	"time"
+
+	"github.com/mathieupost/jetflow"
+)
+
+var _ jetflow.RecoverableStorage = (*Storage)(nil)
+
+// Prepared implements jetflow.RecoverableStorage.
+func (s *Storage) Prepared(ctx context.Context, before time.Time) ([]*jetflow.Request, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var prepared []*jetflow.Request
+	for _, e := range s.committed {
+		if e.prepared == "" || !e.preparedAt.Before(before) {
+			continue
+		}
+		prepared = append(prepared, &jetflow.Request{
+			TransactionID: e.prepared,
+			TypeName:      e.TypeName,
+			InstanceID:    e.InstanceID,
+			Method:        string(jetflow.MethodPrepare),
+			Coordinator:   e.coordinator,
+		})
+	}
+	return prepared, nil
+}
@@ -0,0 +1,379 @@
+// Package file implements a durable jetflow.Storage that keeps the committed
+// operator states in memory and persists them with a write-ahead log and
+// periodic snapshots.
+package file
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+
+	"github.com/mathieupost/jetflow"
+	"github.com/mathieupost/jetflow/log"
+)
+
+var _ jetflow.Storage = (*Storage)(nil)
+
+const (
+	walFileName      = "wal.log"
+	snapshotFileName = "snapshot.json"
+)
+
+type Storage struct {
+	typeHandlerMapping jetflow.HandlerFactoryMapping
+	dir                string
+	snapshotInterval   int
+	commitHooks        []jetflow.CommitHook
+
+	mu        sync.Mutex
+	committed map[string]*entry
+	versions  map[string]*version
+	wal       *os.File
+	commits   int
+}
+
+// entry is the committed state of an operator.
+type entry struct {
+	TypeName   string `json:"n"`
+	InstanceID string `json:"i"`
+	Version    uint64 `json:"v"`
+	State      []byte `json:"s"`
+
+	// prepared is the id of the transaction that prepared preparedState.
+	prepared      string
+	preparedState []byte
+	// coordinator is the coordinator of the prepared transaction and
+	// preparedAt the time at which it prepared the operator.
+	coordinator *jetflow.Address
+	preparedAt  time.Time
+}
+
+// version is the state of an operator for a single transaction.
+type version struct {
+	base    uint64
+	handler jetflow.StatefulHandler
+}
+
+type Option func(*Storage)
+
+// WithSnapshotInterval sets the number of commits after which a snapshot is
+// written and the write-ahead log is truncated.
+func WithSnapshotInterval(commits int) Option {
+	return func(s *Storage) {
+		s.snapshotInterval = commits
+	}
+}
+
+// WithCommitHook adds a hook that is called with every committed change.
+// Hooks are called while the storage is locked, so the changes of all
+// operators are passed in commit order.
+func WithCommitHook(hook jetflow.CommitHook) Option {
+	return func(s *Storage) {
+		s.commitHooks = append(s.commitHooks, hook)
+	}
+}
+
+// NewStorage opens the storage in dir and recovers the committed operator
+// states from the snapshot and write-ahead log found there.
+func NewStorage(mapping jetflow.HandlerFactoryMapping, dir string, opts ...Option) (*Storage, error) {
+	s := &Storage{
+		typeHandlerMapping: mapping,
+		dir:                dir,
+		snapshotInterval:   1000,
+		committed:          map[string]*entry{},
+		versions:           map[string]*version{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating directory")
+	}
+
+	err = s.recover()
+	if err != nil {
+		return nil, errors.Wrap(err, "recovering state")
+	}
+
+	s.wal, err = os.OpenFile(s.walPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening write-ahead log")
+	}
+
+	return s, nil
+}
+
+// Close syncs and closes the write-ahead log.
+func (s *Storage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.wal.Sync()
+	if err != nil {
+		return errors.Wrap(err, "syncing write-ahead log")
+	}
+	return errors.Wrap(s.wal.Close(), "closing write-ahead log")
+}
+
+func (s *Storage) Get(ctx context.Context, call *jetflow.Request) (jetflow.OperatorHandler, error) {
+	ctx, span := otel.Tracer("").Start(ctx, "file.Storage.Get")
+	defer span.End()
+
+	operatorKey := call.TypeName + "." + call.InstanceID
+	versionKey := operatorKey + "." + call.TransactionID
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	committed := s.committed[operatorKey]
+	var committedVersion uint64
+	if committed != nil {
+		committedVersion = committed.Version
+	}
+
+	// Load the operator version for the current request.
+	v, ok := s.versions[versionKey]
+	if ok {
+		// Check if the version is not yet outdated because of a
+		// new committed version.
+		if v.base != committedVersion {
+			return nil, errors.Wrap(jetflow.ErrConflict, "outdated version")
+		}
+		return v.handler, nil
+	}
+
+	// Create the operator version for the current request from the
+	// committed state.
+	handler, err := s.newHandler(call.TypeName, call.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	if committed != nil && committed.Version > 0 {
+		err = handler.UnmarshalState(committed.State)
+		if err != nil {
+			return nil, errors.Wrap(err, "unmarshalling committed state")
+		}
+	}
+	s.versions[versionKey] = &version{
+		base:    committedVersion,
+		handler: handler,
+	}
+
+	return handler, nil
+}
+
+func (s *Storage) Prepare(ctx context.Context, call *jetflow.Request) error {
+	ctx, span := otel.Tracer("").Start(ctx, "file.Storage.Prepare")
+	defer span.End()
+
+	operatorKey := call.TypeName + "." + call.InstanceID
+	versionKey := operatorKey + "." + call.TransactionID
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.versions[versionKey]
+	if !ok {
+		return errors.Wrapf(jetflow.ErrConflict, "request operator does not exist for %s", versionKey)
+	}
+
+	committed := s.committed[operatorKey]
+	var committedVersion uint64
+	if committed != nil {
+		committedVersion = committed.Version
+	}
+
+	// Check if the version for the given transaction is created
+	// from the committed version.
+	if v.base != committedVersion {
+		// A new version is already committed.
+		return errors.Wrap(jetflow.ErrConflict, "base outdated")
+	}
+
+	state, err := v.handler.MarshalState()
+	if err != nil {
+		return errors.Wrap(err, "marshalling state")
+	}
+	baseState, err := s.committedState(call.TypeName, call.InstanceID, committed)
+	if err != nil {
+		return errors.Wrap(err, "loading base state")
+	}
+	if bytes.Equal(state, baseState) {
+		// Operator was not written
+		return nil
+	}
+
+	if committed != nil && committed.prepared != "" {
+		// Already prepared by another request.
+		return errors.Wrap(jetflow.ErrConflict, "already prepared")
+	}
+
+	if committed == nil {
+		committed = &entry{
+			TypeName:   call.TypeName,
+			InstanceID: call.InstanceID,
+		}
+	}
+	prepared := *committed
+	prepared.prepared = call.TransactionID
+	prepared.preparedState = state
+	prepared.coordinator = call.Coordinator
+	prepared.preparedAt = time.Now()
+
+	// The prepare is synced, so the operator stays prepared after a
+	// restart.
+	err = s.append(prepared.prepareRecord(), true)
+	if err != nil {
+		return errors.Wrap(err, "logging prepare")
+	}
+	*committed = prepared
+	s.committed[operatorKey] = committed
+
+	return nil
+}
+
+func (s *Storage) Commit(ctx context.Context, call *jetflow.Request) error {
+	ctx, span := otel.Tracer("").Start(ctx, "file.Storage.Commit")
+	defer span.End()
+
+	operatorKey := call.TypeName + "." + call.InstanceID
+	versionKey := operatorKey + "." + call.TransactionID
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Delete the transaction version.
+	delete(s.versions, versionKey)
+
+	committed := s.committed[operatorKey]
+	if committed == nil || committed.prepared != call.TransactionID {
+		// The transaction did not write the operator, or the commit was
+		// applied before and is sent again because its acknowledgement
+		// was lost. Either way there is nothing left to apply.
+		return nil
+	}
+
+	err := s.append(record{
+		Op:         opCommit,
+		TypeName:   call.TypeName,
+		InstanceID: call.InstanceID,
+		Tx:         call.TransactionID,
+		Version:    committed.Version + 1,
+	}, true)
+	if err != nil {
+		return errors.Wrap(err, "logging commit")
+	}
+
+	// Update the committed version to the prepared version.
+	previousState := committed.State
+	committed.Version++
+	committed.State = committed.preparedState
+	committed.prepared = ""
+	committed.preparedState = nil
+	committed.coordinator = nil
+
+	for _, hook := range s.commitHooks {
+		hook(ctx, jetflow.Change{
+			TypeName:      call.TypeName,
+			InstanceID:    call.InstanceID,
+			Version:       committed.Version,
+			TransactionID: call.TransactionID,
+			State:         committed.State,
+			PreviousState: previousState,
+		})
+	}
+
+	s.commits++
+	if s.snapshotInterval > 0 && s.commits >= s.snapshotInterval {
+		// The commit is already logged, so a failed snapshot is written
+		// again after the next commit.
+		err = s.snapshot()
+		if err != nil {
+			log.Println("writing snapshot", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Storage) Rollback(ctx context.Context, call *jetflow.Request) error {
+	ctx, span := otel.Tracer("").Start(ctx, "file.Storage.Rollback")
+	defer span.End()
+
+	operatorKey := call.TypeName + "." + call.InstanceID
+	versionKey := operatorKey + "." + call.TransactionID
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Cleanup version.
+	delete(s.versions, versionKey)
+
+	// Unprepare if needed.
+	committed := s.committed[operatorKey]
+	if committed == nil || committed.prepared != call.TransactionID {
+		return nil
+	}
+
+	err := s.append(record{
+		Op:         opRollback,
+		TypeName:   call.TypeName,
+		InstanceID: call.InstanceID,
+		Tx:         call.TransactionID,
+	}, false)
+	if err != nil {
+		return errors.Wrap(err, "logging rollback")
+	}
+
+	committed.prepared = ""
+	committed.preparedState = nil
+	committed.coordinator = nil
+	if committed.Version == 0 {
+		// The operator was never committed.
+		delete(s.committed, operatorKey)
+	}
+
+	return nil
+}
+
+// newHandler creates a new instance of the operator using its factory.
+func (s *Storage) newHandler(typeName, id string) (jetflow.StatefulHandler, error) {
+	factory, ok := s.typeHandlerMapping[typeName]
+	if !ok {
+		return nil, errors.Errorf("unknown operator type %s", typeName)
+	}
+	handler, ok := factory(id).(jetflow.StatefulHandler)
+	if !ok {
+		return nil, errors.Errorf("operator type %s is not a StatefulHandler", typeName)
+	}
+	return handler, nil
+}
+
+// committedState returns the committed state of an operator, or the state of
+// a new instance if it was never committed.
+func (s *Storage) committedState(typeName, id string, committed *entry) ([]byte, error) {
+	handler, err := s.newHandler(typeName, id)
+	if err != nil {
+		return nil, err
+	}
+	if committed != nil && committed.Version > 0 {
+		return jetflow.UpgradeState(handler, committed.State)
+	}
+	return handler.MarshalState()
+}
+
+func (s *Storage) walPath() string {
+	return filepath.Join(s.dir, walFileName)
+}
+
+func (s *Storage) snapshotPath() string {
+	return filepath.Join(s.dir, snapshotFileName)
+}
@@ -0,0 +1,189 @@
+package file
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mathieupost/jetflow"
+	"github.com/mathieupost/jetflow/storage/storagetest"
+)
+
+func TestPrepare(t *testing.T) {
+	storagetest.TestPrepare(t, func(t *testing.T, mapping jetflow.HandlerFactoryMapping) jetflow.Storage {
+		s, err := NewStorage(mapping, t.TempDir())
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+func TestExport(t *testing.T) {
+	storagetest.TestExport(t, func(t *testing.T, mapping jetflow.HandlerFactoryMapping) jetflow.Storage {
+		s, err := NewStorage(mapping, t.TempDir())
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+func TestCommitHook(t *testing.T) {
+	storagetest.TestCommitHook(t, func(t *testing.T, mapping jetflow.HandlerFactoryMapping, hook jetflow.CommitHook) jetflow.Storage {
+		s, err := NewStorage(mapping, t.TempDir(), WithCommitHook(hook))
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+func TestPrepared(t *testing.T) {
+	dir := t.TempDir()
+	storagetest.TestRecovery(t, func(t *testing.T, mapping jetflow.HandlerFactoryMapping) jetflow.Storage {
+		s, err := NewStorage(mapping, dir)
+		require.NoError(t, err)
+		return s
+	})
+}
+
+func TestRecovery(t *testing.T) {
+	ctx := context.Background()
+
+	test := func(t *testing.T, interval int) {
+		dir := t.TempDir()
+		s, err := NewStorage(storagetest.Mapping(), dir, WithSnapshotInterval(interval))
+		require.NoError(t, err)
+
+		// Commit a new version of the operator.
+		committed := storagetest.Request("committed", "op")
+		operator, err := s.Get(ctx, committed)
+		require.NoError(t, err)
+		operator.Handle(ctx, nil, committed)
+		require.NoError(t, s.Prepare(ctx, committed))
+		require.NoError(t, s.Commit(ctx, committed))
+
+		// Prepare, but never commit, another version.
+		prepared := storagetest.Request("prepared", "op")
+		operator, err = s.Get(ctx, prepared)
+		require.NoError(t, err)
+		operator.Handle(ctx, nil, prepared)
+		require.NoError(t, s.Prepare(ctx, prepared))
+
+		// Kill the storage without closing it and restart it.
+		s, err = NewStorage(storagetest.Mapping(), dir, WithSnapshotInterval(interval))
+		require.NoError(t, err)
+
+		// The committed version is restored and the prepared version
+		// is kept until its transaction is rolled back.
+		require.NoError(t, s.Rollback(ctx, prepared))
+		call := storagetest.Request("restarted", "op")
+		operator, err = s.Get(ctx, call)
+		require.NoError(t, err)
+		require.Equal(t, 2, storagetest.Field(t, operator))
+		operator.Handle(ctx, nil, call)
+		require.NoError(t, s.Prepare(ctx, call))
+		require.NoError(t, s.Commit(ctx, call))
+		require.NoError(t, s.Close())
+
+		s, err = NewStorage(storagetest.Mapping(), dir)
+		require.NoError(t, err)
+		operator, err = s.Get(ctx, storagetest.Request("reopened", "op"))
+		require.NoError(t, err)
+		require.Equal(t, 3, storagetest.Field(t, operator))
+		require.NoError(t, s.Close())
+	}
+
+	t.Run("WriteAheadLog", func(t *testing.T) { test(t, 1000) })
+	t.Run("Snapshot", func(t *testing.T) { test(t, 1) })
+
+	t.Run("TornWrite", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := NewStorage(storagetest.Mapping(), dir)
+		require.NoError(t, err)
+		commit := func(id string) {
+			call := storagetest.Request(id, "op")
+			operator, err := s.Get(ctx, call)
+			require.NoError(t, err)
+			operator.Handle(ctx, nil, call)
+			require.NoError(t, s.Prepare(ctx, call))
+			require.NoError(t, s.Commit(ctx, call))
+		}
+		commit("committed")
+
+		// Tear the last write.
+		_, err = s.wal.WriteString(`{"op":"prep`)
+		require.NoError(t, err)
+
+		// Commits after the restart are not lost behind the torn write.
+		s, err = NewStorage(storagetest.Mapping(), dir)
+		require.NoError(t, err)
+		commit("restarted")
+		require.NoError(t, s.Close())
+
+		s, err = NewStorage(storagetest.Mapping(), dir)
+		require.NoError(t, err)
+		operator, err := s.Get(ctx, storagetest.Request("reopened", "op"))
+		require.NoError(t, err)
+		require.Equal(t, 3, storagetest.Field(t, operator))
+		require.NoError(t, s.Close())
+	})
+
+	t.Run("Corruption", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := NewStorage(storagetest.Mapping(), dir)
+		require.NoError(t, err)
+		for _, id := range []string{"1", "2"} {
+			call := storagetest.Request(id, "op")
+			operator, err := s.Get(ctx, call)
+			require.NoError(t, err)
+			operator.Handle(ctx, nil, call)
+			require.NoError(t, s.Prepare(ctx, call))
+			require.NoError(t, s.Commit(ctx, call))
+		}
+
+		// A corrupt record before acknowledged records is not cut off.
+		require.NoError(t, s.Close())
+		file, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_WRONLY, 0)
+		require.NoError(t, err)
+		_, err = file.WriteAt([]byte("{{"), 0)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+
+		_, err = NewStorage(storagetest.Mapping(), dir)
+		require.ErrorContains(t, err, "corrupt write-ahead log record")
+	})
+}
+
+func TestSnapshotFailure(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := NewStorage(storagetest.Mapping(), dir, WithSnapshotInterval(1))
+	require.NoError(t, err)
+	commit := func(id string) {
+		call := storagetest.Request(id, "op")
+		operator, err := s.Get(ctx, call)
+		require.NoError(t, err)
+		operator.Handle(ctx, nil, call)
+		require.NoError(t, s.Prepare(ctx, call))
+		require.NoError(t, s.Commit(ctx, call))
+	}
+
+	// The truncated write-ahead log can not be created, so the snapshot
+	// fails and the storage keeps using the old log.
+	require.NoError(t, os.Mkdir(filepath.Join(dir, walFileName+".tmp"), 0o755))
+	commit("1")
+	commit("2")
+	require.NoError(t, s.Close())
+	info, err := os.Stat(filepath.Join(dir, walFileName))
+	require.NoError(t, err)
+	require.NotZero(t, info.Size())
+
+	s, err = NewStorage(storagetest.Mapping(), dir)
+	require.NoError(t, err)
+	operator, err := s.Get(ctx, storagetest.Request("reopened", "op"))
+	require.NoError(t, err)
+	require.Equal(t, 3, storagetest.Field(t, operator))
+	require.NoError(t, s.Close())
+}
@@ -0,0 +1,282 @@
+package file
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mathieupost/jetflow"
+	"github.com/mathieupost/jetflow/log"
+)
+
+const (
+	opPrepare  = "prepare"
+	opCommit   = "commit"
+	opRollback = "rollback"
+	opImport   = "import"
+)
+
+// record is a single entry of the write-ahead log.
+type record struct {
+	Op         string `json:"op"`
+	TypeName   string `json:"n"`
+	InstanceID string `json:"i"`
+	Tx         string `json:"o"`
+	Version    uint64 `json:"v,omitempty"`
+	State      []byte `json:"s,omitempty"`
+
+	// Coordinator and Time are the coordinator of the transaction and the
+	// time at which it prepared the operator.
+	Coordinator *jetflow.Address `json:"c,omitempty"`
+	Time        int64            `json:"t,omitempty"`
+}
+
+// append writes the record to the write-ahead log. The log is synced to disk
+// if sync is set.
+func (s *Storage) append(r record, sync bool) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "marshal record")
+	}
+	data = append(data, '\n')
+
+	_, err = s.wal.Write(data)
+	if err != nil {
+		return errors.Wrap(err, "write record")
+	}
+
+	if sync {
+		return errors.Wrap(s.wal.Sync(), "sync write-ahead log")
+	}
+	return nil
+}
+
+// snapshot writes all committed states to the snapshot file and truncates
+// the write-ahead log. Prepared states are logged again, so they can still be
+// committed after the truncation. The truncated log is written next to the
+// log and replaces it once it is synced, so the storage keeps using the old
+// log if the snapshot fails.
+func (s *Storage) snapshot() error {
+	entries := make([]*entry, 0, len(s.committed))
+	for _, e := range s.committed {
+		if e.Version > 0 {
+			entries = append(entries, e)
+		}
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return errors.Wrap(err, "marshal snapshot")
+	}
+
+	tmp := s.snapshotPath() + ".tmp"
+	err = writeFileSync(tmp, data)
+	if err != nil {
+		return errors.Wrap(err, "write snapshot")
+	}
+	err = os.Rename(tmp, s.snapshotPath())
+	if err != nil {
+		return errors.Wrap(err, "rename snapshot")
+	}
+
+	wal, err := s.truncatedLog()
+	if err != nil {
+		return errors.Wrap(err, "truncate write-ahead log")
+	}
+	err = s.wal.Close()
+	if err != nil {
+		log.Println("closing write-ahead log", err)
+	}
+	s.wal = wal
+	s.commits = 0
+	return nil
+}
+
+// truncatedLog writes a write-ahead log that only contains the prepared
+// states and replaces the log by it.
+func (s *Storage) truncatedLog() (*os.File, error) {
+	tmp := s.walPath() + ".tmp"
+	wal, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, errors.Wrap(err, "create write-ahead log")
+	}
+	err = func() error {
+		for _, e := range s.committed {
+			if e.prepared == "" {
+				continue
+			}
+			data, err := json.Marshal(e.prepareRecord())
+			if err != nil {
+				return errors.Wrap(err, "marshal record")
+			}
+			_, err = wal.Write(append(data, '\n'))
+			if err != nil {
+				return errors.Wrap(err, "log prepared state")
+			}
+		}
+		err = wal.Sync()
+		if err != nil {
+			return errors.Wrap(err, "sync write-ahead log")
+		}
+		return errors.Wrap(os.Rename(tmp, s.walPath()), "rename write-ahead log")
+	}()
+	if err != nil {
+		wal.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+	return wal, nil
+}
+
+// recover restores the committed states from the snapshot and replays the
+// write-ahead log on top of it. Prepared states without a commit or rollback
+// record are prepared again, so they wait for the outcome of their
+// transaction.
+func (s *Storage) recover() error {
+	data, err := os.ReadFile(s.snapshotPath())
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "read snapshot")
+	}
+	if err == nil {
+		var entries []*entry
+		err = json.Unmarshal(data, &entries)
+		if err != nil {
+			return errors.Wrap(err, "unmarshal snapshot")
+		}
+		for _, e := range entries {
+			s.committed[e.TypeName+"."+e.InstanceID] = e
+		}
+	}
+
+	file, err := os.Open(s.walPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "open write-ahead log")
+	}
+	defer file.Close()
+
+	// Prepared states by operator and transaction.
+	prepared := map[string]record{}
+	// Offset of the end of the last valid record.
+	var offset int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A record without a newline is a torn write.
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read write-ahead log")
+		}
+
+		var r record
+		err = json.Unmarshal(line, &r)
+		if err != nil {
+			if _, err := reader.Peek(1); err == io.EOF {
+				// A torn write of the last record, which was never
+				// acknowledged.
+				break
+			}
+			// Records after it were acknowledged, so the log can not
+			// be cut off here.
+			return errors.Wrapf(err, "corrupt write-ahead log record at offset %d", offset)
+		}
+		offset += int64(len(line))
+
+		key := r.TypeName + "." + r.InstanceID + "." + r.Tx
+		switch r.Op {
+		case opPrepare:
+			prepared[key] = r
+		case opRollback:
+			delete(prepared, key)
+		case opImport:
+			operatorKey := r.TypeName + "." + r.InstanceID
+			if _, ok := s.committed[operatorKey]; !ok {
+				s.committed[operatorKey] = &entry{
+					TypeName:   r.TypeName,
+					InstanceID: r.InstanceID,
+					Version:    r.Version,
+					State:      r.State,
+				}
+			}
+		case opCommit:
+			p, ok := prepared[key]
+			delete(prepared, key)
+			if !ok {
+				continue
+			}
+			operatorKey := r.TypeName + "." + r.InstanceID
+			e, ok := s.committed[operatorKey]
+			if !ok {
+				e = &entry{TypeName: r.TypeName, InstanceID: r.InstanceID}
+				s.committed[operatorKey] = e
+			}
+			// Skip commits that are already part of the snapshot.
+			if r.Version <= e.Version {
+				continue
+			}
+			e.Version = r.Version
+			e.State = p.State
+		}
+	}
+
+	for _, r := range prepared {
+		operatorKey := r.TypeName + "." + r.InstanceID
+		e, ok := s.committed[operatorKey]
+		if !ok {
+			e = &entry{TypeName: r.TypeName, InstanceID: r.InstanceID}
+			s.committed[operatorKey] = e
+		}
+		if r.Version != e.Version+1 {
+			// Prepared before a snapshot that already contains a
+			// newer version.
+			continue
+		}
+		e.prepared = r.Tx
+		e.preparedState = r.State
+		e.coordinator = r.Coordinator
+		e.preparedAt = time.Unix(0, r.Time)
+	}
+
+	// Cut off the torn write, so new records are not appended after it.
+	return errors.Wrap(os.Truncate(s.walPath(), offset), "truncate write-ahead log")
+}
+
+// prepareRecord returns the record that logs the prepared state of the
+// entry.
+func (e *entry) prepareRecord() record {
+	return record{
+		Op:          opPrepare,
+		TypeName:    e.TypeName,
+		InstanceID:  e.InstanceID,
+		Tx:          e.prepared,
+		Version:     e.Version + 1,
+		State:       e.preparedState,
+		Coordinator: e.coordinator,
+		Time:        e.preparedAt.UnixNano(),
+	}
+}
+
+func writeFileSync(name string, data []byte) error {
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,17 @@
+// Package typenames contains the helpers that the storages share to filter
+// operators by type.
+package typenames
+
+// Contains reports whether typeName is one of typeNames, or if typeNames is
+// empty.
+func Contains(typeNames []string, typeName string) bool {
+	if len(typeNames) == 0 {
+		return true
+	}
+	for _, name := range typeNames {
+		if name == typeName {
+			return true
+		}
+	}
+	return false
+}
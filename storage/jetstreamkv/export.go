@@ -0,0 +1,76 @@
+package jetstreamkv
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/pkg/errors"
+
+	"github.com/mathieupost/jetflow"
+)
+
+var _ jetflow.ExportableStorage = (*Storage)(nil)
+
+// Export implements jetflow.ExportableStorage.
+//
+// The keys are streamed by a watcher, so they are not all held in memory.
+func (s *Storage) Export(ctx context.Context, typeNames []string, fn func(jetflow.StateRecord) error) error {
+	if len(typeNames) == 0 {
+		return s.export(ctx, jetstream.AllKeys, fn)
+	}
+	for _, typeName := range typeNames {
+		err := s.export(ctx, typeName+".*", fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// export calls fn with the states of the operators whose keys match the
+// filter.
+func (s *Storage) export(ctx context.Context, filter string, fn func(jetflow.StateRecord) error) error {
+	watcher, err := s.kv.Watch(ctx, filter, jetstream.IgnoreDeletes(), jetstream.MetaOnly())
+	if err != nil {
+		return errors.Wrap(err, "watching keys")
+	}
+	defer watcher.Stop()
+
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			// All keys were listed.
+			return nil
+		}
+		k := entry.Key()
+		typeName, encodedID, _ := strings.Cut(k, ".")
+		id, err := base64.RawURLEncoding.DecodeString(encodedID)
+		if err != nil {
+			return errors.Wrapf(err, "decoding key %s", k)
+		}
+		_, state, err := s.load(ctx, k)
+		if err != nil {
+			return errors.Wrapf(err, "loading key %s", k)
+		}
+		if state == nil {
+			// Deleted in the meantime.
+			continue
+		}
+		err = fn(jetflow.StateRecord{
+			TypeName:   typeName,
+			InstanceID: string(id),
+			State:      state,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return errors.Wrap(ctx.Err(), "watching keys")
+}
+
+// Import implements jetflow.ExportableStorage.
+func (s *Storage) Import(ctx context.Context, record jetflow.StateRecord) error {
+	_, err := s.kv.Create(ctx, key(record.TypeName, record.InstanceID), record.State)
+	return errors.Wrap(err, "creating key")
+}
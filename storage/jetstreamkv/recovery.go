@@ -0,0 +1,53 @@
+package jetstreamkv
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/pkg/errors"
+
+	"github.com/mathieupost/jetflow"
+)
+
+var _ jetflow.RecoverableStorage = (*Storage)(nil)
+
+// Prepared implements jetflow.RecoverableStorage.
+//
+// The prepared operators of all consumers that share the bucket are returned.
+func (s *Storage) Prepared(ctx context.Context, before time.Time) ([]*jetflow.Request, error) {
+	keys, err := s.preparedKV.Keys(ctx)
+	if errors.Is(err, jetstream.ErrNoKeysFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "listing keys")
+	}
+
+	var requests []*jetflow.Request
+	for _, k := range keys {
+		p, _, err := s.loadPrepared(ctx, k)
+		if err != nil {
+			return nil, errors.Wrapf(err, "loading key %s", k)
+		}
+		if p == nil || !time.Unix(0, p.Time).Before(before) {
+			// Completed in the meantime, or prepared too recently.
+			continue
+		}
+		typeName, encodedID, _ := strings.Cut(k, ".")
+		id, err := base64.RawURLEncoding.DecodeString(encodedID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding key %s", k)
+		}
+		requests = append(requests, &jetflow.Request{
+			TransactionID: p.TransactionID,
+			TypeName:      typeName,
+			InstanceID:    string(id),
+			Method:        string(jetflow.MethodPrepare),
+			Coordinator:   p.Coordinator,
+		})
+	}
+	return requests, nil
+}
@@ -0,0 +1,379 @@
+// Package jetstreamkv implements a jetflow.Storage that keeps the committed
+// operator states in a JetStream Key-Value bucket.
+//
+// The revision of a key is used as the version of the operator. Prepared
+// states are kept in a second bucket, so a transaction that prepared an
+// operator holds it until it is committed or rolled back, also against other
+// consumers. Only the transaction that holds the prepared entry writes the
+// operator, so its commit can not conflict.
+package jetstreamkv
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+
+	"github.com/mathieupost/jetflow"
+)
+
+var _ jetflow.Storage = (*Storage)(nil)
+
+type Storage struct {
+	typeHandlerMapping jetflow.HandlerFactoryMapping
+	kv                 jetstream.KeyValue
+	preparedKV         jetstream.KeyValue
+	commitHooks        []jetflow.CommitHook
+
+	mu       sync.Mutex
+	versions map[string]*version
+}
+
+// version is the state of an operator for a single transaction.
+type version struct {
+	base    uint64
+	handler jetflow.StatefulHandler
+}
+
+// prepared is the state that a transaction prepared for an operator.
+type prepared struct {
+	TransactionID string           `json:"o"`
+	Base          uint64           `json:"b"`
+	State         []byte           `json:"s"`
+	Coordinator   *jetflow.Address `json:"c,omitempty"`
+	Time          int64            `json:"t"`
+}
+
+type Option func(*Storage)
+
+// WithCommitHook adds a hook that is called with every committed change. The
+// revision of the key is used as the version of the change.
+func WithCommitHook(hook jetflow.CommitHook) Option {
+	return func(s *Storage) {
+		s.commitHooks = append(s.commitHooks, hook)
+	}
+}
+
+// NewStorage binds to the Key-Value bucket with the given name, and the
+// bucket with the name and a "_PREPARED" suffix for the prepared states, and
+// creates them if they do not exist yet.
+func NewStorage(ctx context.Context, mapping jetflow.HandlerFactoryMapping, js jetstream.JetStream, bucket string, opts ...Option) (*Storage, error) {
+	kv, err := bindKeyValue(ctx, js, bucket)
+	if err != nil {
+		return nil, errors.Wrap(err, "binding key-value bucket")
+	}
+	preparedKV, err := bindKeyValue(ctx, js, bucket+"_PREPARED")
+	if err != nil {
+		return nil, errors.Wrap(err, "binding prepared key-value bucket")
+	}
+
+	s := &Storage{
+		typeHandlerMapping: mapping,
+		kv:                 kv,
+		preparedKV:         preparedKV,
+		versions:           map[string]*version{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+func (s *Storage) Get(ctx context.Context, call *jetflow.Request) (jetflow.OperatorHandler, error) {
+	ctx, span := otel.Tracer("").Start(ctx, "jetstreamkv.Storage.Get")
+	defer span.End()
+
+	operatorKey := key(call.TypeName, call.InstanceID)
+	versionKey := operatorKey + "." + call.TransactionID
+
+	revision, state, err := s.load(ctx, operatorKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading committed state")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Load the operator version for the current request.
+	v, ok := s.versions[versionKey]
+	if ok {
+		// Check if the version is not yet outdated because of a
+		// new committed revision.
+		if v.base != revision {
+			return nil, errors.Wrap(jetflow.ErrConflict, "outdated version")
+		}
+		return v.handler, nil
+	}
+
+	// Create the operator version for the current request from the
+	// committed state.
+	handler, err := s.newHandler(call.TypeName, call.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	if state != nil {
+		err = handler.UnmarshalState(state)
+		if err != nil {
+			return nil, errors.Wrap(err, "unmarshalling committed state")
+		}
+	}
+	s.versions[versionKey] = &version{
+		base:    revision,
+		handler: handler,
+	}
+
+	return handler, nil
+}
+
+func (s *Storage) Prepare(ctx context.Context, call *jetflow.Request) error {
+	ctx, span := otel.Tracer("").Start(ctx, "jetstreamkv.Storage.Prepare")
+	defer span.End()
+
+	operatorKey := key(call.TypeName, call.InstanceID)
+	versionKey := operatorKey + "." + call.TransactionID
+
+	revision, baseState, err := s.load(ctx, operatorKey)
+	if err != nil {
+		return errors.Wrap(err, "loading committed state")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.versions[versionKey]
+	if !ok {
+		return errors.Wrapf(jetflow.ErrConflict, "request operator does not exist for %s", versionKey)
+	}
+
+	// Check if the version for the given transaction is created
+	// from the committed revision.
+	if v.base != revision {
+		// A new revision is already committed.
+		return errors.Wrap(jetflow.ErrConflict, "base outdated")
+	}
+
+	state, err := v.handler.MarshalState()
+	if err != nil {
+		return errors.Wrap(err, "marshalling state")
+	}
+	if baseState == nil {
+		baseState, err = s.initialState(call.TypeName, call.InstanceID)
+		if err != nil {
+			return errors.Wrap(err, "creating base state")
+		}
+	} else {
+		baseState, err = s.upgradeState(call.TypeName, call.InstanceID, baseState)
+		if err != nil {
+			return errors.Wrap(err, "upgrading base state")
+		}
+	}
+	if bytes.Equal(state, baseState) {
+		// Operator was not written
+		return nil
+	}
+
+	// Hold the operator for the transaction. The entry is only created
+	// if no other transaction holds the operator.
+	data, err := json.Marshal(prepared{
+		TransactionID: call.TransactionID,
+		Base:          revision,
+		State:         state,
+		Coordinator:   call.Coordinator,
+		Time:          time.Now().UnixNano(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "marshalling prepared state")
+	}
+	preparedRevision, err := s.preparedKV.Create(ctx, operatorKey, data)
+	if errors.Is(err, jetstream.ErrKeyExists) {
+		// Already prepared by another request.
+		return errors.Wrap(jetflow.ErrConflict, "already prepared")
+	}
+	if err != nil {
+		return errors.Wrap(err, "storing prepared state")
+	}
+
+	// Another transaction could have committed between loading the
+	// revision and holding the operator.
+	revision, _, err = s.load(ctx, operatorKey)
+	if err == nil && revision != v.base {
+		err = errors.Wrap(jetflow.ErrConflict, "base outdated")
+	}
+	if err != nil {
+		s.preparedKV.Delete(ctx, operatorKey, jetstream.LastRevision(preparedRevision))
+		return err
+	}
+
+	return nil
+}
+
+func (s *Storage) Commit(ctx context.Context, call *jetflow.Request) error {
+	ctx, span := otel.Tracer("").Start(ctx, "jetstreamkv.Storage.Commit")
+	defer span.End()
+
+	operatorKey := key(call.TypeName, call.InstanceID)
+	versionKey := operatorKey + "." + call.TransactionID
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Delete the transaction version.
+	delete(s.versions, versionKey)
+
+	p, preparedRevision, err := s.loadPrepared(ctx, operatorKey)
+	if err != nil {
+		return errors.Wrap(err, "loading prepared state")
+	}
+	if p == nil || p.TransactionID != call.TransactionID {
+		// The transaction did not write the operator, or the commit was
+		// applied before and is sent again because its acknowledgement
+		// was lost. Either way there is nothing left to apply.
+		return nil
+	}
+
+	revision, previousState, err := s.load(ctx, operatorKey)
+	if err != nil {
+		return errors.Wrap(err, "loading previous state")
+	}
+
+	// The operator is only written by the transaction that holds it, so
+	// the revision only changed if the state was written by an earlier
+	// attempt of this commit.
+	if revision == p.Base {
+		if p.Base == 0 {
+			revision, err = s.kv.Create(ctx, operatorKey, p.State)
+		} else {
+			revision, err = s.kv.Update(ctx, operatorKey, p.State, p.Base)
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to commit")
+		}
+
+		for _, hook := range s.commitHooks {
+			hook(ctx, jetflow.Change{
+				TypeName:      call.TypeName,
+				InstanceID:    call.InstanceID,
+				Version:       revision,
+				TransactionID: call.TransactionID,
+				State:         p.State,
+				PreviousState: previousState,
+			})
+		}
+	}
+
+	// Release the operator once the state is written.
+	err = s.preparedKV.Delete(ctx, operatorKey, jetstream.LastRevision(preparedRevision))
+	return errors.Wrap(err, "deleting prepared state")
+}
+
+func (s *Storage) Rollback(ctx context.Context, call *jetflow.Request) error {
+	ctx, span := otel.Tracer("").Start(ctx, "jetstreamkv.Storage.Rollback")
+	defer span.End()
+
+	operatorKey := key(call.TypeName, call.InstanceID)
+	versionKey := operatorKey + "." + call.TransactionID
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Cleanup version.
+	delete(s.versions, versionKey)
+
+	// Unprepare if needed.
+	p, preparedRevision, err := s.loadPrepared(ctx, operatorKey)
+	if err != nil {
+		return errors.Wrap(err, "loading prepared state")
+	}
+	if p == nil || p.TransactionID != call.TransactionID {
+		return nil
+	}
+	err = s.preparedKV.Delete(ctx, operatorKey, jetstream.LastRevision(preparedRevision))
+	return errors.Wrap(err, "deleting prepared state")
+}
+
+// load returns the latest revision and state of the key. The revision is 0
+// and the state nil if the key does not exist.
+func (s *Storage) load(ctx context.Context, key string) (uint64, []byte, error) {
+	entry, err := s.kv.Get(ctx, key)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return 0, nil, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	return entry.Revision(), entry.Value(), nil
+}
+
+// loadPrepared returns the prepared state of the operator and the revision
+// of its entry. The prepared state is nil if the operator is not prepared.
+func (s *Storage) loadPrepared(ctx context.Context, key string) (*prepared, uint64, error) {
+	entry, err := s.preparedKV.Get(ctx, key)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	var p prepared
+	err = json.Unmarshal(entry.Value(), &p)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "unmarshalling prepared state")
+	}
+	return &p, entry.Revision(), nil
+}
+
+// newHandler creates a new instance of the operator using its factory.
+func (s *Storage) newHandler(typeName, id string) (jetflow.StatefulHandler, error) {
+	factory, ok := s.typeHandlerMapping[typeName]
+	if !ok {
+		return nil, errors.Errorf("unknown operator type %s", typeName)
+	}
+	handler, ok := factory(id).(jetflow.StatefulHandler)
+	if !ok {
+		return nil, errors.Errorf("operator type %s is not a StatefulHandler", typeName)
+	}
+	return handler, nil
+}
+
+// initialState returns the state of a new instance of the operator.
+func (s *Storage) initialState(typeName, id string) ([]byte, error) {
+	handler, err := s.newHandler(typeName, id)
+	if err != nil {
+		return nil, err
+	}
+	return handler.MarshalState()
+}
+
+// upgradeState migrates a committed state to the state version of the
+// operator.
+func (s *Storage) upgradeState(typeName, id string, state []byte) ([]byte, error) {
+	handler, err := s.newHandler(typeName, id)
+	if err != nil {
+		return nil, err
+	}
+	return jetflow.UpgradeState(handler, state)
+}
+
+// bindKeyValue binds to the Key-Value bucket with the given name and creates
+// it if it does not exist yet.
+func bindKeyValue(ctx context.Context, js jetstream.JetStream, bucket string) (jetstream.KeyValue, error) {
+	kv, err := js.KeyValue(ctx, bucket)
+	if errors.Is(err, jetstream.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(ctx, jetstream.KeyValueConfig{
+			Bucket: bucket,
+		})
+	}
+	return kv, err
+}
+
+// key returns the bucket key of an operator. The instance id is encoded, so
+// it only contains characters that are valid in a key.
+func key(typeName, id string) string {
+	return typeName + "." + base64.RawURLEncoding.EncodeToString([]byte(id))
+}
@@ -0,0 +1,136 @@
+package jetstreamkv
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mathieupost/jetflow"
+	"github.com/mathieupost/jetflow/storage/storagetest"
+)
+
+func TestPrepare(t *testing.T) {
+	js := initJetStream(t)
+	storagetest.TestPrepare(t, func(t *testing.T, mapping jetflow.HandlerFactoryMapping) jetflow.Storage {
+		s, err := NewStorage(context.Background(), mapping, js, "OPERATORS")
+		require.NoError(t, err)
+		return s
+	})
+}
+
+func TestExport(t *testing.T) {
+	js := initJetStream(t)
+	buckets := 0
+	storagetest.TestExport(t, func(t *testing.T, mapping jetflow.HandlerFactoryMapping) jetflow.Storage {
+		buckets++
+		s, err := NewStorage(context.Background(), mapping, js, fmt.Sprintf("OPERATORS_%d", buckets))
+		require.NoError(t, err)
+		return s
+	})
+}
+
+func TestCommitHook(t *testing.T) {
+	js := initJetStream(t)
+	storagetest.TestCommitHook(t, func(t *testing.T, mapping jetflow.HandlerFactoryMapping, hook jetflow.CommitHook) jetflow.Storage {
+		s, err := NewStorage(context.Background(), mapping, js, "OPERATORS", WithCommitHook(hook))
+		require.NoError(t, err)
+		return s
+	})
+}
+
+func TestRecovery(t *testing.T) {
+	js := initJetStream(t)
+	storagetest.TestRecovery(t, func(t *testing.T, mapping jetflow.HandlerFactoryMapping) jetflow.Storage {
+		s, err := NewStorage(context.Background(), mapping, js, "OPERATORS")
+		require.NoError(t, err)
+		return s
+	})
+}
+
+func TestRestart(t *testing.T) {
+	ctx := context.Background()
+	js := initJetStream(t)
+
+	s, err := NewStorage(ctx, storagetest.Mapping(), js, "OPERATORS")
+	require.NoError(t, err)
+
+	call := storagetest.Request("1", "op with spaces")
+	operator, err := s.Get(ctx, call)
+	require.NoError(t, err)
+	operator.Handle(ctx, nil, call)
+	require.NoError(t, s.Prepare(ctx, call))
+	require.NoError(t, s.Commit(ctx, call))
+
+	// Another consumer sees the committed state.
+	s, err = NewStorage(ctx, storagetest.Mapping(), js, "OPERATORS")
+	require.NoError(t, err)
+
+	call = storagetest.Request("2", "op with spaces")
+	operator, err = s.Get(ctx, call)
+	require.NoError(t, err)
+	require.Equal(t, 2, storagetest.Field(t, operator))
+}
+
+func TestCommitConflict(t *testing.T) {
+	ctx := context.Background()
+	js := initJetStream(t)
+
+	s1, err := NewStorage(ctx, storagetest.Mapping(), js, "OPERATORS")
+	require.NoError(t, err)
+	s2, err := NewStorage(ctx, storagetest.Mapping(), js, "OPERATORS")
+	require.NoError(t, err)
+
+	// Both consumers write a version of the same operator.
+	call1 := storagetest.Request("1", "op")
+	operator, err := s1.Get(ctx, call1)
+	require.NoError(t, err)
+	operator.Handle(ctx, nil, call1)
+
+	call2 := storagetest.Request("2", "op")
+	operator, err = s2.Get(ctx, call2)
+	require.NoError(t, err)
+	operator.Handle(ctx, nil, call2)
+
+	// Only the first prepare succeeds, so the commit can not conflict.
+	require.NoError(t, s1.Prepare(ctx, call1))
+	require.ErrorIs(t, s2.Prepare(ctx, call2), jetflow.ErrConflict)
+	require.NoError(t, s1.Commit(ctx, call1))
+	require.NoError(t, s2.Rollback(ctx, call2))
+
+	// A new transaction reads the committed state and prepares.
+	call3 := storagetest.Request("3", "op")
+	operator, err = s2.Get(ctx, call3)
+	require.NoError(t, err)
+	require.Equal(t, 2, storagetest.Field(t, operator))
+	operator.Handle(ctx, nil, call3)
+	require.NoError(t, s2.Prepare(ctx, call3))
+	require.NoError(t, s2.Commit(ctx, call3))
+}
+
+func initJetStream(t *testing.T) jetstream.JetStream {
+	// Setup a NATS server with JetStream enabled.
+	opts := server.Options{
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		Port:      server.RANDOM_PORT,
+	}
+	s, err := server.NewServer(&opts)
+	require.NoError(t, err)
+	err = server.Run(s)
+	require.NoError(t, err)
+	t.Cleanup(s.Shutdown)
+
+	nc, err := nats.Connect(fmt.Sprintf("0.0.0.0:%d", opts.Port))
+	require.NoError(t, err)
+	t.Cleanup(nc.Close)
+
+	js, err := jetstream.New(nc)
+	require.NoError(t, err)
+
+	return js
+}
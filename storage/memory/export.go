@@ -0,0 +1,64 @@
+package memory
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mathieupost/jetflow"
+	"github.com/mathieupost/jetflow/storage/internal/typenames"
+)
+
+var _ jetflow.ExportableStorage = (*Storage)(nil)
+
+// Export implements jetflow.ExportableStorage.
+//
+// Passivated operators are not exported.
+func (s *Storage) Export(ctx context.Context, typeNames []string, fn func(jetflow.StateRecord) error) error {
+	var err error
+	s.keyVersionMapping.Range(func(key, value any) bool {
+		v := value.(version)
+		if v.base != "" {
+			// A transaction version.
+			return true
+		}
+		typeName, id, _ := strings.Cut(key.(string), ".")
+		if !typenames.Contains(typeNames, typeName) {
+			return true
+		}
+		state, ok := s.versionStateMapping.Load(v.key)
+		if !ok || state.([]byte) == nil {
+			// Not loaded or deleted.
+			return true
+		}
+		err = fn(jetflow.StateRecord{
+			TypeName:   typeName,
+			InstanceID: id,
+			State:      state.([]byte),
+		})
+		return err == nil
+	})
+	return err
+}
+
+// Import implements jetflow.ExportableStorage.
+func (s *Storage) Import(ctx context.Context, record jetflow.StateRecord) error {
+	state, err := s.upgradeState(record.TypeName, record.InstanceID, record.State)
+	if err != nil {
+		return err
+	}
+
+	// Store the state before the version, so the operator is never
+	// visible without it.
+	operatorKey := record.TypeName + "." + record.InstanceID
+	v := version{key: operatorKey + ".import", number: 1}
+	if _, loaded := s.versionStateMapping.LoadOrStore(v.key, state); loaded {
+		return errors.New("operator already exists")
+	}
+	if _, loaded := s.keyVersionMapping.LoadOrStore(operatorKey, v); loaded {
+		s.versionStateMapping.Delete(v.key)
+		return errors.New("operator already exists")
+	}
+	return nil
+}
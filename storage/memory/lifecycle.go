@@ -0,0 +1,107 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+
+	"github.com/mathieupost/jetflow"
+)
+
+var _ jetflow.LifecycleStorage = (*Storage)(nil)
+
+// Create implements jetflow.LifecycleStorage.
+func (s *Storage) Create(ctx context.Context, call *jetflow.Request) error {
+	ctx, span := otel.Tracer("").Start(ctx, "memory.Storage.Create")
+	defer span.End()
+
+	operator, err := s.transactionOperator(ctx, call)
+	if err != nil {
+		return err
+	}
+	if operator != nil {
+		return errors.Wrapf(jetflow.ErrAlreadyExists, "%s %s", call.TypeName, call.InstanceID)
+	}
+
+	handler, err := s.newHandler(call.TypeName, call.InstanceID)
+	if err != nil {
+		return err
+	}
+	return s.storeTransactionOperator(ctx, call, handler)
+}
+
+// Exists implements jetflow.LifecycleStorage.
+func (s *Storage) Exists(ctx context.Context, call *jetflow.Request) (bool, error) {
+	ctx, span := otel.Tracer("").Start(ctx, "memory.Storage.Exists")
+	defer span.End()
+
+	operatorKey := call.TypeName + "." + call.InstanceID
+	versionKey := operatorKey + "." + call.TransactionID
+
+	operator, ok := s.versionOperatorMapping.Load(versionKey)
+	if ok {
+		return operator != nil, nil
+	}
+
+	committedVersion := s.keyVersionMappingLoadOrStore(operatorKey)
+	state, err := s.committedState(ctx, call, committedVersion)
+	return state != nil, err
+}
+
+// Delete implements jetflow.LifecycleStorage.
+//
+// Operators that are not strict are replaced by a new instance.
+func (s *Storage) Delete(ctx context.Context, call *jetflow.Request) error {
+	ctx, span := otel.Tracer("").Start(ctx, "memory.Storage.Delete")
+	defer span.End()
+
+	operator, err := s.transactionOperator(ctx, call)
+	if err != nil {
+		return err
+	}
+	if operator == nil {
+		return errors.Wrapf(jetflow.ErrNotFound, "%s %s", call.TypeName, call.InstanceID)
+	}
+
+	strict, err := s.strict(call.TypeName)
+	if err != nil {
+		return err
+	}
+	var handler jetflow.StatefulHandler
+	if !strict {
+		handler, err = s.newHandler(call.TypeName, call.InstanceID)
+		if err != nil {
+			return err
+		}
+	}
+	return s.storeTransactionOperator(ctx, call, handler)
+}
+
+// storeTransactionOperator replaces the operator of the version of the
+// transaction. A nil operator does not exist in the version.
+func (s *Storage) storeTransactionOperator(ctx context.Context, call *jetflow.Request, operator jetflow.StatefulHandler) error {
+	operatorKey := call.TypeName + "." + call.InstanceID
+	versionKey := operatorKey + "." + call.TransactionID
+
+	_, ok := s.keyVersionMapping.Load(versionKey)
+	if !ok {
+		// The operator does not exist in the committed version, so the
+		// transaction has no version yet.
+		committedVersion := s.keyVersionMappingLoadOrStore(operatorKey)
+		_, err := s.committedState(ctx, call, committedVersion)
+		if err != nil {
+			return err
+		}
+		s.keyVersionMapping.Store(versionKey, version{
+			base:     committedVersion.key,
+			key:      versionKey,
+			operator: operatorKey,
+			created:  time.Now(),
+		})
+	}
+
+	s.versionOperatorMapping.Store(versionKey, operator)
+	return nil
+}
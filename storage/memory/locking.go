@@ -0,0 +1,108 @@
+package memory
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mathieupost/jetflow"
+)
+
+// WithLocking makes transactions lock the operators of the given types when
+// they start using them, instead of validating their versions when they are
+// prepared. This avoids aborting transactions at prepare time for operators
+// that are used by many transactions at once.
+//
+// Locks are released when the transaction commits or rolls back. Deadlocks
+// are prevented with wait-die: a transaction waits for a lock that is held
+// by a younger transaction, and is aborted if the lock is held by an older
+// one. Retries keep the time of their transaction, so they eventually get
+// the lock.
+func WithLocking(typeNames ...string) Option {
+	return func(s *Storage) {
+		if s.lockedTypes == nil {
+			s.lockedTypes = map[string]bool{}
+			s.locks = map[string]*lock{}
+		}
+		for _, typeName := range typeNames {
+			s.lockedTypes[typeName] = true
+		}
+	}
+}
+
+// lock is held by a transaction on an operator.
+type lock struct {
+	transactionID   string
+	transactionTime int64
+	// released is closed once the lock is released.
+	released chan struct{}
+}
+
+// older reports whether the transaction of the call is older than the
+// transaction holding the lock. Transactions that started at the same time
+// are ordered by their id.
+func older(call *jetflow.Request, l *lock) bool {
+	if call.TransactionTime != l.transactionTime {
+		return call.TransactionTime < l.transactionTime
+	}
+	return call.TransactionID < l.transactionID
+}
+
+// acquireLock locks the operator of the call for its transaction if the type
+// of the operator uses locking. It waits while the lock is held by a younger
+// transaction.
+func (s *Storage) acquireLock(ctx context.Context, call *jetflow.Request) error {
+	if !s.lockedTypes[call.TypeName] {
+		return nil
+	}
+	operatorKey := call.TypeName + "." + call.InstanceID
+
+	for {
+		s.lockMu.Lock()
+		l, ok := s.locks[operatorKey]
+		if !ok {
+			s.locks[operatorKey] = &lock{
+				transactionID:   call.TransactionID,
+				transactionTime: call.TransactionTime,
+				released:        make(chan struct{}),
+			}
+			s.lockMu.Unlock()
+			return nil
+		}
+		s.lockMu.Unlock()
+
+		if l.transactionID == call.TransactionID {
+			return nil
+		}
+		if !older(call, l) {
+			// Die, so an older transaction never waits for a younger one.
+			return errors.Wrap(jetflow.ErrConflict, "locked by an older transaction")
+		}
+
+		select {
+		case <-l.released:
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "waiting for lock")
+		}
+	}
+}
+
+// releaseLock releases the lock of the transaction on the operator, if any.
+func (s *Storage) releaseLock(operatorKey, transactionID string) {
+	if s.locks == nil {
+		return
+	}
+	s.lockMu.Lock()
+	defer s.lockMu.Unlock()
+	l, ok := s.locks[operatorKey]
+	if ok && l.transactionID == transactionID {
+		delete(s.locks, operatorKey)
+		close(l.released)
+	}
+}
+
+// releaseVersionLock releases the lock of the transaction of the version key.
+func (s *Storage) releaseVersionLock(operatorKey, versionKey string) {
+	s.releaseLock(operatorKey, strings.TrimPrefix(versionKey, operatorKey+"."))
+}
@@ -0,0 +1,91 @@
+package memory
+
+import (
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Stats contains the counters of a Storage.
+type Stats struct {
+	// ReclaimedVersions is the number of abandoned transaction versions
+	// that were removed by Sweep.
+	ReclaimedVersions int64
+	// ExpiredLeases is the number of prepared versions that were released
+	// by Sweep because their lease expired.
+	ExpiredLeases int64
+	// Waiting is the number of transactions that currently wait for a
+	// prepared version.
+	Waiting int64
+	// Waits is the number of times a transaction waited for a prepared
+	// version.
+	Waits int64
+	// WaitTime is the total time transactions waited for prepared versions.
+	WaitTime time.Duration
+	// Activations is the number of times an operator was loaded into
+	// memory.
+	Activations int64
+	// Passivations is the number of times an idle operator was removed from
+	// memory.
+	Passivations int64
+}
+
+// Stats returns the current counters of the storage.
+func (s *Storage) Stats() Stats {
+	return Stats{
+		ReclaimedVersions: s.metrics.reclaimedVersions.Load(),
+		ExpiredLeases:     s.metrics.expiredLeases.Load(),
+		Waiting:           s.metrics.waiting.Load(),
+		Waits:             s.metrics.waits.Load(),
+		WaitTime:          time.Duration(s.metrics.waitTime.Load()),
+		Activations:       s.metrics.activations.Load(),
+		Passivations:      s.metrics.passivations.Load(),
+	}
+}
+
+type metrics struct {
+	reclaimedVersions atomic.Int64
+	expiredLeases     atomic.Int64
+	waiting           atomic.Int64
+	waits             atomic.Int64
+	waitTime          atomic.Int64
+	activations       atomic.Int64
+	passivations      atomic.Int64
+
+	reclaimedVersionsCounter metric.Int64Counter
+	expiredLeasesCounter     metric.Int64Counter
+	waitingCounter           metric.Int64UpDownCounter
+	waitTimeHistogram        metric.Float64Histogram
+	activationsCounter       metric.Int64Counter
+	passivationsCounter      metric.Int64Counter
+}
+
+func newMetrics() *metrics {
+	meter := otel.Meter("github.com/mathieupost/jetflow/storage/memory")
+
+	// The global meter provider never returns errors, so they are ignored.
+	reclaimedVersions, _ := meter.Int64Counter("jetflow.memory.reclaimed_versions",
+		metric.WithDescription("Abandoned transaction versions that were removed."))
+	expiredLeases, _ := meter.Int64Counter("jetflow.memory.expired_leases",
+		metric.WithDescription("Prepared versions that were released after their lease expired."))
+	waiting, _ := meter.Int64UpDownCounter("jetflow.memory.waiting",
+		metric.WithDescription("Transactions that wait for a prepared version."))
+	waitTime, _ := meter.Float64Histogram("jetflow.memory.wait_time",
+		metric.WithDescription("Time a transaction waited for a prepared version."),
+		metric.WithUnit("s"))
+	activations, _ := meter.Int64Counter("jetflow.memory.activations",
+		metric.WithDescription("Operators that were loaded into memory."))
+	passivations, _ := meter.Int64Counter("jetflow.memory.passivations",
+		metric.WithDescription("Idle operators that were removed from memory."))
+
+	return &metrics{
+		reclaimedVersionsCounter: reclaimedVersions,
+		expiredLeasesCounter:     expiredLeases,
+		waitingCounter:           waiting,
+		waitTimeHistogram:        waitTime,
+		activationsCounter:       activations,
+		passivationsCounter:      passivations,
+	}
+}
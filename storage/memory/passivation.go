@@ -0,0 +1,230 @@
+package memory
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mathieupost/jetflow"
+	"github.com/mathieupost/jetflow/log"
+)
+
+// PassivationStore persists the committed states of passivated operators.
+// The storage also saves the version numbers of passivated operators in it,
+// under keys that start with '#'.
+type PassivationStore interface {
+	// Load returns the state of the operator, or false if it was never
+	// passivated.
+	Load(ctx context.Context, operatorKey string) ([]byte, bool, error)
+	// Save stores the state of the operator. A nil state means that the
+	// operator does not exist.
+	Save(ctx context.Context, operatorKey string, state []byte) error
+}
+
+// DirStore is a PassivationStore that stores every operator in its own file.
+type DirStore struct {
+	dir string
+}
+
+var _ PassivationStore = (*DirStore)(nil)
+
+// NewDirStore creates a DirStore in dir. The directory is created if it does
+// not exist.
+func NewDirStore(dir string) (*DirStore, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating directory")
+	}
+	return &DirStore{dir: dir}, nil
+}
+
+// Load implements PassivationStore.
+func (d *DirStore) Load(ctx context.Context, operatorKey string) ([]byte, bool, error) {
+	state, err := os.ReadFile(d.path(operatorKey))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, errors.Wrap(err, "reading state")
+	}
+	return state, true, nil
+}
+
+// Save implements PassivationStore.
+func (d *DirStore) Save(ctx context.Context, operatorKey string, state []byte) error {
+	path := d.path(operatorKey)
+	if state == nil {
+		err := os.Remove(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return errors.Wrap(err, "removing state")
+	}
+	err := os.WriteFile(path+".tmp", state, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "writing state")
+	}
+	return errors.Wrap(os.Rename(path+".tmp", path), "renaming state")
+}
+
+func (d *DirStore) path(operatorKey string) string {
+	return filepath.Join(d.dir, base64.RawURLEncoding.EncodeToString([]byte(operatorKey)))
+}
+
+// touch records that the operator was used.
+func (s *Storage) touch(operatorKey string) {
+	if s.passivationStore == nil {
+		return
+	}
+	accessed, _ := s.accessMapping.LoadOrStore(operatorKey, new(atomic.Int64))
+	accessed.(*atomic.Int64).Store(time.Now().UnixNano())
+}
+
+// numberKey returns the key under which the version number of a passivated
+// operator is saved. Type names can not contain '#', so it does not collide
+// with operator keys.
+func numberKey(operatorKey string) string {
+	return "#" + operatorKey
+}
+
+// passivatedNumber returns the number of the committed version of the
+// operator when it was passivated, or 0 if it was never passivated.
+func (s *Storage) passivatedNumber(ctx context.Context, operatorKey string) (uint64, error) {
+	if s.passivationStore == nil {
+		return 0, nil
+	}
+	data, ok, err := s.passivationStore.Load(ctx, numberKey(operatorKey))
+	if err != nil {
+		return 0, errors.Wrap(err, "loading passivated version number")
+	}
+	if !ok || len(data) != 8 {
+		return 0, nil
+	}
+	return binary.BigEndian.Uint64(data), nil
+}
+
+// activeState returns the state of an operator that is not in memory. It is
+// loaded from the passivation store, or created if the operator was never
+// passivated and is not strict. The state is nil if the operator does not
+// exist.
+func (s *Storage) activeState(ctx context.Context, typeName, id string) ([]byte, error) {
+	if s.passivationStore != nil {
+		state, ok, err := s.passivationStore.Load(ctx, typeName+"."+id)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading passivated state")
+		}
+		if ok {
+			return s.upgradeState(typeName, id, state)
+		}
+	}
+	strict, err := s.strict(typeName)
+	if err != nil || strict {
+		// Strict operators do not exist until they are created.
+		return nil, err
+	}
+	return s.initialState(typeName, id)
+}
+
+// activate notifies the operator that it was loaded into memory.
+func (s *Storage) activate(ctx context.Context, handler jetflow.StatefulHandler) error {
+	s.metrics.activations.Add(1)
+	s.metrics.activationsCounter.Add(ctx, 1)
+	activationHandler, ok := handler.(jetflow.ActivationHandler)
+	if !ok {
+		return nil
+	}
+	return errors.Wrap(activationHandler.OnActivate(ctx), "activating operator")
+}
+
+// passivate saves the committed state of operators that were not used for
+// the idle time to the passivation store and removes them from memory.
+// Operators that are prepared or used by a transaction stay in memory.
+func (s *Storage) passivate(ctx context.Context, now time.Time) {
+	if s.passivationStore == nil {
+		return
+	}
+
+	// Collect the operators that are used by transactions.
+	busy := map[string]bool{}
+	s.keyVersionMapping.Range(func(key, value any) bool {
+		v := value.(version)
+		if v.base != "" {
+			busy[v.operator] = true
+		}
+		return true
+	})
+
+	s.keyVersionMapping.Range(func(key, value any) bool {
+		operatorKey := key.(string)
+		v := value.(version)
+		if v.base != "" || v.prepared != "" || busy[operatorKey] {
+			return true
+		}
+		accessed, ok := s.accessMapping.Load(operatorKey)
+		if ok && now.Sub(time.Unix(0, accessed.(*atomic.Int64).Load())) <= s.idleTime {
+			return true
+		}
+		state, ok := s.versionStateMapping.Load(v.key)
+		if !ok {
+			return true
+		}
+
+		// Operators that do not exist are removed without notifying them.
+		var handler jetflow.StatefulHandler
+		var err error
+		if state.([]byte) != nil {
+			typeName, id, _ := strings.Cut(operatorKey, ".")
+			handler, err = s.newHandler(typeName, id)
+			if err == nil {
+				err = handler.UnmarshalState(state.([]byte))
+			}
+			if err != nil {
+				log.Println("passivating", operatorKey, err)
+				return true
+			}
+		}
+
+		// Save the version number, so the numbers keep increasing when the
+		// operator is activated again. It is 0 if the operator was not
+		// committed since it was activated, and the saved number is kept.
+		if v.number > 0 {
+			err = s.passivationStore.Save(ctx, numberKey(operatorKey), binary.BigEndian.AppendUint64(nil, v.number))
+			if err != nil {
+				log.Println("passivating", operatorKey, err)
+				return true
+			}
+		}
+
+		// Save the state before removing it, so a concurrent Get either
+		// finds the operator in memory or in the passivation store.
+		err = s.passivationStore.Save(ctx, operatorKey, state.([]byte))
+		if err != nil {
+			log.Println("passivating", operatorKey, err)
+			return true
+		}
+		if !s.keyVersionMapping.CompareAndDelete(operatorKey, v) {
+			// Used in the meantime.
+			return true
+		}
+		s.accessMapping.Delete(operatorKey)
+		s.versionStateMapping.Delete(v.key)
+		s.snapshotOperatorMapping.Delete(v.key)
+		s.metrics.passivations.Add(1)
+		s.metrics.passivationsCounter.Add(ctx, 1)
+
+		if activationHandler, ok := handler.(jetflow.ActivationHandler); ok {
+			err = activationHandler.OnDeactivate(ctx)
+			if err != nil {
+				log.Println("deactivating", operatorKey, err)
+			}
+		}
+		return true
+	})
+}
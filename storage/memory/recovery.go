@@ -0,0 +1,35 @@
+package memory
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/mathieupost/jetflow"
+)
+
+// Prepared implements jetflow.RecoverableStorage.
+func (s *Storage) Prepared(ctx context.Context, before time.Time) ([]*jetflow.Request, error) {
+	var prepared []*jetflow.Request
+	s.keyVersionMapping.Range(func(key, value any) bool {
+		v := value.(version)
+		if v.base != "" || v.prepared == "" || !v.preparedAt.Before(before) {
+			return true
+		}
+		operatorKey := key.(string)
+		typeName, id, _ := strings.Cut(operatorKey, ".")
+		request := &jetflow.Request{
+			TransactionID: strings.TrimPrefix(v.prepared, operatorKey+"."),
+			TypeName:      typeName,
+			InstanceID:    id,
+			Method:        string(jetflow.MethodPrepare),
+		}
+		if v.coordinator != (jetflow.Address{}) {
+			coordinator := v.coordinator
+			request.Coordinator = &coordinator
+		}
+		prepared = append(prepared, request)
+		return true
+	})
+	return prepared, nil
+}
@@ -0,0 +1,112 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mathieupost/jetflow"
+)
+
+// WithSerializable validates the operators that a transaction read but did
+// not write when it is prepared, so transactions are serializable. Without
+// it, only written operators are validated, which allows write skew: two
+// transactions that each read the operator that the other one writes can
+// both commit.
+//
+// A read operator is prepared if it was not changed or prepared by another
+// transaction since it was read. It is then locked for reading until the
+// transaction commits or rolls back, so other transactions cannot prepare
+// it in the meantime. Read-only calls are served from snapshots, so they are
+// not validated, unless they are made within a transaction.
+func WithSerializable() Option {
+	return func(s *Storage) {
+		s.serializable = true
+		s.readers = map[string]map[string]time.Time{}
+	}
+}
+
+// Serializable implements jetflow.SerializableStorage.
+func (s *Storage) Serializable() bool {
+	return s.serializable
+}
+
+// prepareRead validates the version of an operator that the transaction read
+// but did not write, and locks the operator for reading.
+func (s *Storage) prepareRead(ctx context.Context, operatorKey string, v version) error {
+	committedVersion, err := s.keyVersionMappingLoad(operatorKey)
+	if err != nil {
+		return errors.Wrap(err, "loading committed version")
+	}
+	if committedVersion.prepared != "" && s.prepareWait > 0 {
+		// Wait until the other request commits or rolls back.
+		s.waitUntilReleased(ctx, operatorKey)
+	}
+
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+
+	committedVersion, err = s.keyVersionMappingLoad(operatorKey)
+	if err != nil {
+		return errors.Wrap(err, "loading committed version")
+	}
+	if v.base != committedVersion.key {
+		// Another request committed a new version since it was read.
+		return errors.Wrap(jetflow.ErrConflict, "base outdated")
+	}
+	if committedVersion.prepared != "" {
+		return errors.Wrap(jetflow.ErrConflict, "read already prepared")
+	}
+
+	readers, ok := s.readers[operatorKey]
+	if !ok {
+		readers = map[string]time.Time{}
+		s.readers[operatorKey] = readers
+	}
+	readers[v.key] = time.Now()
+	return nil
+}
+
+// readByOthers reports whether other transactions than the one of the
+// version locked the operator for reading. The caller must hold readMu.
+func (s *Storage) readByOthers(operatorKey, versionKey string) bool {
+	for reader := range s.readers[operatorKey] {
+		if reader != versionKey {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseRead removes the read lock of the transaction version.
+func (s *Storage) releaseRead(operatorKey, versionKey string) {
+	if !s.serializable {
+		return
+	}
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+	delete(s.readers[operatorKey], versionKey)
+	if len(s.readers[operatorKey]) == 0 {
+		delete(s.readers, operatorKey)
+	}
+}
+
+// sweepReads removes the read locks that are older than the prepare lease.
+func (s *Storage) sweepReads(now time.Time) {
+	if !s.serializable || s.prepareLease <= 0 {
+		return
+	}
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+	for operatorKey, readers := range s.readers {
+		for versionKey, readAt := range readers {
+			if now.Sub(readAt) > s.prepareLease {
+				delete(readers, versionKey)
+			}
+		}
+		if len(readers) == 0 {
+			delete(s.readers, operatorKey)
+		}
+	}
+}
@@ -1,64 +1,208 @@
 package memory
 
 import (
+	"bytes"
 	"context"
-	"reflect"
 	"sync"
+	"time"
 
-	"github.com/huandu/go-clone"
 	"github.com/pkg/errors"
 	"go.opentelemetry.io/otel"
 
 	"github.com/mathieupost/jetflow"
 )
 
-var _ jetflow.Storage = (*Storage)(nil)
+var (
+	_ jetflow.SnapshotStorage    = (*Storage)(nil)
+	_ jetflow.RecoverableStorage = (*Storage)(nil)
+)
 
 type Storage struct {
-	typeHandlerMapping     jetflow.HandlerFactoryMapping
-	keyVersionMapping      sync.Map
+	typeHandlerMapping jetflow.HandlerFactoryMapping
+	keyVersionMapping  sync.Map
+	// versionOperatorMapping maps the version of a transaction to its
+	// jetflow.StatefulHandler.
 	versionOperatorMapping sync.Map
+	// versionStateMapping maps committed and prepared versions to their
+	// marshalled state.
+	versionStateMapping sync.Map
+	// snapshotOperatorMapping maps committed versions to a shared
+	// jetflow.StatefulHandler that serves read-only calls.
+	snapshotOperatorMapping sync.Map
+	// releaseMapping maps operators to a channel that is closed once their
+	// prepared version is committed or rolled back.
+	releaseMapping sync.Map
+	// accessMapping maps operators to the time they were last used.
+	accessMapping sync.Map
+
+	versionTTL       time.Duration
+	prepareLease     time.Duration
+	prepareWait      time.Duration
+	passivationStore PassivationStore
+	idleTime         time.Duration
+	commitHooks      []jetflow.CommitHook
+	metrics          *metrics
+
+	// hookMu orders the commits of all operators while their hooks are
+	// called.
+	hookMu sync.Mutex
+
+	serializable bool
+	// readers maps operators to the transaction versions that locked them
+	// for reading, and the time they did so. It is guarded by readMu.
+	readers map[string]map[string]time.Time
+	readMu  sync.Mutex
+
+	// lockedTypes are the operator types that use locking. locks maps
+	// their operators to the lock of a transaction. It is guarded by lockMu.
+	lockedTypes map[string]bool
+	locks       map[string]*lock
+	lockMu      sync.Mutex
 }
 
 type version struct {
 	base     string
 	key      string
 	prepared string
+
+	// number is the number of the committed version. It is incremented by
+	// every commit, and starts at 0 when the operator is loaded into memory.
+	// The first commit continues from the number that was saved when the
+	// operator was passivated.
+	number uint64
+
+	// operator is the key of the operator of a transaction version.
+	operator string
+	// created is the time at which a transaction version was created.
+	created time.Time
+	// preparedAt is the time at which the committed version was prepared.
+	preparedAt time.Time
+	// coordinator is the coordinator of the transaction that prepared the
+	// committed version.
+	coordinator jetflow.Address
+}
+
+type Option func(*Storage)
+
+// WithVersionTTL sets the time after which a transaction version that was
+// not prepared is reclaimed by Sweep. It should be longer than the longest
+// running transaction.
+func WithVersionTTL(ttl time.Duration) Option {
+	return func(s *Storage) {
+		s.versionTTL = ttl
+	}
+}
+
+// WithPrepareLease sets the time after which Sweep releases a prepared
+// version that was neither committed nor rolled back, so the operator can be
+// prepared by other transactions again. It only applies to transactions
+// without a coordinator, such as those of Client.Transaction, because the
+// others are resolved by asking their coordinator. Releasing a version gives
+// up the atomicity of its transaction: a commit that arrives after the lease
+// expired has nothing left to apply, while the other operators of the
+// transaction may have committed.
+func WithPrepareLease(lease time.Duration) Option {
+	return func(s *Storage) {
+		s.prepareLease = lease
+	}
+}
+
+// WithPrepareWait makes transactions wait up to the given time for an
+// operator that is prepared by another transaction, instead of aborting right
+// away. Transactions that start using the operator wait until the prepared
+// version is committed or rolled back, so they read its outcome. Transactions
+// that want to prepare the operator wait until they can prepare it.
+func WithPrepareWait(timeout time.Duration) Option {
+	return func(s *Storage) {
+		s.prepareWait = timeout
+	}
+}
+
+// WithPassivation makes Sweep passivate operators that were not used for the
+// given idle time. Their committed state is saved to the store and removed
+// from memory, and loaded again by the next Get.
+func WithPassivation(store PassivationStore, idleTime time.Duration) Option {
+	return func(s *Storage) {
+		s.passivationStore = store
+		s.idleTime = idleTime
+	}
+}
+
+// WithCommitHook adds a hook that is called with every committed change.
+// Hooks are called one commit at a time, so the changes of all operators are
+// passed in commit order. The versions of an operator start at 1 again when it
+// is activated after passivation.
+func WithCommitHook(hook jetflow.CommitHook) Option {
+	return func(s *Storage) {
+		s.commitHooks = append(s.commitHooks, hook)
+	}
 }
 
-func NewStorage(mapping jetflow.HandlerFactoryMapping) *Storage {
-	return &Storage{
+func NewStorage(mapping jetflow.HandlerFactoryMapping, opts ...Option) *Storage {
+	s := &Storage{
 		typeHandlerMapping: mapping,
+		metrics:            newMetrics(),
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 func (s *Storage) Get(ctx context.Context, call *jetflow.Request) (jetflow.OperatorHandler, error) {
 	ctx, span := otel.Tracer("").Start(ctx, "memory.Storage.Get")
 	defer span.End()
 
+	operator, err := s.transactionOperator(ctx, call)
+	if err != nil {
+		return nil, err
+	}
+	if operator == nil {
+		return nil, errors.Wrapf(jetflow.ErrNotFound, "%s %s", call.TypeName, call.InstanceID)
+	}
+	return operator, nil
+}
+
+// transactionOperator returns the operator of the version of the transaction,
+// creating the version from the committed version if needed. It returns nil
+// if the operator does not exist in the version.
+func (s *Storage) transactionOperator(ctx context.Context, call *jetflow.Request) (jetflow.StatefulHandler, error) {
 	// Get last committed value. Create a new value if not found.
 	operatorKey := call.TypeName + "." + call.InstanceID
 	versionKey := operatorKey + "." + call.TransactionID
+	s.touch(operatorKey)
+
+	err := s.acquireLock(ctx, call)
+	if err != nil {
+		return nil, err
+	}
 
 	// Load the operator version for the current request.
 	committedVersion := s.keyVersionMappingLoadOrStore(operatorKey)
 	operator, ok := s.versionOperatorMapping.Load(versionKey)
 	if !ok {
-		// Clone the committed version if there was no previous version for this request.
-		operator, ok = s.versionOperatorMapping.Load(committedVersion.key)
-		if !ok {
-			// Create an initial instance of the operator if it did not yet exist.
-			operator, _ = s.versionOperatorMapping.LoadOrStore(
-				committedVersion.key,
-				s.typeHandlerMapping[call.TypeName](call.InstanceID),
-			)
+		if committedVersion.prepared != "" && s.prepareWait > 0 {
+			// Start from the outcome of the prepared version.
+			committedVersion = s.waitUntilReleased(ctx, operatorKey)
+		}
+		// Unmarshal the committed state if there was no previous version for this request.
+		handler, err := s.committedHandler(ctx, call, committedVersion)
+		if err != nil {
+			return nil, err
+		}
+		if handler == nil {
+			// Versions are only created for operators that exist, or that
+			// are created by the transaction.
+			return nil, nil
 		}
 		// Store the operator version for the current request.
-		operator = clone.Clone(operator)
+		operator = handler
 		s.versionOperatorMapping.Store(versionKey, operator)
 		s.keyVersionMapping.Store(versionKey, version{
-			base: committedVersion.key,
-			key:  versionKey,
+			base:     committedVersion.key,
+			key:      versionKey,
+			operator: operatorKey,
+			created:  time.Now(),
 		})
 	} else {
 		// Check if the version is not yet outdated because of a
@@ -66,10 +210,54 @@ func (s *Storage) Get(ctx context.Context, call *jetflow.Request) (jetflow.Opera
 		v, _ := s.keyVersionMapping.Load(versionKey)
 		requestVersion := v.(version)
 		if requestVersion.base != committedVersion.key {
-			return nil, errors.New("outdated version")
+			return nil, errors.Wrap(jetflow.ErrConflict, "outdated version")
 		}
 	}
 
+	if operator == nil {
+		// Deleted by the transaction.
+		return nil, nil
+	}
+	return operator.(jetflow.StatefulHandler), nil
+}
+
+// GetSnapshot implements jetflow.SnapshotStorage.
+//
+// The operator of the committed version is unmarshalled once and shared by
+// all read-only calls until a new version is committed.
+func (s *Storage) GetSnapshot(ctx context.Context, call *jetflow.Request) (jetflow.OperatorHandler, error) {
+	ctx, span := otel.Tracer("").Start(ctx, "memory.Storage.GetSnapshot")
+	defer span.End()
+
+	operatorKey := call.TypeName + "." + call.InstanceID
+	versionKey := operatorKey + "." + call.TransactionID
+	s.touch(operatorKey)
+
+	// Read the writes of the transaction if it has its own version.
+	operator, ok := s.versionOperatorMapping.Load(versionKey)
+	if ok && operator == nil {
+		// Deleted by the transaction.
+		return nil, errors.Wrapf(jetflow.ErrNotFound, "%s %s", call.TypeName, call.InstanceID)
+	}
+	if ok {
+		return operator.(jetflow.OperatorHandler), nil
+	}
+
+	committedVersion := s.keyVersionMappingLoadOrStore(operatorKey)
+	operator, ok = s.snapshotOperatorMapping.Load(committedVersion.key)
+	if ok {
+		return operator.(jetflow.OperatorHandler), nil
+	}
+
+	handler, err := s.committedHandler(ctx, call, committedVersion)
+	if err != nil {
+		return nil, err
+	}
+	if handler == nil {
+		return nil, errors.Wrapf(jetflow.ErrNotFound, "%s %s", call.TypeName, call.InstanceID)
+	}
+	operator, _ = s.snapshotOperatorMapping.LoadOrStore(committedVersion.key, handler)
+
 	return operator.(jetflow.OperatorHandler), nil
 }
 
@@ -86,41 +274,77 @@ func (s *Storage) Prepare(ctx context.Context, call *jetflow.Request) error {
 	versionKey := operatorKey + "." + call.TransactionID
 	version, err := s.keyVersionMappingLoad(versionKey)
 	if err != nil {
-		return errors.Wrap(err, "loading request version")
+		// The version expired, so the transaction has to start over.
+		return errors.Wrap(jetflow.ErrConflict, "loading request version")
 	}
 
 	// Check if the version for the given transaction is created
 	// from the committed version.
 	if version.base != committedVersion.key {
 		// A new version is already committed.
-		return errors.New("base outdated")
+		return errors.Wrap(jetflow.ErrConflict, "base outdated")
 	}
 
 	operator, ok := s.versionOperatorMapping.Load(version.key)
 	if !ok {
-		return errors.Errorf("request operator does not exist for %s", versionKey)
+		return errors.Wrapf(jetflow.ErrConflict, "request operator does not exist for %s", versionKey)
 	}
-	baseOperator, ok := s.versionOperatorMapping.Load(version.base)
+	baseState, ok := s.versionStateMapping.Load(version.base)
 	if !ok {
-		return errors.Errorf("base operator (%s) does not exist for %s", version.base, versionKey)
+		return errors.Wrapf(jetflow.ErrConflict, "base state (%s) does not exist for %s", version.base, versionKey)
 	}
-	equal := reflect.DeepEqual(operator, baseOperator)
-	if equal {
+	// The state of an operator that is deleted by the transaction is nil.
+	var state []byte
+	if operator != nil {
+		state, err = operator.(jetflow.StatefulHandler).MarshalState()
+		if err != nil {
+			return errors.Wrap(err, "marshalling state")
+		}
+	}
+	if bytes.Equal(state, baseState.([]byte)) {
 		// Operator was not written
+		if s.serializable {
+			return s.prepareRead(ctx, operatorKey, version)
+		}
 		return nil
 	}
 
+	if committedVersion.prepared != "" && s.prepareWait > 0 {
+		// Wait until the other request commits or rolls back.
+		committedVersion = s.waitUntilReleased(ctx, operatorKey)
+		if version.base != committedVersion.key {
+			// The other request committed a new version.
+			return errors.Wrap(jetflow.ErrConflict, "base outdated")
+		}
+	}
+
 	if committedVersion.prepared != "" {
 		// Already prepared by another request.
-		return errors.New("already prepared")
+		return errors.Wrap(jetflow.ErrConflict, "already prepared")
+	}
+
+	if s.serializable {
+		// Hold the lock until the version is prepared, so no transaction
+		// locks the operator for reading in between.
+		s.readMu.Lock()
+		defer s.readMu.Unlock()
+		if s.readByOthers(operatorKey, versionKey) {
+			return errors.Wrap(jetflow.ErrConflict, "read by another transaction")
+		}
 	}
 
 	// Copy and set prepared to the version for the given request.
 	newCommittedVersion := committedVersion
 	newCommittedVersion.prepared = versionKey
+	newCommittedVersion.preparedAt = time.Now()
+	if call.Coordinator != nil {
+		newCommittedVersion.coordinator = *call.Coordinator
+	}
+	s.versionStateMapping.Store(versionKey, state)
 	updated := s.keyVersionMappingSwap(operatorKey, committedVersion, newCommittedVersion)
 	if !updated {
-		return errors.New("failed to prepare")
+		s.versionStateMapping.Delete(versionKey)
+		return errors.Wrap(jetflow.ErrConflict, "failed to prepare")
 	}
 
 	return nil
@@ -135,6 +359,9 @@ func (s *Storage) Commit(ctx context.Context, call *jetflow.Request) error {
 
 	// Delete the transaction version mapping.
 	defer s.keyVersionMapping.Delete(versionKey)
+	defer s.versionOperatorMapping.Delete(versionKey)
+	defer s.releaseRead(operatorKey, versionKey)
+	defer s.releaseLock(operatorKey, call.TransactionID)
 
 	committedVersion, err := s.keyVersionMappingLoad(operatorKey)
 	if err != nil {
@@ -142,18 +369,60 @@ func (s *Storage) Commit(ctx context.Context, call *jetflow.Request) error {
 	}
 
 	if committedVersion.prepared != versionKey {
-		return errors.New("not prepared by this request")
+		// The transaction did not write the operator, or the commit was
+		// applied before and is sent again because its acknowledgement
+		// was lost. Either way there is nothing left to apply.
+		return nil
+	}
+
+	number := committedVersion.number
+	if number == 0 {
+		number, err = s.passivatedNumber(ctx, operatorKey)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Update the committed version to the prepared version.
-	newVersion := version{key: committedVersion.prepared}
+	newVersion := version{
+		key:    committedVersion.prepared,
+		number: number + 1,
+	}
+	hooked := len(s.commitHooks) > 0
+	if hooked {
+		s.hookMu.Lock()
+	}
 	updated := s.keyVersionMappingSwap(operatorKey, committedVersion, newVersion)
 	if !updated {
-		return errors.New("failed to commit")
+		if hooked {
+			s.hookMu.Unlock()
+		}
+		return errors.Wrap(jetflow.ErrConflict, "failed to commit")
+	}
+
+	if hooked {
+		previous, _ := s.versionStateMapping.Load(committedVersion.key)
+		previousState, _ := previous.([]byte)
+		state, _ := s.versionStateMapping.Load(newVersion.key)
+		change := jetflow.Change{
+			TypeName:      call.TypeName,
+			InstanceID:    call.InstanceID,
+			Version:       newVersion.number,
+			TransactionID: call.TransactionID,
+			State:         state.([]byte),
+			PreviousState: previousState,
+		}
+		for _, hook := range s.commitHooks {
+			hook(ctx, change)
+		}
+		s.hookMu.Unlock()
 	}
 
-	// Delete the previous operator version.
-	s.versionOperatorMapping.Delete(committedVersion.key)
+	s.release(operatorKey)
+
+	// Delete the previous operator state.
+	s.versionStateMapping.Delete(committedVersion.key)
+	s.snapshotOperatorMapping.Delete(committedVersion.key)
 
 	return nil
 }
@@ -168,6 +437,8 @@ func (s *Storage) Rollback(ctx context.Context, call *jetflow.Request) error {
 	// Cleanup version.
 	s.keyVersionMapping.Delete(versionKey)
 	s.versionOperatorMapping.Delete(versionKey)
+	s.releaseRead(operatorKey, versionKey)
+	defer s.releaseLock(operatorKey, call.TransactionID)
 
 	// Unprepare if needed.
 	committedVersion, err := s.keyVersionMappingLoad(operatorKey)
@@ -177,15 +448,117 @@ func (s *Storage) Rollback(ctx context.Context, call *jetflow.Request) error {
 	if committedVersion.prepared == versionKey {
 		newCommittedVersion := committedVersion
 		newCommittedVersion.prepared = ""
+		newCommittedVersion.preparedAt = time.Time{}
+		newCommittedVersion.coordinator = jetflow.Address{}
 		updated := s.keyVersionMappingSwap(operatorKey, committedVersion, newCommittedVersion)
 		if !updated {
-			return errors.New("failed to rollback")
+			return errors.Wrap(jetflow.ErrConflict, "failed to rollback")
 		}
+		s.release(operatorKey)
+		s.versionStateMapping.Delete(versionKey)
 	}
 
 	return nil
 }
 
+// newHandler creates a new instance of the operator using its factory.
+func (s *Storage) newHandler(typeName, id string) (jetflow.StatefulHandler, error) {
+	factory, ok := s.typeHandlerMapping[typeName]
+	if !ok {
+		return nil, errors.Errorf("unknown operator type %s", typeName)
+	}
+	handler, ok := factory(id).(jetflow.StatefulHandler)
+	if !ok {
+		return nil, errors.Errorf("operator type %s is not a StatefulHandler", typeName)
+	}
+	return handler, nil
+}
+
+// committedHandler unmarshals the state of the committed version into a new
+// instance of the operator. It returns nil if the operator does not exist.
+func (s *Storage) committedHandler(ctx context.Context, call *jetflow.Request, committedVersion version) (jetflow.StatefulHandler, error) {
+	state, err := s.committedState(ctx, call, committedVersion)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return nil, nil
+	}
+	handler, err := s.newHandler(call.TypeName, call.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	err = handler.UnmarshalState(state)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshalling committed state")
+	}
+	return handler, nil
+}
+
+// committedState returns the state of the committed version. The operator is
+// activated if it was not in memory. The state is nil if the operator does
+// not exist.
+func (s *Storage) committedState(ctx context.Context, call *jetflow.Request, committedVersion version) ([]byte, error) {
+	state, ok := s.versionStateMapping.Load(committedVersion.key)
+	if ok {
+		return state.([]byte), nil
+	}
+
+	// Load or create the state of the operator if it is not in memory.
+	activeState, err := s.activeState(ctx, call.TypeName, call.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	state, loaded := s.versionStateMapping.LoadOrStore(committedVersion.key, activeState)
+	if loaded || activeState == nil {
+		return state.([]byte), nil
+	}
+
+	handler, err := s.newHandler(call.TypeName, call.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	err = handler.UnmarshalState(activeState)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshalling committed state")
+	}
+	return activeState, s.activate(ctx, handler)
+}
+
+// strict reports whether operators of the type must be created explicitly.
+func (s *Storage) strict(typeName string) (bool, error) {
+	handler, err := s.newHandler(typeName, "")
+	if err != nil {
+		return false, err
+	}
+	strictHandler, ok := handler.(jetflow.StrictHandler)
+	return ok && strictHandler.Strict(), nil
+}
+
+// upgradeState migrates a state that was stored outside of memory to the
+// state version of the operator.
+func (s *Storage) upgradeState(typeName, id string, state []byte) ([]byte, error) {
+	if state == nil {
+		return nil, nil
+	}
+	handler, err := s.newHandler(typeName, id)
+	if err != nil {
+		return nil, err
+	}
+	state, err = jetflow.UpgradeState(handler, state)
+	return state, errors.Wrap(err, "upgrading state")
+}
+
+// initialState returns the state of a new instance of the operator.
+func (s *Storage) initialState(typeName, id string) ([]byte, error) {
+	handler, err := s.newHandler(typeName, id)
+	if err != nil {
+		return nil, err
+	}
+	state, err := handler.MarshalState()
+	return state, errors.Wrap(err, "marshalling initial state")
+}
+
 func (s *Storage) keyVersionMappingLoad(key string) (version, error) {
 	v, _ := s.keyVersionMapping.Load(key)
 	version, ok := v.(version)
@@ -2,111 +2,546 @@ package memory
 
 import (
 	"context"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/mathieupost/jetflow"
+	"github.com/mathieupost/jetflow/storage/storagetest"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func TestPrepare(t *testing.T) {
+	storagetest.TestPrepare(t, func(t *testing.T, mapping jetflow.HandlerFactoryMapping) jetflow.Storage {
+		return NewStorage(mapping)
+	})
+}
+
+func TestExport(t *testing.T) {
+	storagetest.TestExport(t, func(t *testing.T, mapping jetflow.HandlerFactoryMapping) jetflow.Storage {
+		return NewStorage(mapping)
+	})
+}
+
+func TestCommitHook(t *testing.T) {
+	storagetest.TestCommitHook(t, func(t *testing.T, mapping jetflow.HandlerFactoryMapping, hook jetflow.CommitHook) jetflow.Storage {
+		return NewStorage(mapping, WithCommitHook(hook))
+	})
+}
+
+func TestSweep(t *testing.T) {
 	ctx := context.Background()
-	var s jetflow.Storage
-	s = NewStorage(jetflow.HandlerFactoryMapping{
-		"TestType": NewTestTypeHandler,
-	})
-
-	setup := func(ctx context.Context, trID, opID string) (jetflow.OperatorHandler, *jetflow.Request) {
-		call := &jetflow.Request{
-			TransactionID: trID,
-			RequestID:     "req_id",
-			TypeName:      "TestType",
-			InstanceID:    opID,
-			Args:          []byte("1"),
-		}
+	s := NewStorage(storagetest.Mapping(),
+		WithVersionTTL(5*time.Minute),
+		WithPrepareLease(time.Minute),
+	)
+
+	t.Run("LostRollback", func(t *testing.T) {
+		call := storagetest.Request("lost", t.Name())
 		operator, err := s.Get(ctx, call)
 		require.NoError(t, err)
-		return operator, call
-	}
-
-	t.Run("Success", func(t *testing.T) {
-		operator, call := setup(ctx, "1", t.Name())
 		operator.Handle(ctx, nil, call)
-		err := s.Prepare(ctx, call)
-		require.NoError(t, err)
+
+		// The coordinator never sends Prepare or Rollback.
+		s.Sweep(ctx, time.Now())
+		require.Equal(t, int64(0), s.Stats().ReclaimedVersions)
+		s.Sweep(ctx, time.Now().Add(10*time.Minute))
+		require.Equal(t, int64(1), s.Stats().ReclaimedVersions)
+
+		_, ok := s.keyVersionMapping.Load(call.TypeName + "." + call.InstanceID + "." + call.TransactionID)
+		require.False(t, ok)
+		err = s.Prepare(ctx, call)
+		require.ErrorIs(t, err, jetflow.ErrConflict)
 	})
 
-	t.Run("AlreadyPrepared", func(t *testing.T) {
-		operator, call1 := setup(ctx, "1", t.Name())
+	t.Run("LostCommit", func(t *testing.T) {
+		call1 := storagetest.Request("lost", t.Name())
+		operator, err := s.Get(ctx, call1)
+		require.NoError(t, err)
 		operator.Handle(ctx, nil, call1)
-		operator, call2 := setup(ctx, "2", t.Name())
-		operator.Handle(ctx, nil, call2)
+		require.NoError(t, s.Prepare(ctx, call1))
 
-		err := s.Prepare(ctx, call1)
+		// The prepared version blocks other transactions.
+		call2 := storagetest.Request("next", t.Name())
+		operator, err = s.Get(ctx, call2)
 		require.NoError(t, err)
+		operator.Handle(ctx, nil, call2)
+		require.ErrorContains(t, s.Prepare(ctx, call2), "already prepared")
 
-		err = s.Prepare(ctx, call2)
-		require.ErrorContains(t, err, "already prepared")
+		// The coordinator never sends Commit, so the lease expires. The
+		// version of the second transaction is not reclaimed, because it
+		// is not older than the TTL.
+		s.Sweep(ctx, time.Now().Add(30*time.Second))
+		require.Equal(t, int64(0), s.Stats().ExpiredLeases)
+		s.Sweep(ctx, time.Now().Add(2*time.Minute))
+		require.Equal(t, int64(1), s.Stats().ExpiredLeases)
+
+		require.NoError(t, s.Prepare(ctx, call2))
+		require.NoError(t, s.Commit(ctx, call2))
+		// The late commit of the first transaction has nothing left to
+		// apply, so it is lost.
+		require.NoError(t, s.Commit(ctx, call1))
+		operator, err = s.GetSnapshot(ctx, storagetest.Request("read", t.Name()))
+		require.NoError(t, err)
+		require.Equal(t, 2, storagetest.Field(t, operator))
 	})
 
-	t.Run("AlreadyPreparedButNoChanges", func(t *testing.T) {
-		operator, call1 := setup(ctx, "1", t.Name())
-		operator.Handle(ctx, nil, call1)
-		operator, call2 := setup(ctx, "2", t.Name())
-		call2.Args = []byte{}
-		operator.Handle(ctx, nil, call2)
+	t.Run("Coordinator", func(t *testing.T) {
+		call := storagetest.Request("coordinated", t.Name())
+		call.Coordinator = &jetflow.Address{TypeName: "TestType", InstanceID: "coordinator"}
+		operator, err := s.Get(ctx, call)
+		require.NoError(t, err)
+		operator.Handle(ctx, nil, call)
+		require.NoError(t, s.Prepare(ctx, call))
 
-		err := s.Prepare(ctx, call1)
+		// The version stays prepared until the coordinator is asked for
+		// the outcome, so a late commit is still applied.
+		s.Sweep(ctx, time.Now().Add(2*time.Minute))
+		require.Equal(t, int64(1), s.Stats().ExpiredLeases)
+		prepared, err := s.Prepared(ctx, time.Now())
 		require.NoError(t, err)
+		require.Len(t, prepared, 1)
+		require.Equal(t, "coordinated", prepared[0].TransactionID)
 
-		err = s.Prepare(ctx, call2)
+		require.NoError(t, s.Commit(ctx, call))
+		operator, err = s.GetSnapshot(ctx, storagetest.Request("read", t.Name()))
 		require.NoError(t, err)
+		require.Equal(t, 2, storagetest.Field(t, operator))
 	})
+}
 
-	t.Run("BaseOutdated", func(t *testing.T) {
-		operator, call1 := setup(ctx, "1", t.Name())
-		operator.Handle(ctx, nil, call1)
-		operator, call2 := setup(ctx, "2", t.Name())
+func TestGetSnapshot(t *testing.T) {
+	ctx := context.Background()
+	s := NewStorage(storagetest.Mapping())
+
+	// Read-only calls share the committed operator.
+	read1 := storagetest.Request("read1", t.Name())
+	snapshot1, err := s.GetSnapshot(ctx, read1)
+	require.NoError(t, err)
+	read2 := storagetest.Request("read2", t.Name())
+	snapshot2, err := s.GetSnapshot(ctx, read2)
+	require.NoError(t, err)
+	require.Same(t, snapshot1, snapshot2)
+
+	// Read-only calls do not create a version for their transaction.
+	_, ok := s.versionOperatorMapping.Load("TestType." + t.Name() + ".read1")
+	require.False(t, ok)
+
+	// A transaction reads its own writes.
+	write := storagetest.Request("write", t.Name())
+	operator, err := s.Get(ctx, write)
+	require.NoError(t, err)
+	operator.Handle(ctx, nil, write)
+	snapshot, err := s.GetSnapshot(ctx, write)
+	require.NoError(t, err)
+	require.Same(t, operator, snapshot)
+	require.Equal(t, 2, storagetest.Field(t, snapshot))
+
+	// Other transactions read the new state once it is committed.
+	snapshot, err = s.GetSnapshot(ctx, read1)
+	require.NoError(t, err)
+	require.Equal(t, 1, storagetest.Field(t, snapshot))
+	require.NoError(t, s.Prepare(ctx, write))
+	require.NoError(t, s.Commit(ctx, write))
+	snapshot, err = s.GetSnapshot(ctx, read1)
+	require.NoError(t, err)
+	require.Equal(t, 2, storagetest.Field(t, snapshot))
+}
+
+func TestPrepareWait(t *testing.T) {
+	ctx := context.Background()
+	s := NewStorage(storagetest.Mapping(), WithPrepareWait(time.Second))
+
+	write := func(t *testing.T, trID string) *jetflow.Request {
+		call := storagetest.Request(trID, t.Name())
+		operator, err := s.Get(ctx, call)
+		require.NoError(t, err)
+		operator.Handle(ctx, nil, call)
+		return call
+	}
+
+	t.Run("PrepareWaitsForRollback", func(t *testing.T) {
+		call1 := write(t, "1")
+		call2 := write(t, "2")
+		require.NoError(t, s.Prepare(ctx, call1))
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			assert.Equal(t, int64(1), s.Stats().Waiting)
+			s.Rollback(ctx, call1)
+		}()
+		require.NoError(t, s.Prepare(ctx, call2))
+		require.Equal(t, int64(0), s.Stats().Waiting)
+	})
+
+	t.Run("GetWaitsForCommit", func(t *testing.T) {
+		call1 := write(t, "1")
+		require.NoError(t, s.Prepare(ctx, call1))
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			s.Commit(ctx, call1)
+		}()
+		call2 := storagetest.Request("2", t.Name())
+		operator, err := s.Get(ctx, call2)
+		require.NoError(t, err)
+		require.Equal(t, 2, storagetest.Field(t, operator))
 		operator.Handle(ctx, nil, call2)
+		require.NoError(t, s.Prepare(ctx, call2))
+	})
 
-		err := s.Prepare(ctx, call1)
+	t.Run("Timeout", func(t *testing.T) {
+		s := NewStorage(storagetest.Mapping(), WithPrepareWait(50*time.Millisecond))
+		call1 := storagetest.Request("1", t.Name())
+		operator, err := s.Get(ctx, call1)
 		require.NoError(t, err)
-		err = s.Commit(ctx, call1)
+		operator.Handle(ctx, nil, call1)
+		call2 := storagetest.Request("2", t.Name())
+		operator, err = s.Get(ctx, call2)
 		require.NoError(t, err)
+		operator.Handle(ctx, nil, call2)
+		require.NoError(t, s.Prepare(ctx, call1))
 
 		err = s.Prepare(ctx, call2)
-		require.ErrorContains(t, err, "base outdated")
+		require.ErrorContains(t, err, "already prepared")
+		stats := s.Stats()
+		require.Equal(t, int64(1), stats.Waits)
+		require.GreaterOrEqual(t, stats.WaitTime, 50*time.Millisecond)
 	})
 
+	require.Equal(t, int64(2), s.Stats().Waits)
 }
 
-type TestTypeHandler struct {
-	instance TestType
+func TestPassivation(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewDirStore(t.TempDir())
+	require.NoError(t, err)
+	var activations, deactivations atomic.Int64
+	mapping := jetflow.HandlerFactoryMapping{
+		"TestType": func(id string) jetflow.OperatorHandler {
+			return &activationHandler{
+				TestTypeHandler: storagetest.NewTestTypeHandler(id).(*storagetest.TestTypeHandler),
+				activations:     &activations,
+				deactivations:   &deactivations,
+			}
+		},
+	}
+	var versions []uint64
+	hook := WithCommitHook(func(ctx context.Context, change jetflow.Change) {
+		versions = append(versions, change.Version)
+	})
+	s := NewStorage(mapping, WithPassivation(store, time.Minute), hook)
+
+	field := func(t *testing.T, operator jetflow.OperatorHandler) int {
+		return storagetest.Field(t, operator.(*activationHandler).TestTypeHandler)
+	}
+
+	call := storagetest.Request("1", "op")
+	operator, err := s.Get(ctx, call)
+	require.NoError(t, err)
+	operator.Handle(ctx, nil, call)
+	require.NoError(t, s.Prepare(ctx, call))
+	require.NoError(t, s.Commit(ctx, call))
+	require.Equal(t, int64(1), activations.Load())
+
+	// Recently used operators stay in memory.
+	s.Sweep(ctx, time.Now())
+	require.Equal(t, int64(0), s.Stats().Passivations)
+
+	s.Sweep(ctx, time.Now().Add(2*time.Minute))
+	require.Equal(t, int64(1), s.Stats().Passivations)
+	require.Equal(t, int64(1), deactivations.Load())
+	_, ok := s.keyVersionMapping.Load("TestType.op")
+	require.False(t, ok)
+
+	// The next Get activates the operator with its passivated state.
+	call = storagetest.Request("2", "op")
+	operator, err = s.Get(ctx, call)
+	require.NoError(t, err)
+	require.Equal(t, 2, field(t, operator))
+	require.Equal(t, int64(2), activations.Load())
+
+	// Operators that are used by a transaction stay in memory.
+	s.Sweep(ctx, time.Now().Add(2*time.Minute))
+	require.Equal(t, int64(1), s.Stats().Passivations)
+
+	operator.Handle(ctx, nil, call)
+	require.NoError(t, s.Prepare(ctx, call))
+	require.NoError(t, s.Commit(ctx, call))
+	s.Sweep(ctx, time.Now().Add(2*time.Minute))
+	require.Equal(t, int64(2), s.Stats().Passivations)
+
+	operator, err = s.Get(ctx, storagetest.Request("3", "op"))
+	require.NoError(t, err)
+	require.Equal(t, 3, field(t, operator))
+
+	// The version numbers keep increasing after activations, also when the
+	// storage is created again.
+	s = NewStorage(mapping, WithPassivation(store, time.Minute), hook)
+	call = storagetest.Request("4", "op")
+	operator, err = s.Get(ctx, call)
+	require.NoError(t, err)
+	operator.Handle(ctx, nil, call)
+	require.NoError(t, s.Prepare(ctx, call))
+	require.NoError(t, s.Commit(ctx, call))
+	require.Equal(t, []uint64{1, 2, 3}, versions)
 }
 
-func (h *TestTypeHandler) Handle(ctx context.Context, client jetflow.OperatorClient, call *jetflow.Request) (bytes []byte, err error) {
-	h.instance.(*testType).field += len(call.Args)
-	return
+type activationHandler struct {
+	*storagetest.TestTypeHandler
+	activations   *atomic.Int64
+	deactivations *atomic.Int64
 }
 
-func NewTestTypeHandler(id string) jetflow.OperatorHandler {
-	instance := NewTestType(id)
-	return &TestTypeHandler{instance}
+// OnActivate implements jetflow.ActivationHandler.
+func (h *activationHandler) OnActivate(ctx context.Context) error {
+	h.activations.Add(1)
+	return nil
+}
+
+// OnDeactivate implements jetflow.ActivationHandler.
+func (h *activationHandler) OnDeactivate(ctx context.Context) error {
+	h.deactivations.Add(1)
+	return nil
+}
+
+func TestLifecycle(t *testing.T) {
+	ctx := context.Background()
+	mapping := jetflow.HandlerFactoryMapping{
+		"TestType": func(id string) jetflow.OperatorHandler {
+			return &strictHandler{storagetest.NewTestTypeHandler(id).(*storagetest.TestTypeHandler)}
+		},
+	}
+	s := NewStorage(mapping)
+
+	commit := func(t *testing.T, call *jetflow.Request) {
+		require.NoError(t, s.Prepare(ctx, call))
+		require.NoError(t, s.Commit(ctx, call))
+	}
+
+	t.Run("NotFound", func(t *testing.T) {
+		call := storagetest.Request("1", t.Name())
+		_, err := s.Get(ctx, call)
+		require.ErrorIs(t, err, jetflow.ErrNotFound)
+		_, err = s.GetSnapshot(ctx, call)
+		require.ErrorIs(t, err, jetflow.ErrNotFound)
+		exists, err := s.Exists(ctx, call)
+		require.NoError(t, err)
+		require.False(t, exists)
+		require.ErrorIs(t, s.Delete(ctx, call), jetflow.ErrNotFound)
+	})
+
+	t.Run("Create", func(t *testing.T) {
+		call := storagetest.Request("1", t.Name())
+		require.NoError(t, s.Create(ctx, call))
+		require.ErrorIs(t, s.Create(ctx, call), jetflow.ErrAlreadyExists)
+
+		// The operator only exists in the transaction until it commits.
+		exists, err := s.Exists(ctx, call)
+		require.NoError(t, err)
+		require.True(t, exists)
+		exists, err = s.Exists(ctx, storagetest.Request("2", t.Name()))
+		require.NoError(t, err)
+		require.False(t, exists)
+
+		operator, err := s.Get(ctx, call)
+		require.NoError(t, err)
+		operator.Handle(ctx, nil, call)
+		commit(t, call)
+
+		call = storagetest.Request("2", t.Name())
+		require.ErrorIs(t, s.Create(ctx, call), jetflow.ErrAlreadyExists)
+		operator, err = s.Get(ctx, call)
+		require.NoError(t, err)
+		require.Equal(t, 2, storagetest.Field(t, operator.(*strictHandler).TestTypeHandler))
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		call := storagetest.Request("1", t.Name())
+		require.NoError(t, s.Create(ctx, call))
+		commit(t, call)
+
+		call = storagetest.Request("2", t.Name())
+		require.NoError(t, s.Delete(ctx, call))
+		_, err := s.Get(ctx, call)
+		require.ErrorIs(t, err, jetflow.ErrNotFound)
+		commit(t, call)
+
+		call = storagetest.Request("3", t.Name())
+		_, err = s.Get(ctx, call)
+		require.ErrorIs(t, err, jetflow.ErrNotFound)
+
+		// Deleted operators can be created again.
+		require.NoError(t, s.Create(ctx, call))
+		commit(t, call)
+		exists, err := s.Exists(ctx, storagetest.Request("4", t.Name()))
+		require.NoError(t, err)
+		require.True(t, exists)
+	})
+
+	t.Run("NotStrict", func(t *testing.T) {
+		s := NewStorage(storagetest.Mapping())
+		call := storagetest.Request("1", t.Name())
+		require.ErrorIs(t, s.Create(ctx, call), jetflow.ErrAlreadyExists)
+		operator, err := s.Get(ctx, call)
+		require.NoError(t, err)
+		operator.Handle(ctx, nil, call)
+		commit := func(call *jetflow.Request) {
+			require.NoError(t, s.Prepare(ctx, call))
+			require.NoError(t, s.Commit(ctx, call))
+		}
+		commit(call)
+
+		// Deleting resets the operator.
+		call = storagetest.Request("2", t.Name())
+		require.NoError(t, s.Delete(ctx, call))
+		commit(call)
+		operator, err = s.Get(ctx, storagetest.Request("3", t.Name()))
+		require.NoError(t, err)
+		require.Equal(t, 1, storagetest.Field(t, operator))
+	})
 }
 
-type TestType interface {
-	jetflow.Operator
+type strictHandler struct {
+	*storagetest.TestTypeHandler
 }
 
-func NewTestType(id string) TestType {
-	return &testType{id: id, field: 1}
+// Strict implements jetflow.StrictHandler.
+func (h *strictHandler) Strict() bool {
+	return true
 }
 
-type testType struct {
-	id    string
-	field int
+func TestSerializable(t *testing.T) {
+	ctx := context.Background()
+
+	// call reads the operator in the transaction, and writes it if write is
+	// set.
+	call := func(t *testing.T, s *Storage, trID, opID string, write bool) *jetflow.Request {
+		call := storagetest.Request(trID, opID)
+		if !write {
+			call.Args = []byte{}
+		}
+		operator, err := s.Get(ctx, call)
+		require.NoError(t, err)
+		_, err = operator.Handle(ctx, nil, call)
+		require.NoError(t, err)
+		return call
+	}
+
+	t.Run("WriteSkew", func(t *testing.T) {
+		s := NewStorage(storagetest.Mapping())
+
+		// Both transactions read the operator that the other one writes.
+		readA1, writeB1 := call(t, s, "1", "a", false), call(t, s, "1", "b", true)
+		readB2, writeA2 := call(t, s, "2", "b", false), call(t, s, "2", "a", true)
+
+		// Without serializable isolation, both transactions commit.
+		for _, call := range []*jetflow.Request{readA1, writeB1, readB2, writeA2} {
+			require.NoError(t, s.Prepare(ctx, call))
+		}
+		for _, call := range []*jetflow.Request{readA1, writeB1, readB2, writeA2} {
+			require.NoError(t, s.Commit(ctx, call))
+		}
+	})
+
+	t.Run("Serializable", func(t *testing.T) {
+		s := NewStorage(storagetest.Mapping(), WithSerializable())
+
+		readA1, writeB1 := call(t, s, "1", "a", false), call(t, s, "1", "b", true)
+		readB2, writeA2 := call(t, s, "2", "b", false), call(t, s, "2", "a", true)
+
+		// The reads lock the operators, so neither transaction can prepare
+		// its write.
+		require.NoError(t, s.Prepare(ctx, readA1))
+		require.NoError(t, s.Prepare(ctx, readB2))
+		require.ErrorContains(t, s.Prepare(ctx, writeB1), "read by another transaction")
+		require.ErrorContains(t, s.Prepare(ctx, writeA2), "read by another transaction")
+		require.NoError(t, s.Rollback(ctx, readA1))
+		require.NoError(t, s.Rollback(ctx, writeB1))
+
+		// Once the first transaction released its read lock, the second one
+		// commits.
+		require.NoError(t, s.Prepare(ctx, writeA2))
+		require.NoError(t, s.Commit(ctx, readB2))
+		require.NoError(t, s.Commit(ctx, writeA2))
+	})
+
+	t.Run("ReadOutdated", func(t *testing.T) {
+		s := NewStorage(storagetest.Mapping(), WithSerializable())
+
+		readA1, writeB1 := call(t, s, "1", "a", false), call(t, s, "1", "b", true)
+		writeA2 := call(t, s, "2", "a", true)
+		require.NoError(t, s.Prepare(ctx, writeA2))
+
+		// The operator that the first transaction read is prepared and then
+		// committed by the second one.
+		require.ErrorContains(t, s.Prepare(ctx, readA1), "read already prepared")
+		require.NoError(t, s.Commit(ctx, writeA2))
+		require.ErrorContains(t, s.Prepare(ctx, readA1), "base outdated")
+		require.NoError(t, s.Prepare(ctx, writeB1))
+	})
 }
 
-// ID implements jetflow.Operator interface.
-func (t *testType) ID() string {
-	return t.id
+func TestLocking(t *testing.T) {
+	ctx := context.Background()
+	s := NewStorage(storagetest.Mapping(), WithLocking("TestType"))
+
+	get := func(t *testing.T, trID string, transactionTime int64) (jetflow.OperatorHandler, *jetflow.Request, error) {
+		call := storagetest.Request(trID, t.Name())
+		call.TransactionTime = transactionTime
+		operator, err := s.Get(ctx, call)
+		return operator, call, err
+	}
+
+	t.Run("OlderWaits", func(t *testing.T) {
+		operator, call1, err := get(t, "young", 2)
+		require.NoError(t, err)
+		operator.Handle(ctx, nil, call1)
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			assert.NoError(t, s.Prepare(ctx, call1))
+			assert.NoError(t, s.Commit(ctx, call1))
+		}()
+
+		// The older transaction waits for the lock and reads the committed
+		// state of the younger one.
+		operator, call2, err := get(t, "old", 1)
+		require.NoError(t, err)
+		require.Equal(t, 2, storagetest.Field(t, operator))
+		operator.Handle(ctx, nil, call2)
+		require.NoError(t, s.Prepare(ctx, call2))
+		require.NoError(t, s.Commit(ctx, call2))
+	})
+
+	t.Run("YoungerDies", func(t *testing.T) {
+		_, call1, err := get(t, "old", 1)
+		require.NoError(t, err)
+
+		_, _, err = get(t, "young", 2)
+		require.ErrorContains(t, err, "locked by an older transaction")
+
+		// The lock is released by the rollback.
+		require.NoError(t, s.Rollback(ctx, call1))
+		_, _, err = get(t, "young", 2)
+		require.NoError(t, err)
+	})
+
+	t.Run("OtherTypes", func(t *testing.T) {
+		s := NewStorage(jetflow.HandlerFactoryMapping{
+			"TestType":  storagetest.NewTestTypeHandler,
+			"OtherType": storagetest.NewTestTypeHandler,
+		}, WithLocking("TestType"))
+
+		// Operators of other types are not locked.
+		call1 := storagetest.Request("old", t.Name())
+		call1.TypeName, call1.TransactionTime = "OtherType", 1
+		_, err := s.Get(ctx, call1)
+		require.NoError(t, err)
+		call2 := storagetest.Request("young", t.Name())
+		call2.TypeName, call2.TransactionTime = "OtherType", 2
+		_, err = s.Get(ctx, call2)
+		require.NoError(t, err)
+	})
 }
@@ -0,0 +1,90 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/mathieupost/jetflow"
+)
+
+// StartSweeper calls Sweep every interval until the context is done.
+func (s *Storage) StartSweeper(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				s.Sweep(ctx, now)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Sweep reclaims the versions of transactions whose Commit or Rollback was
+// lost, for example because the coordinator crashed.
+//
+// Transaction versions that were not prepared are removed once they are
+// older than the version TTL. Prepared versions whose transaction has a
+// coordinator are left to jetflow.Executor.Recover, which asks the coordinator
+// for the outcome. Prepared versions without a coordinator, which nobody can
+// be asked about, are rolled back once their prepare lease expired, so they no
+// longer block the operator. Idle operators
+// are passivated if passivation is enabled. Read locks of serializable
+// transactions are released once they are older than the prepare lease, and
+// the locks of transactions are released with their versions.
+func (s *Storage) Sweep(ctx context.Context, now time.Time) {
+	defer s.passivate(ctx, now)
+	s.sweepReads(now)
+
+	s.keyVersionMapping.Range(func(key, value any) bool {
+		v := value.(version)
+
+		if v.base == "" {
+			// A committed version.
+			expired := s.prepareLease > 0 && v.prepared != "" &&
+				v.coordinator == jetflow.Address{} &&
+				now.Sub(v.preparedAt) > s.prepareLease
+			if !expired {
+				return true
+			}
+			unprepared := v
+			unprepared.prepared = ""
+			unprepared.preparedAt = time.Time{}
+			unprepared.coordinator = jetflow.Address{}
+			if !s.keyVersionMappingSwap(key.(string), v, unprepared) {
+				// Committed or rolled back in the meantime.
+				return true
+			}
+			s.release(key.(string))
+			s.releaseVersionLock(key.(string), v.prepared)
+			s.keyVersionMapping.Delete(v.prepared)
+			s.versionOperatorMapping.Delete(v.prepared)
+			s.versionStateMapping.Delete(v.prepared)
+			s.metrics.expiredLeases.Add(1)
+			s.metrics.expiredLeasesCounter.Add(ctx, 1)
+			return true
+		}
+
+		// A transaction version.
+		expired := s.versionTTL > 0 && now.Sub(v.created) > s.versionTTL
+		if !expired {
+			return true
+		}
+		committed, err := s.keyVersionMappingLoad(v.operator)
+		if err == nil && committed.prepared == v.key {
+			// Prepared versions are released by their lease.
+			return true
+		}
+		if !s.keyVersionMapping.CompareAndDelete(key, v) {
+			return true
+		}
+		s.versionOperatorMapping.Delete(v.key)
+		s.releaseVersionLock(v.operator, v.key)
+		s.metrics.reclaimedVersions.Add(1)
+		s.metrics.reclaimedVersionsCounter.Add(ctx, 1)
+		return true
+	})
+}
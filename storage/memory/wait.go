@@ -0,0 +1,53 @@
+package memory
+
+import (
+	"context"
+	"time"
+)
+
+// waitUntilReleased waits until the operator is no longer prepared, the
+// prepare wait timeout expires or the context is done. It returns the latest
+// committed version of the operator.
+func (s *Storage) waitUntilReleased(ctx context.Context, operatorKey string) version {
+	start := time.Now()
+	timer := time.NewTimer(s.prepareWait)
+	defer timer.Stop()
+
+	s.metrics.waiting.Add(1)
+	s.metrics.waitingCounter.Add(ctx, 1)
+	defer func() {
+		waited := time.Since(start)
+		s.metrics.waiting.Add(-1)
+		s.metrics.waitingCounter.Add(ctx, -1)
+		s.metrics.waits.Add(1)
+		s.metrics.waitTime.Add(int64(waited))
+		s.metrics.waitTimeHistogram.Record(ctx, waited.Seconds())
+	}()
+
+	for {
+		released, _ := s.releaseMapping.LoadOrStore(operatorKey, make(chan struct{}))
+
+		// Check after subscribing, so a release in between is not missed.
+		committedVersion := s.keyVersionMappingLoadOrStore(operatorKey)
+		if committedVersion.prepared == "" {
+			return committedVersion
+		}
+
+		select {
+		case <-released.(chan struct{}):
+		case <-timer.C:
+			return s.keyVersionMappingLoadOrStore(operatorKey)
+		case <-ctx.Done():
+			return s.keyVersionMappingLoadOrStore(operatorKey)
+		}
+	}
+}
+
+// release wakes up the transactions that wait for the prepared version of the
+// operator.
+func (s *Storage) release(operatorKey string) {
+	released, ok := s.releaseMapping.LoadAndDelete(operatorKey)
+	if ok {
+		close(released.(chan struct{}))
+	}
+}
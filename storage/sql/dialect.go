@@ -0,0 +1,99 @@
+package sql
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Dialect contains the parts of the queries that differ between databases.
+// The queries are written with ? placeholders, which Bind replaces by the
+// placeholders of the database. Other databases than the ones below can be
+// supported by a custom Dialect.
+type Dialect struct {
+	// Placeholder returns the placeholder of the nth argument of a query,
+	// counting from 1.
+	Placeholder func(n int) string
+	// Blob is the column type of binary data.
+	Blob string
+	// InsertIgnore returns a statement that inserts a row with the columns
+	// into the table, or does nothing if a row with the same key exists.
+	InsertIgnore func(table string, columns, key []string) string
+	// Upsert returns a statement that inserts a row with the columns into
+	// the table, or updates the other columns if a row with the same key
+	// exists.
+	Upsert func(table string, columns, key []string) string
+}
+
+// PostgreSQL is the Dialect of PostgreSQL. It is the default.
+var PostgreSQL = Dialect{
+	Placeholder:  numbered,
+	Blob:         "BYTEA",
+	InsertIgnore: onConflictDoNothing,
+	Upsert:       onConflictDoUpdate,
+}
+
+// SQLite is the Dialect of SQLite.
+var SQLite = Dialect{
+	Placeholder:  numbered,
+	Blob:         "BLOB",
+	InsertIgnore: onConflictDoNothing,
+	Upsert:       onConflictDoUpdate,
+}
+
+// Bind replaces the ? placeholders in the query by the placeholders of the
+// dialect.
+func (d Dialect) Bind(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString(d.Placeholder(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// ValidateTableName returns an error if the name can not be used as a table
+// name. Table names are inserted into the queries as they are, so only
+// letters, digits and underscores are allowed, optionally qualified by a
+// schema name.
+func ValidateTableName(name string) error {
+	if !identifier.MatchString(name) {
+		return errors.Errorf("invalid table name %q", name)
+	}
+	return nil
+}
+
+// numbered returns the numbered placeholder $n.
+func numbered(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+// insert returns an insert statement for the columns with ? placeholders.
+func insert(table string, columns []string) string {
+	values := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	return "INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES (" + values + ")"
+}
+
+func onConflictDoNothing(table string, columns, key []string) string {
+	return insert(table, columns) + " ON CONFLICT (" + strings.Join(key, ", ") + ") DO NOTHING"
+}
+
+func onConflictDoUpdate(table string, columns, key []string) string {
+	var updates []string
+	for _, column := range columns {
+		if !slices.Contains(key, column) {
+			updates = append(updates, column+" = excluded."+column)
+		}
+	}
+	return insert(table, columns) + " ON CONFLICT (" + strings.Join(key, ", ") + ") DO UPDATE SET " + strings.Join(updates, ", ")
+}
@@ -0,0 +1,57 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mathieupost/jetflow"
+)
+
+var _ jetflow.ExportableStorage = (*Storage)(nil)
+
+// Export implements jetflow.ExportableStorage.
+func (s *Storage) Export(ctx context.Context, typeNames []string, fn func(jetflow.StateRecord) error) error {
+	query := fmt.Sprintf(`SELECT type_name, instance_id, state FROM %s WHERE version > 0`, s.table)
+	args := []any{}
+	if len(typeNames) > 0 {
+		placeholders := make([]string, len(typeNames))
+		for i, typeName := range typeNames {
+			placeholders[i] = "?"
+			args = append(args, typeName)
+		}
+		query += " AND type_name IN (" + strings.Join(placeholders, ", ") + ")"
+	}
+	query = s.dialect.Bind(query)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return errors.Wrap(err, "querying states")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var record jetflow.StateRecord
+		err = rows.Scan(&record.TypeName, &record.InstanceID, &record.State)
+		if err != nil {
+			return errors.Wrap(err, "scanning state")
+		}
+		err = fn(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	return errors.Wrap(rows.Err(), "querying states")
+}
+
+// Import implements jetflow.ExportableStorage.
+func (s *Storage) Import(ctx context.Context, record jetflow.StateRecord) error {
+	_, err := s.db.ExecContext(ctx, s.query(`INSERT INTO %s (type_name, instance_id, version, state)
+		VALUES (?, ?, 1, ?)`),
+		record.TypeName, record.InstanceID, []byte(record.State),
+	)
+	return errors.Wrap(err, "inserting operator")
+}
@@ -0,0 +1,360 @@
+// Package sql implements a jetflow.Storage that persists the committed
+// operator states in a relational table using database/sql.
+//
+// A transaction prepares an operator by conditionally updating its row: the
+// prepared state is only stored if the row still has the version the
+// transaction read and no other transaction prepared it. The queries use the
+// PostgreSQL dialect by default, see WithDialect.
+package sql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+
+	"github.com/mathieupost/jetflow"
+)
+
+var _ jetflow.Storage = (*Storage)(nil)
+
+type Storage struct {
+	typeHandlerMapping jetflow.HandlerFactoryMapping
+	db                 *sql.DB
+	table              string
+	dialect            Dialect
+	commitHooks        []jetflow.CommitHook
+
+	mu       sync.Mutex
+	versions map[string]*version
+}
+
+// version is the state of an operator for a single transaction.
+type version struct {
+	base      int64
+	baseState []byte
+	handler   jetflow.StatefulHandler
+}
+
+type Option func(*Storage)
+
+// WithTable sets the name of the table in which the operator states are
+// stored. Defaults to jetflow_operators.
+func WithTable(table string) Option {
+	return func(s *Storage) {
+		s.table = table
+	}
+}
+
+// WithDialect sets the dialect of the database. Defaults to PostgreSQL.
+func WithDialect(dialect Dialect) Option {
+	return func(s *Storage) {
+		s.dialect = dialect
+	}
+}
+
+// WithCommitHook adds a hook that is called with every committed change.
+func WithCommitHook(hook jetflow.CommitHook) Option {
+	return func(s *Storage) {
+		s.commitHooks = append(s.commitHooks, hook)
+	}
+}
+
+// NewStorage creates the operator table in db if it does not exist yet.
+func NewStorage(ctx context.Context, mapping jetflow.HandlerFactoryMapping, db *sql.DB, opts ...Option) (*Storage, error) {
+	s := &Storage{
+		typeHandlerMapping: mapping,
+		db:                 db,
+		table:              "jetflow_operators",
+		dialect:            PostgreSQL,
+		versions:           map[string]*version{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	err := ValidateTableName(s.table)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %[1]s (
+		type_name      TEXT NOT NULL,
+		instance_id    TEXT NOT NULL,
+		version        BIGINT NOT NULL,
+		state          %[2]s,
+		prepared_tx    TEXT,
+		prepared_state %[2]s,
+		prepared_at    BIGINT,
+		coordinator    TEXT,
+		coordinator_id TEXT,
+		PRIMARY KEY (type_name, instance_id)
+	)`, s.table, s.dialect.Blob))
+	if err != nil {
+		return nil, errors.Wrap(err, "creating table")
+	}
+
+	return s, nil
+}
+
+func (s *Storage) Get(ctx context.Context, call *jetflow.Request) (jetflow.OperatorHandler, error) {
+	ctx, span := otel.Tracer("").Start(ctx, "sql.Storage.Get")
+	defer span.End()
+
+	versionKey := call.TypeName + "." + call.InstanceID + "." + call.TransactionID
+
+	committedVersion, state, _, err := s.load(ctx, call)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading committed state")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Load the operator version for the current request.
+	v, ok := s.versions[versionKey]
+	if ok {
+		// Check if the version is not yet outdated because of a
+		// new committed version.
+		if v.base != committedVersion {
+			return nil, errors.Wrap(jetflow.ErrConflict, "outdated version")
+		}
+		return v.handler, nil
+	}
+
+	// Create the operator version for the current request from the
+	// committed state.
+	handler, err := s.newHandler(call.TypeName, call.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	if committedVersion > 0 {
+		state, err = jetflow.UpgradeState(handler, state)
+		if err != nil {
+			return nil, errors.Wrap(err, "upgrading committed state")
+		}
+		err = handler.UnmarshalState(state)
+		if err != nil {
+			return nil, errors.Wrap(err, "unmarshalling committed state")
+		}
+	} else {
+		state, err = handler.MarshalState()
+		if err != nil {
+			return nil, errors.Wrap(err, "marshalling initial state")
+		}
+	}
+	s.versions[versionKey] = &version{
+		base:      committedVersion,
+		baseState: state,
+		handler:   handler,
+	}
+
+	return handler, nil
+}
+
+func (s *Storage) Prepare(ctx context.Context, call *jetflow.Request) error {
+	ctx, span := otel.Tracer("").Start(ctx, "sql.Storage.Prepare")
+	defer span.End()
+
+	versionKey := call.TypeName + "." + call.InstanceID + "." + call.TransactionID
+
+	s.mu.Lock()
+	v, ok := s.versions[versionKey]
+	s.mu.Unlock()
+	if !ok {
+		return errors.Wrapf(jetflow.ErrConflict, "request operator does not exist for %s", versionKey)
+	}
+
+	committedVersion, _, preparedTx, err := s.load(ctx, call)
+	if err != nil {
+		return errors.Wrap(err, "loading committed state")
+	}
+
+	// Check if the version for the given transaction is created
+	// from the committed version.
+	if v.base != committedVersion {
+		// A new version is already committed.
+		return errors.Wrap(jetflow.ErrConflict, "base outdated")
+	}
+
+	state, err := v.handler.MarshalState()
+	if err != nil {
+		return errors.Wrap(err, "marshalling state")
+	}
+	if bytes.Equal(state, v.baseState) {
+		// Operator was not written
+		return nil
+	}
+
+	if preparedTx.Valid {
+		// Already prepared by another request.
+		return errors.Wrap(jetflow.ErrConflict, "already prepared")
+	}
+
+	if v.base == 0 {
+		// Make sure there is a row to prepare.
+		_, err = s.db.ExecContext(ctx, s.dialect.Bind(s.dialect.InsertIgnore(s.table,
+			[]string{"type_name", "instance_id", "version"},
+			[]string{"type_name", "instance_id"},
+		)),
+			call.TypeName, call.InstanceID, 0,
+		)
+		if err != nil {
+			return errors.Wrap(err, "inserting operator")
+		}
+	}
+
+	// Only prepare if the row still has the version this transaction read
+	// and is not prepared by another transaction.
+	var coordinator, coordinatorID sql.NullString
+	if call.Coordinator != nil {
+		coordinator = sql.NullString{String: call.Coordinator.TypeName, Valid: true}
+		coordinatorID = sql.NullString{String: call.Coordinator.InstanceID, Valid: true}
+	}
+	res, err := s.db.ExecContext(ctx, s.query(`UPDATE %s
+		SET prepared_tx = ?, prepared_state = ?, prepared_at = ?, coordinator = ?, coordinator_id = ?
+		WHERE type_name = ? AND instance_id = ? AND version = ? AND prepared_tx IS NULL`),
+		call.TransactionID, state, time.Now().UnixNano(), coordinator, coordinatorID,
+		call.TypeName, call.InstanceID, v.base,
+	)
+	if err != nil {
+		return errors.Wrap(err, "updating prepared state")
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "updating prepared state")
+	}
+	if updated == 0 {
+		return errors.Wrap(jetflow.ErrConflict, "failed to prepare")
+	}
+
+	return nil
+}
+
+func (s *Storage) Commit(ctx context.Context, call *jetflow.Request) error {
+	ctx, span := otel.Tracer("").Start(ctx, "sql.Storage.Commit")
+	defer span.End()
+
+	versionKey := call.TypeName + "." + call.InstanceID + "." + call.TransactionID
+
+	// Delete the transaction version.
+	s.mu.Lock()
+	delete(s.versions, versionKey)
+	s.mu.Unlock()
+
+	// Read the change before committing it. The row cannot change while it
+	// is prepared by this request.
+	var change jetflow.Change
+	if len(s.commitHooks) > 0 {
+		change = jetflow.Change{
+			TypeName:      call.TypeName,
+			InstanceID:    call.InstanceID,
+			TransactionID: call.TransactionID,
+		}
+		var previousState, state []byte
+		err := s.db.QueryRowContext(ctx, s.query(`SELECT version + 1, state, prepared_state FROM %s
+			WHERE type_name = ? AND instance_id = ? AND prepared_tx = ?`),
+			call.TypeName, call.InstanceID, call.TransactionID,
+		).Scan(&change.Version, &previousState, &state)
+		if errors.Is(err, sql.ErrNoRows) {
+			// The transaction did not write the operator, or the commit
+			// was applied before and is sent again because its
+			// acknowledgement was lost.
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "reading prepared state")
+		}
+		change.State, change.PreviousState = state, previousState
+	}
+
+	// Update the committed version to the prepared version.
+	res, err := s.db.ExecContext(ctx, s.query(`UPDATE %s
+		SET version = version + 1, state = prepared_state,
+			prepared_tx = NULL, prepared_state = NULL, prepared_at = NULL, coordinator = NULL, coordinator_id = NULL
+		WHERE type_name = ? AND instance_id = ? AND prepared_tx = ?`),
+		call.TypeName, call.InstanceID, call.TransactionID,
+	)
+	if err != nil {
+		return errors.Wrap(err, "updating committed state")
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "updating committed state")
+	}
+	if updated == 0 {
+		// Not prepared by this transaction, as above.
+		return nil
+	}
+
+	for _, hook := range s.commitHooks {
+		hook(ctx, change)
+	}
+
+	return nil
+}
+
+func (s *Storage) Rollback(ctx context.Context, call *jetflow.Request) error {
+	ctx, span := otel.Tracer("").Start(ctx, "sql.Storage.Rollback")
+	defer span.End()
+
+	versionKey := call.TypeName + "." + call.InstanceID + "." + call.TransactionID
+
+	// Cleanup version.
+	s.mu.Lock()
+	delete(s.versions, versionKey)
+	s.mu.Unlock()
+
+	// Unprepare if needed.
+	_, err := s.db.ExecContext(ctx, s.query(`UPDATE %s
+		SET prepared_tx = NULL, prepared_state = NULL, prepared_at = NULL, coordinator = NULL, coordinator_id = NULL
+		WHERE type_name = ? AND instance_id = ? AND prepared_tx = ?`),
+		call.TypeName, call.InstanceID, call.TransactionID,
+	)
+	if err != nil {
+		return errors.Wrap(err, "clearing prepared state")
+	}
+
+	return nil
+}
+
+// load returns the committed version and state of the operator and the id
+// of the transaction that prepared it. The version is 0 if the operator was
+// never committed.
+func (s *Storage) load(ctx context.Context, call *jetflow.Request) (int64, []byte, sql.NullString, error) {
+	var (
+		version    int64
+		state      []byte
+		preparedTx sql.NullString
+	)
+	err := s.db.QueryRowContext(ctx, s.query(`SELECT version, state, prepared_tx FROM %s
+		WHERE type_name = ? AND instance_id = ?`),
+		call.TypeName, call.InstanceID,
+	).Scan(&version, &state, &preparedTx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil, preparedTx, nil
+	}
+	return version, state, preparedTx, err
+}
+
+// newHandler creates a new instance of the operator using its factory.
+func (s *Storage) newHandler(typeName, id string) (jetflow.StatefulHandler, error) {
+	factory, ok := s.typeHandlerMapping[typeName]
+	if !ok {
+		return nil, errors.Errorf("unknown operator type %s", typeName)
+	}
+	handler, ok := factory(id).(jetflow.StatefulHandler)
+	if !ok {
+		return nil, errors.Errorf("operator type %s is not a StatefulHandler", typeName)
+	}
+	return handler, nil
+}
+
+// query fills in the table name and the placeholders of the dialect.
+func (s *Storage) query(format string) string {
+	return s.dialect.Bind(fmt.Sprintf(format, s.table))
+}
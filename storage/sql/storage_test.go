@@ -0,0 +1,96 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+
+	"github.com/mathieupost/jetflow"
+	"github.com/mathieupost/jetflow/storage/storagetest"
+)
+
+func TestPrepare(t *testing.T) {
+	db := openDB(t)
+	storagetest.TestPrepare(t, func(t *testing.T, mapping jetflow.HandlerFactoryMapping) jetflow.Storage {
+		s, err := NewStorage(context.Background(), mapping, db, WithDialect(SQLite))
+		require.NoError(t, err)
+		return s
+	})
+}
+
+func TestExport(t *testing.T) {
+	storagetest.TestExport(t, func(t *testing.T, mapping jetflow.HandlerFactoryMapping) jetflow.Storage {
+		s, err := NewStorage(context.Background(), mapping, openDB(t))
+		require.NoError(t, err)
+		return s
+	})
+}
+
+func TestCommitHook(t *testing.T) {
+	storagetest.TestCommitHook(t, func(t *testing.T, mapping jetflow.HandlerFactoryMapping, hook jetflow.CommitHook) jetflow.Storage {
+		s, err := NewStorage(context.Background(), mapping, openDB(t), WithCommitHook(hook))
+		require.NoError(t, err)
+		return s
+	})
+}
+
+func TestRecovery(t *testing.T) {
+	db := openDB(t)
+	storagetest.TestRecovery(t, func(t *testing.T, mapping jetflow.HandlerFactoryMapping) jetflow.Storage {
+		s, err := NewStorage(context.Background(), mapping, db, WithDialect(SQLite))
+		require.NoError(t, err)
+		return s
+	})
+}
+
+func TestRestart(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+
+	s, err := NewStorage(ctx, storagetest.Mapping(), db)
+	require.NoError(t, err)
+
+	call := storagetest.Request("1", "op")
+	operator, err := s.Get(ctx, call)
+	require.NoError(t, err)
+	operator.Handle(ctx, nil, call)
+	require.NoError(t, s.Prepare(ctx, call))
+
+	// The prepared state survives a restart and can still be committed.
+	s, err = NewStorage(ctx, storagetest.Mapping(), db)
+	require.NoError(t, err)
+	require.NoError(t, s.Commit(ctx, call))
+
+	operator, err = s.Get(ctx, storagetest.Request("2", "op"))
+	require.NoError(t, err)
+	require.Equal(t, 2, storagetest.Field(t, operator))
+}
+
+func TestTableName(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+
+	_, err := NewStorage(ctx, storagetest.Mapping(), db, WithTable("main.operators"))
+	require.NoError(t, err)
+	_, err = NewStorage(ctx, storagetest.Mapping(), db, WithTable("operators; DROP TABLE jetflow_operators"))
+	require.ErrorContains(t, err, "invalid table name")
+}
+
+func TestBind(t *testing.T) {
+	query := `SELECT state FROM t WHERE type_name = ? AND instance_id = ?`
+	require.Equal(t, `SELECT state FROM t WHERE type_name = $1 AND instance_id = $2`, PostgreSQL.Bind(query))
+
+	mysql := Dialect{Placeholder: func(n int) string { return "?" }}
+	require.Equal(t, query, mysql.Bind(query))
+}
+
+func openDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "jetflow.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
@@ -0,0 +1,385 @@
+// Package storagetest contains the behavioral tests that every
+// jetflow.Storage implementation should pass.
+package storagetest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mathieupost/jetflow"
+)
+
+// NewStorage creates the Storage under test for the given mapping.
+type NewStorage func(t *testing.T, mapping jetflow.HandlerFactoryMapping) jetflow.Storage
+
+// Mapping returns the HandlerFactoryMapping of the TestType operator.
+func Mapping() jetflow.HandlerFactoryMapping {
+	return jetflow.HandlerFactoryMapping{
+		"TestType": NewTestTypeHandler,
+	}
+}
+
+// Request returns a request to the TestType operator with the given id.
+func Request(trID, opID string) *jetflow.Request {
+	return &jetflow.Request{
+		TransactionID: trID,
+		RequestID:     "req_id",
+		TypeName:      "TestType",
+		InstanceID:    opID,
+		Args:          []byte("1"),
+	}
+}
+
+// TestPrepare runs the prepare, commit and conflict tests against the
+// Storage created by newStorage.
+func TestPrepare(t *testing.T, newStorage NewStorage) {
+	ctx := context.Background()
+	s := newStorage(t, Mapping())
+
+	setup := func(ctx context.Context, trID, opID string) (jetflow.OperatorHandler, *jetflow.Request) {
+		call := Request(trID, opID)
+		operator, err := s.Get(ctx, call)
+		require.NoError(t, err)
+		return operator, call
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		operator, call := setup(ctx, "1", t.Name())
+		operator.Handle(ctx, nil, call)
+		err := s.Prepare(ctx, call)
+		require.NoError(t, err)
+	})
+
+	t.Run("AlreadyPrepared", func(t *testing.T) {
+		operator, call1 := setup(ctx, "1", t.Name())
+		operator.Handle(ctx, nil, call1)
+		operator, call2 := setup(ctx, "2", t.Name())
+		operator.Handle(ctx, nil, call2)
+
+		err := s.Prepare(ctx, call1)
+		require.NoError(t, err)
+
+		err = s.Prepare(ctx, call2)
+		require.ErrorContains(t, err, "already prepared")
+	})
+
+	t.Run("AlreadyPreparedButNoChanges", func(t *testing.T) {
+		operator, call1 := setup(ctx, "1", t.Name())
+		operator.Handle(ctx, nil, call1)
+		operator, call2 := setup(ctx, "2", t.Name())
+		call2.Args = []byte{}
+		operator.Handle(ctx, nil, call2)
+
+		err := s.Prepare(ctx, call1)
+		require.NoError(t, err)
+
+		err = s.Prepare(ctx, call2)
+		require.NoError(t, err)
+	})
+
+	t.Run("BaseOutdated", func(t *testing.T) {
+		operator, call1 := setup(ctx, "1", t.Name())
+		operator.Handle(ctx, nil, call1)
+		operator, call2 := setup(ctx, "2", t.Name())
+		operator.Handle(ctx, nil, call2)
+
+		err := s.Prepare(ctx, call1)
+		require.NoError(t, err)
+		err = s.Commit(ctx, call1)
+		require.NoError(t, err)
+
+		err = s.Prepare(ctx, call2)
+		require.ErrorContains(t, err, "base outdated")
+	})
+
+	t.Run("CommitVisible", func(t *testing.T) {
+		operator, call1 := setup(ctx, "1", t.Name())
+		operator.Handle(ctx, nil, call1)
+		require.NoError(t, s.Prepare(ctx, call1))
+		require.NoError(t, s.Commit(ctx, call1))
+
+		operator, _ = setup(ctx, "2", t.Name())
+		require.Equal(t, 2, Field(t, operator))
+	})
+
+	t.Run("RollbackDiscards", func(t *testing.T) {
+		operator, call1 := setup(ctx, "1", t.Name())
+		operator.Handle(ctx, nil, call1)
+		require.NoError(t, s.Prepare(ctx, call1))
+		require.NoError(t, s.Rollback(ctx, call1))
+
+		operator, call2 := setup(ctx, "2", t.Name())
+		require.Equal(t, 1, Field(t, operator))
+		operator.Handle(ctx, nil, call2)
+		require.NoError(t, s.Prepare(ctx, call2))
+	})
+
+	t.Run("CommitSentAgain", func(t *testing.T) {
+		// The first transaction writes the operator and the second one
+		// only reads it.
+		operator, write := setup(ctx, "1", t.Name())
+		operator.Handle(ctx, nil, write)
+		require.NoError(t, s.Prepare(ctx, write))
+		require.NoError(t, s.Commit(ctx, write))
+		operator, read := setup(ctx, "2", t.Name())
+		read.Args = []byte{}
+		operator.Handle(ctx, nil, read)
+		require.NoError(t, s.Prepare(ctx, read))
+		require.NoError(t, s.Commit(ctx, read))
+
+		// Another transaction commits the operator in the meantime.
+		operator, next := setup(ctx, "3", t.Name())
+		operator.Handle(ctx, nil, next)
+		require.NoError(t, s.Prepare(ctx, next))
+		require.NoError(t, s.Commit(ctx, next))
+
+		// The commits are sent again, because their acknowledgements were
+		// lost, and are not applied twice.
+		require.NoError(t, s.Commit(ctx, write))
+		require.NoError(t, s.Commit(ctx, read))
+		operator, _ = setup(ctx, "4", t.Name())
+		require.Equal(t, 3, Field(t, operator))
+	})
+}
+
+// TestExport exports the committed states of one Storage created by
+// newStorage and imports them into another. Both storages must implement
+// jetflow.ExportableStorage.
+func TestExport(t *testing.T, newStorage NewStorage) {
+	ctx := context.Background()
+	source, ok := newStorage(t, Mapping()).(jetflow.ExportableStorage)
+	require.True(t, ok, "storage is not a jetflow.ExportableStorage")
+	target, ok := newStorage(t, Mapping()).(jetflow.ExportableStorage)
+	require.True(t, ok, "storage is not a jetflow.ExportableStorage")
+
+	for _, id := range []string{"a", "b"} {
+		call := Request("1", id)
+		operator, err := source.Get(ctx, call)
+		require.NoError(t, err)
+		operator.Handle(ctx, nil, call)
+		require.NoError(t, source.Prepare(ctx, call))
+		require.NoError(t, source.Commit(ctx, call))
+	}
+
+	records := []jetflow.StateRecord{}
+	err := source.Export(ctx, []string{"TestType"}, func(record jetflow.StateRecord) error {
+		records = append(records, record)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+
+	err = source.Export(ctx, []string{"OtherType"}, func(record jetflow.StateRecord) error {
+		return errors.New("unexpected record")
+	})
+	require.NoError(t, err)
+
+	for _, record := range records {
+		require.NoError(t, target.Import(ctx, record))
+	}
+	// Existing operators are not overwritten.
+	require.Error(t, target.Import(ctx, records[0]))
+
+	for _, id := range []string{"a", "b"} {
+		call := Request("2", id)
+		operator, err := target.Get(ctx, call)
+		require.NoError(t, err)
+		require.Equal(t, 2, Field(t, operator))
+
+		// Imported operators can be updated like any other operator.
+		operator.Handle(ctx, nil, call)
+		require.NoError(t, target.Prepare(ctx, call))
+		require.NoError(t, target.Commit(ctx, call))
+	}
+}
+
+// NewStorageWithHook creates the Storage under test for the given mapping,
+// with the given commit hook.
+type NewStorageWithHook func(t *testing.T, mapping jetflow.HandlerFactoryMapping, hook jetflow.CommitHook) jetflow.Storage
+
+// TestCommitHook commits two versions of an operator and checks the changes
+// that are passed to the commit hook.
+func TestCommitHook(t *testing.T, newStorage NewStorageWithHook) {
+	ctx := context.Background()
+	changes := []jetflow.Change{}
+	s := newStorage(t, Mapping(), func(ctx context.Context, change jetflow.Change) {
+		changes = append(changes, change)
+	})
+
+	for _, trID := range []string{"1", "2"} {
+		call := Request(trID, "op")
+		operator, err := s.Get(ctx, call)
+		require.NoError(t, err)
+		operator.Handle(ctx, nil, call)
+		require.NoError(t, s.Prepare(ctx, call))
+		require.NoError(t, s.Commit(ctx, call))
+	}
+
+	// Rolled back versions are not passed to the hook.
+	call := Request("3", "op")
+	operator, err := s.Get(ctx, call)
+	require.NoError(t, err)
+	operator.Handle(ctx, nil, call)
+	require.NoError(t, s.Prepare(ctx, call))
+	require.NoError(t, s.Rollback(ctx, call))
+
+	require.Len(t, changes, 2)
+	for i, change := range changes {
+		require.Equal(t, "TestType", change.TypeName)
+		require.Equal(t, "op", change.InstanceID)
+		require.Equal(t, fmt.Sprint(i+1), change.TransactionID)
+		require.JSONEq(t, fmt.Sprint(i+2), string(change.State))
+	}
+	require.Less(t, changes[0].Version, changes[1].Version)
+	require.JSONEq(t, "2", string(changes[1].PreviousState))
+}
+
+// TestRecovery prepares two operators, restarts the storage by creating it
+// again and checks that the operators are still prepared and can be committed
+// and rolled back, also more than once. Every call of newStorage must open the same storage.
+func TestRecovery(t *testing.T, newStorage NewStorage) {
+	ctx := context.Background()
+	s := newStorage(t, Mapping())
+	coordinator := &jetflow.Address{TypeName: "Coordinator", InstanceID: "c"}
+
+	start := time.Now()
+	for _, opID := range []string{"a", "b"} {
+		call := Request(opID, opID)
+		call.Coordinator = coordinator
+		operator, err := s.Get(ctx, call)
+		require.NoError(t, err)
+		operator.Handle(ctx, nil, call)
+		require.NoError(t, s.Prepare(ctx, call))
+	}
+
+	// Restart the storage.
+	s = newStorage(t, Mapping())
+	recoverable, ok := s.(jetflow.RecoverableStorage)
+	require.True(t, ok, "storage is a %T", s)
+
+	prepared, err := recoverable.Prepared(ctx, start)
+	require.NoError(t, err)
+	require.Empty(t, prepared)
+	prepared, err = recoverable.Prepared(ctx, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.Len(t, prepared, 2)
+	requests := map[string]*jetflow.Request{}
+	for _, request := range prepared {
+		require.Equal(t, "TestType", request.TypeName)
+		require.Equal(t, request.InstanceID, request.TransactionID)
+		require.Equal(t, coordinator, request.Coordinator)
+		requests[request.InstanceID] = request
+	}
+
+	// The operators are still held by their transactions.
+	call := Request("c", "a")
+	operator, err := s.Get(ctx, call)
+	require.NoError(t, err)
+	operator.Handle(ctx, nil, call)
+	require.ErrorIs(t, s.Prepare(ctx, call), jetflow.ErrConflict)
+	require.NoError(t, s.Rollback(ctx, call))
+
+	require.NoError(t, s.Commit(ctx, requests["a"]))
+	require.NoError(t, s.Rollback(ctx, requests["b"]))
+
+	// Another transaction writes a and only reads b.
+	write, read := Request("e", "a"), Request("e", "b")
+	read.Args = []byte{}
+	for _, call := range []*jetflow.Request{write, read} {
+		operator, err := s.Get(ctx, call)
+		require.NoError(t, err)
+		operator.Handle(ctx, nil, call)
+		require.NoError(t, s.Prepare(ctx, call))
+		require.NoError(t, s.Commit(ctx, call))
+	}
+
+	// Decisions that are sent again, because their acknowledgement was lost,
+	// are acknowledged again, also after a restart.
+	require.NoError(t, s.Commit(ctx, requests["a"]))
+	require.NoError(t, s.Rollback(ctx, requests["b"]))
+	require.NoError(t, s.Commit(ctx, read))
+	s = newStorage(t, Mapping())
+	recoverable = s.(jetflow.RecoverableStorage)
+	require.NoError(t, s.Commit(ctx, requests["a"]))
+	require.NoError(t, s.Rollback(ctx, requests["b"]))
+	require.NoError(t, s.Commit(ctx, write))
+	require.NoError(t, s.Commit(ctx, read))
+
+	prepared, err = recoverable.Prepared(ctx, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.Empty(t, prepared)
+	for opID, field := range map[string]int{"a": 3, "b": 1} {
+		operator, err := s.Get(ctx, Request("d", opID))
+		require.NoError(t, err)
+		require.Equal(t, field, Field(t, operator))
+	}
+}
+
+// Field returns the field of the TestType operator handled by operator.
+//
+// Handlers that wrap the TestTypeHandler can expose it with an
+// Unwrap() jetflow.OperatorHandler method.
+func Field(t *testing.T, operator jetflow.OperatorHandler) int {
+	for {
+		wrapper, ok := operator.(interface {
+			Unwrap() jetflow.OperatorHandler
+		})
+		if !ok {
+			break
+		}
+		operator = wrapper.Unwrap()
+	}
+	handler, ok := operator.(*TestTypeHandler)
+	require.True(t, ok, "operator is a %T", operator)
+	return handler.instance.(*testType).field
+}
+
+var _ jetflow.StatefulHandler = (*TestTypeHandler)(nil)
+
+type TestTypeHandler struct {
+	instance TestType
+}
+
+func (h *TestTypeHandler) Handle(ctx context.Context, client jetflow.OperatorClient, call *jetflow.Request) (bytes []byte, err error) {
+	h.instance.(*testType).field += len(call.Args)
+	return
+}
+
+// MarshalState implements jetflow.StatefulHandler.
+func (h *TestTypeHandler) MarshalState() ([]byte, error) {
+	return json.Marshal(h.instance.(*testType).field)
+}
+
+// UnmarshalState implements jetflow.StatefulHandler.
+func (h *TestTypeHandler) UnmarshalState(data []byte) error {
+	return json.Unmarshal(data, &h.instance.(*testType).field)
+}
+
+func NewTestTypeHandler(id string) jetflow.OperatorHandler {
+	instance := NewTestType(id)
+	return &TestTypeHandler{instance}
+}
+
+type TestType interface {
+	jetflow.Operator
+}
+
+func NewTestType(id string) TestType {
+	return &testType{id: id, field: 1}
+}
+
+type testType struct {
+	id    string
+	field int
+}
+
+// ID implements jetflow.Operator interface.
+func (t *testType) ID() string {
+	return t.id
+}
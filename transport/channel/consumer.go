@@ -39,6 +39,10 @@ func (w *Consumer) processInbox(ctx context.Context) {
 				carrier := propagation.HeaderCarrier(req.headers)
 				ctx := propagator.Extract(ctx, carrier)
 
+				// Handle the request until the deadline of the caller.
+				ctx, cancel := jetflow.ContextWithRequestDeadline(ctx, req.Request)
+				defer cancel()
+
 				w.outbox <- w.handler.Handle(ctx, req.Request)
 			}()
 		case <-ctx.Done():
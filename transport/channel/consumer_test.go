@@ -0,0 +1,217 @@
+package channel
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/mathieupost/jetflow"
+	"github.com/mathieupost/jetflow/storage/memory"
+	"github.com/mathieupost/jetflow/storage/storagetest"
+)
+
+// countingHandler counts the calls to the TestType.
+type countingHandler struct {
+	*storagetest.TestTypeHandler
+	calls *atomic.Int32
+}
+
+func (h *countingHandler) Handle(ctx context.Context, client jetflow.OperatorClient, call *jetflow.Request) ([]byte, error) {
+	h.calls.Add(1)
+	return h.TestTypeHandler.Handle(ctx, client, call)
+}
+
+// Unwrap returns the TestTypeHandler.
+func (h *countingHandler) Unwrap() jetflow.OperatorHandler {
+	return h.TestTypeHandler
+}
+
+func TestDeduplication(t *testing.T) {
+	// Every request needs its own span id.
+	otel.SetTracerProvider(sdktrace.NewTracerProvider())
+
+	setup := func(t *testing.T, retention time.Duration) (*jetflow.Client, *memory.Storage, *atomic.Int32, chan requestWithHeaders) {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		calls := &atomic.Int32{}
+		storage := memory.NewStorage(jetflow.HandlerFactoryMapping{
+			"TestType": func(id string) jetflow.OperatorHandler {
+				handler := storagetest.NewTestTypeHandler(id).(*storagetest.TestTypeHandler)
+				return &countingHandler{handler, calls}
+			},
+		})
+		publisher, requests, responses := NewPublisher()
+		client := jetflow.NewClient(nil, publisher)
+		executor := jetflow.NewExecutor(storage, client, jetflow.WithDeduplication(retention))
+
+		// Deliver every request twice, like a transport that redelivers.
+		inbox := make(chan requestWithHeaders)
+		go func() {
+			for req := range requests {
+				inbox <- req
+				inbox <- req
+			}
+		}()
+		NewConsumer(inbox, responses, executor).Start(ctx)
+
+		return client, storage, calls, inbox
+	}
+
+	call := func(t *testing.T, ctx context.Context, client *jetflow.Client) {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		_, err := client.Call(ctx, &jetflow.Request{
+			TypeName:   "TestType",
+			InstanceID: "op",
+			Args:       []byte("1"),
+		})
+		require.NoError(t, err)
+	}
+
+	field := func(t *testing.T, storage *memory.Storage) int {
+		// The commit is sent asynchronously.
+		var operator jetflow.OperatorHandler
+		require.Eventually(t, func() bool {
+			prepared, err := storage.Prepared(context.Background(), time.Now())
+			require.NoError(t, err)
+			return len(prepared) == 0
+		}, time.Second, 10*time.Millisecond)
+		operator, err := storage.GetSnapshot(context.Background(), storagetest.Request("read", "op"))
+		require.NoError(t, err)
+		return storagetest.Field(t, operator)
+	}
+
+	t.Run("Duplicates", func(t *testing.T) {
+		client, storage, calls, _ := setup(t, time.Minute)
+
+		call(t, context.Background(), client)
+		require.Equal(t, int32(1), calls.Load())
+		require.Equal(t, 2, field(t, storage))
+	})
+
+	t.Run("IdempotencyKey", func(t *testing.T) {
+		client, storage, calls, _ := setup(t, time.Minute)
+
+		// A retry of the caller has a new request id, but the same key.
+		ctx := jetflow.ContextWithIdempotencyKey(context.Background(), "key")
+		call(t, ctx, client)
+		call(t, ctx, client)
+		require.Equal(t, int32(1), calls.Load())
+		require.Equal(t, 2, field(t, storage))
+	})
+
+	t.Run("RetentionExpired", func(t *testing.T) {
+		_, _, calls, inbox := setup(t, 10*time.Millisecond)
+
+		// A request that is redelivered after the retention window is
+		// handled again.
+		redeliver := func() {
+			inbox <- requestWithHeaders{Request: &jetflow.Request{
+				TransactionID: "tx",
+				RequestID:     "tx",
+				TypeName:      "TestType",
+				InstanceID:    "op",
+				Args:          []byte("1"),
+			}, headers: map[string][]string{}}
+		}
+		redeliver()
+		redeliver()
+		require.Eventually(t, func() bool {
+			return calls.Load() == 1
+		}, time.Second, 10*time.Millisecond)
+
+		time.Sleep(20 * time.Millisecond)
+		redeliver()
+		require.Eventually(t, func() bool {
+			return calls.Load() == 2
+		}, time.Second, 10*time.Millisecond)
+	})
+}
+
+// panickingHandler panics after modifying the TestType for calls to the
+// "panic" method.
+type panickingHandler struct {
+	*storagetest.TestTypeHandler
+}
+
+func (h *panickingHandler) Handle(ctx context.Context, client jetflow.OperatorClient, call *jetflow.Request) ([]byte, error) {
+	res, err := h.TestTypeHandler.Handle(ctx, client, call)
+	if call.Method == "panic" {
+		panic("operator bug")
+	}
+	return res, err
+}
+
+// Unwrap returns the TestTypeHandler.
+func (h *panickingHandler) Unwrap() jetflow.OperatorHandler {
+	return h.TestTypeHandler
+}
+
+func TestPanic(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	storage := memory.NewStorage(jetflow.HandlerFactoryMapping{
+		"TestType": func(id string) jetflow.OperatorHandler {
+			handler := storagetest.NewTestTypeHandler(id).(*storagetest.TestTypeHandler)
+			return &panickingHandler{handler}
+		},
+	}, memory.WithVersionTTL(time.Minute))
+	publisher, requests, responses := NewPublisher()
+	client := jetflow.NewClient(nil, publisher)
+	executor := jetflow.NewExecutor(storage, client)
+	NewConsumer(requests, responses, executor).Start(ctx)
+
+	call := func(method string) error {
+		_, err := client.Call(ctx, &jetflow.Request{
+			TypeName:   "TestType",
+			InstanceID: "op",
+			Method:     method,
+			Args:       []byte("1"),
+		})
+		return err
+	}
+	field := func() int {
+		operator, err := storage.GetSnapshot(ctx, storagetest.Request("read", "op"))
+		require.NoError(t, err)
+		return storagetest.Field(t, operator)
+	}
+
+	err := call("panic")
+	require.ErrorIs(t, err, jetflow.ErrPanic)
+	require.ErrorContains(t, err, "operator bug")
+	require.Equal(t, 1, field())
+
+	// The stack of the panic is recorded in the span of the operator.
+	var stack string
+	for _, span := range spans.Ended() {
+		for _, event := range span.Events() {
+			for _, attr := range event.Attributes {
+				if attr.Key == "exception.stacktrace" {
+					stack = attr.Value.AsString()
+				}
+			}
+		}
+	}
+	require.Contains(t, stack, "panickingHandler")
+
+	// The transaction is rolled back, so its version does not have to be
+	// reclaimed. The rollback is sent asynchronously.
+	time.Sleep(50 * time.Millisecond)
+	storage.Sweep(ctx, time.Now().Add(time.Hour))
+	require.Equal(t, int64(0), storage.Stats().ReclaimedVersions)
+	require.NoError(t, call("add"))
+	require.Eventually(t, func() bool {
+		return field() == 2
+	}, time.Second, 10*time.Millisecond)
+}
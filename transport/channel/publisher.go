@@ -70,7 +70,9 @@ func (d *Publisher) processResponses() {
 func (d *Publisher) handleResponse(response *jetflow.Response) {
 	c, ok := d.responseChannels.LoadAndDelete(response.RequestID)
 	if !ok {
-		log.Fatalln("response not found", response)
+		// A response to a duplicate of a request that was answered.
+		log.Println("response not found", response)
+		return
 	}
 
 	responseChan := c.(chan *jetflow.Response)
@@ -0,0 +1,93 @@
+package channel
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+
+	"github.com/mathieupost/jetflow"
+	"github.com/mathieupost/jetflow/storage/memory"
+	"github.com/mathieupost/jetflow/storage/storagetest"
+)
+
+func TestTransaction(t *testing.T) {
+	// Every request needs its own span id.
+	otel.SetTracerProvider(sdktrace.NewTracerProvider())
+
+	setup := func(t *testing.T) (*jetflow.Client, *memory.Storage) {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		storage := memory.NewStorage(storagetest.Mapping())
+		publisher, requests, responses := NewPublisher()
+		client := jetflow.NewClient(nil, publisher)
+		executor := jetflow.NewExecutor(storage, client)
+		NewConsumer(requests, responses, executor).Start(ctx)
+		return client, storage
+	}
+
+	add := func(ctx context.Context, client *jetflow.Client, id string) error {
+		_, err := client.Call(ctx, &jetflow.Request{
+			TypeName:   "TestType",
+			InstanceID: id,
+			Args:       []byte("1"),
+		})
+		return err
+	}
+
+	field := func(t *testing.T, storage *memory.Storage, id string) int {
+		// The decision is sent asynchronously.
+		require.Eventually(t, func() bool {
+			prepared, err := storage.Prepared(context.Background(), time.Now())
+			require.NoError(t, err)
+			return len(prepared) == 0
+		}, time.Second, 10*time.Millisecond)
+		operator, err := storage.GetSnapshot(context.Background(), storagetest.Request("read", id))
+		require.NoError(t, err)
+		return storagetest.Field(t, operator)
+	}
+
+	t.Run("Commit", func(t *testing.T) {
+		client, storage := setup(t)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		err := client.Transaction(ctx, func(ctx context.Context) error {
+			require.NoError(t, add(ctx, client, "op1"))
+			return add(ctx, client, "op2")
+		})
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			return field(t, storage, "op1") == 2 && field(t, storage, "op2") == 2
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Rollback", func(t *testing.T) {
+		client, storage := setup(t)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		errAbort := errors.New("abort")
+		err := client.Transaction(ctx, func(ctx context.Context) error {
+			require.NoError(t, add(ctx, client, "op1"))
+			require.NoError(t, add(ctx, client, "op2"))
+			return errAbort
+		})
+		require.ErrorIs(t, err, errAbort)
+
+		// Both calls are rolled back, so a new transaction can change the
+		// operators again.
+		require.Equal(t, 1, field(t, storage, "op1"))
+		require.Equal(t, 1, field(t, storage, "op2"))
+		require.NoError(t, add(ctx, client, "op1"))
+		require.Eventually(t, func() bool {
+			return field(t, storage, "op1") == 2
+		}, time.Second, 10*time.Millisecond)
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
@@ -21,17 +22,32 @@ type Consumer struct {
 	handler   jetflow.RequestHandler
 }
 
+type ConsumerOption func(*Consumer)
+
+// WithMailbox makes the consumer handle the calls to an operator instance one
+// at a time with a jetflow.Mailbox, instead of handling every message right
+// away. Calls that wait longer than the timeout for their turn fail.
+func WithMailbox(timeout time.Duration) ConsumerOption {
+	return func(c *Consumer) {
+		c.handler = jetflow.NewMailbox(c.handler, timeout)
+	}
+}
+
 func NewConsumer(
 	ctx context.Context,
 	id int,
 	jetstream jetstream.JetStream,
 	handler jetflow.RequestHandler,
+	opts ...ConsumerOption,
 ) *Consumer {
 	consumer := &Consumer{
 		id:        id,
 		jetstream: jetstream,
 		handler:   handler,
 	}
+	for _, opt := range opts {
+		opt(consumer)
+	}
 
 	consumer.initConsumer(ctx)
 
@@ -93,8 +109,11 @@ func (r *Consumer) handle(ctx context.Context, msg jetstream.Msg) {
 		log.Fatalln("acknowledge request", err, string(msg.Data()))
 	}
 
-	// Handle the request.
-	response := r.handler.Handle(ctx, call)
+	// Handle the request until the deadline of the caller. The response is
+	// still sent after it expired.
+	handleCtx, cancel := jetflow.ContextWithRequestDeadline(ctx, call)
+	response := r.handler.Handle(handleCtx, call)
+	cancel()
 
 	// Marshal the response.
 	data, err := json.Marshal(response)
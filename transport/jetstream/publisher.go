@@ -151,11 +151,12 @@ func (d *Publisher) handleMsg(msg jetstream.Msg) {
 }
 
 func (d *Publisher) handleResponse(response *jetflow.Response) {
-	c, ok := d.responseChannels.Load(response.RequestID)
+	c, ok := d.responseChannels.LoadAndDelete(response.RequestID)
 	if !ok {
-		log.Fatalln("response not found", response)
+		// A response to a duplicate of a request that was answered.
+		log.Println("response not found", response)
+		return
 	}
-	defer d.responseChannels.Delete(response.RequestID)
 
 	responseChan := c.(chan *jetflow.Response)
 	responseChan <- response
@@ -0,0 +1,91 @@
+package jetflow
+
+import (
+	"context"
+	"sync"
+)
+
+// turns serializes the calls of a transaction to an operator instance. The
+// calls share the version of the operator in the storage, and can arrive at
+// the same time when they are made with Async. A call holds the turn of its
+// operator while it runs, and gives it up while it waits for the calls it
+// makes, so the operators it calls can call it back.
+type turns struct {
+	mu    sync.Mutex
+	turns map[string]*turn
+}
+
+// turn is the turn of an operator instance within a transaction.
+type turn struct {
+	// running holds a value while a call runs.
+	running chan struct{}
+	// users is the number of calls that hold or wait for the turn. It is
+	// guarded by turns.mu.
+	users int
+}
+
+func newTurns() *turns {
+	return &turns{turns: map[string]*turn{}}
+}
+
+// take waits for the turn of the operator within the transaction of the
+// call.
+func (ts *turns) take(call *Request) *turn {
+	key := call.TypeName + "." + call.InstanceID + "." + call.TransactionID
+
+	ts.mu.Lock()
+	t, ok := ts.turns[key]
+	if !ok {
+		t = &turn{running: make(chan struct{}, 1)}
+		ts.turns[key] = t
+	}
+	t.users++
+	ts.mu.Unlock()
+
+	t.acquire()
+	return t
+}
+
+// done gives the turn to the next call, and forgets it once no call uses it.
+func (ts *turns) done(call *Request, t *turn) {
+	key := call.TypeName + "." + call.InstanceID + "." + call.TransactionID
+
+	t.release()
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t.users--
+	if t.users == 0 {
+		delete(ts.turns, key)
+	}
+}
+
+func (t *turn) acquire() {
+	t.running <- struct{}{}
+}
+
+func (t *turn) release() {
+	select {
+	case <-t.running:
+	default:
+	}
+}
+
+// turnKey
+var turnKey ctxKey = "TURN"
+
+// contextWithTurn returns a copy of ctx that holds the turn of the operator
+// that handles a call, so yield can give it up.
+func contextWithTurn(ctx context.Context, t *turn) context.Context {
+	return context.WithValue(ctx, turnKey, t)
+}
+
+// yield gives up the turn that the context holds until the returned function
+// is called, which waits until it is the turn of the context again.
+func yield(ctx context.Context) func() {
+	t, ok := ctx.Value(turnKey).(*turn)
+	if !ok {
+		return func() {}
+	}
+	t.release()
+	return t.acquire
+}
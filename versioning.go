@@ -0,0 +1,103 @@
+package jetflow
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// Migration upgrades an operator state from the version it is registered for
+// to the next version.
+type Migration func(state json.RawMessage) (json.RawMessage, error)
+
+// VersionedHandler is a StatefulHandler whose state has a schema version.
+// UnmarshalState must accept states of older versions and upgrade them with
+// the migrations, for example using MigrateState.
+type VersionedHandler interface {
+	StatefulHandler
+	// StateVersion returns the version of the state that MarshalState
+	// returns. Versions start at 1.
+	StateVersion() int
+	// Migrations returns the migrations by the version they upgrade from.
+	Migrations() map[int]Migration
+}
+
+// versionedState is the envelope of states with a version above 1. States
+// without an envelope have version 1, so operators that never changed their
+// state do not need one.
+type versionedState struct {
+	Version int             `json:"$v"`
+	State   json.RawMessage `json:"$s"`
+}
+
+// VersionState returns the state with the given version in the format that
+// SplitState reads.
+func VersionState(version int, state []byte) ([]byte, error) {
+	if version <= 1 {
+		return state, nil
+	}
+	data, err := json.Marshal(versionedState{version, state})
+	return data, errors.Wrap(err, "marshalling versioned state")
+}
+
+// SplitState returns the version of a state created by VersionState and the
+// state without its version.
+func SplitState(data []byte) (int, json.RawMessage) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(data, &fields)
+	if err != nil || len(fields) != 2 || fields["$v"] == nil || fields["$s"] == nil {
+		return 1, data
+	}
+	var version int
+	err = json.Unmarshal(fields["$v"], &version)
+	if err != nil || version <= 1 {
+		return 1, data
+	}
+	return version, fields["$s"]
+}
+
+// MigrateState migrates a state of any version to the state version of the
+// handler and returns it without its version. VersionedHandlers use it to
+// unmarshal states of older versions.
+func MigrateState(handler VersionedHandler, data []byte) (json.RawMessage, error) {
+	target := handler.StateVersion()
+	version, state := SplitState(data)
+	if version > target {
+		return nil, errors.Errorf("state version %d is newer than %d", version, target)
+	}
+
+	migrations := handler.Migrations()
+	for ; version < target; version++ {
+		migrate, ok := migrations[version]
+		if !ok {
+			return nil, errors.Errorf("no migration from state version %d", version)
+		}
+		var err error
+		state, err = migrate(state)
+		if err != nil {
+			return nil, errors.Wrapf(err, "migrating state version %d", version)
+		}
+	}
+	return state, nil
+}
+
+// UpgradeState returns the state as the handler marshals it if the state has
+// an older version than the handler. Storages call it on the states they load,
+// so they can be compared to the states that the handler marshals. The state
+// of the handler is replaced, so it should be a new instance.
+func UpgradeState(handler OperatorHandler, data []byte) ([]byte, error) {
+	versioned, ok := handler.(VersionedHandler)
+	if !ok || data == nil || versioned.StateVersion() <= 1 {
+		return data, nil
+	}
+	version, _ := SplitState(data)
+	if version == versioned.StateVersion() {
+		return data, nil
+	}
+
+	err := versioned.UnmarshalState(data)
+	if err != nil {
+		return nil, err
+	}
+	return versioned.MarshalState()
+}
@@ -2,7 +2,10 @@ package jetflow_test
 
 import (
 	"context"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/mock"
@@ -10,6 +13,8 @@ import (
 
 	"github.com/mathieupost/jetflow"
 	"github.com/mathieupost/jetflow/mocks"
+	"github.com/mathieupost/jetflow/storage/memory"
+	"github.com/mathieupost/jetflow/storage/storagetest"
 )
 
 func TestProcessRequest(t *testing.T) {
@@ -59,6 +64,31 @@ func TestProcessRequest(t *testing.T) {
 		require.ErrorIs(t, response.Error, nil)
 	})
 
+	t.Run("ParentSyncCommit", func(t *testing.T) {
+		storage := mocks.NewStorage(t)
+		handler := mocks.NewOperatorHandler(t)
+		client := mocks.NewOperatorClient(t)
+		worker := jetflow.NewExecutor(storage, client, jetflow.WithSyncCommit())
+
+		// The lost commit is sent again, and the reply waits until it is
+		// acknowledged.
+		storage.EXPECT().Get(ANY, ANY).Return(handler, nil).Once()
+		handler.EXPECT().Handle(ANY, ANY, ANY).Return(nil, nil).Once()
+		client.EXPECT().Call(ANY, match(jetflow.MethodPrepare)).Return(nil, nil).Once()
+		client.EXPECT().Call(ANY, match(jetflow.MethodCommit)).Return(nil, errors.New("lost")).Once()
+		client.EXPECT().Call(ANY, match(jetflow.MethodCommit)).Return(nil, nil).Once()
+
+		request := &jetflow.Request{
+			TransactionID: t.Name(),
+			RequestID:     t.Name(),
+		}
+		response := worker.Handle(ctx, request)
+
+		require.Equal(t, t.Name(), response.RequestID)
+		require.NoError(t, response.Error)
+		client.AssertNumberOfCalls(t, "Call", 3)
+	})
+
 	t.Run("Child", func(t *testing.T) {
 		tt := setup(t)
 
@@ -75,11 +105,50 @@ func TestProcessRequest(t *testing.T) {
 		require.ErrorIs(t, response.Error, nil)
 	})
 
+	t.Run("ChildAsync", func(t *testing.T) {
+		tt := setup(t)
+
+		// The calls of futures that were not awaited, or whose Await gave
+		// up, still involve their operators.
+		async := func(ctx context.Context, id string, release chan struct{}) *jetflow.Future[int] {
+			return jetflow.Async(ctx, func(ctx context.Context) (int, error) {
+				<-release
+				jetflow.ContextAddInvolvedOperator(ctx, "Other", id)
+				return 0, nil
+			})
+		}
+		tt.storage.EXPECT().Get(ANY, ANY).Return(tt.handler, nil).Once()
+		tt.handler.EXPECT().Handle(ANY, ANY, ANY).Run(func(ctx context.Context, _ jetflow.OperatorClient, _ *jetflow.Request) {
+			release := make(chan struct{})
+			async(ctx, "not-awaited", release)
+			future := async(ctx, "await-canceled", release)
+			canceled, cancel := context.WithCancel(ctx)
+			cancel()
+			_, err := future.Await(canceled)
+			require.ErrorIs(t, err, context.Canceled)
+			close(release)
+		}).Return(nil, nil).Once()
+
+		request := &jetflow.Request{
+			TransactionID: t.Name(),
+			RequestID:     "child",
+			TypeName:      "TestType",
+			InstanceID:    "op",
+		}
+		response := tt.worker.Handle(ctx, request)
+
+		require.NoError(t, response.Error)
+		require.Equal(t, map[string]map[string]bool{
+			"TestType": {"op": true},
+			"Other":    {"not-awaited": true, "await-canceled": true},
+		}, response.InvolvedOperators)
+	})
+
 	t.Run("ParentHandleError", func(t *testing.T) {
 		tt := setup(t)
 
 		tt.storage.EXPECT().Get(ANY, ANY).Return(tt.handler, nil).Once()
-		err := errors.New("handle error")
+		err := errors.Wrap(jetflow.ErrConflict, "handle error")
 		tt.handler.EXPECT().Handle(ANY, ANY, ANY).Return(nil, err).Once()
 		tt.client.EXPECT().Call(ANY, match(jetflow.MethodRollback)).Return(nil, nil).Maybe() // ROLLBACK
 		tt.storage.EXPECT().Get(ANY, ANY).Return(tt.handler, nil).Once()
@@ -97,6 +166,129 @@ func TestProcessRequest(t *testing.T) {
 		require.ErrorIs(t, response.Error, nil)
 	})
 
+	t.Run("ParentHandleErrorKeepsTransactionTime", func(t *testing.T) {
+		tt := setup(t)
+
+		// The retry gets a new transaction id, but keeps the time at which
+		// the transaction started.
+		var transactionTimes []int64
+		record := func(ctx context.Context, _ *jetflow.Request) {
+			transactionTimes = append(transactionTimes, jetflow.TransactionTimeFromContext(ctx))
+		}
+		tt.storage.EXPECT().Get(ANY, ANY).Run(record).Return(tt.handler, nil).Times(2)
+		tt.handler.EXPECT().Handle(ANY, ANY, ANY).Return(nil, errors.Wrap(jetflow.ErrConflict, "handle error")).Once()
+		tt.client.EXPECT().Call(ANY, match(jetflow.MethodRollback)).Return(nil, nil).Maybe() // ROLLBACK
+		tt.handler.EXPECT().Handle(ANY, ANY, ANY).Return(nil, nil).Once()
+		tt.client.EXPECT().Call(ANY, match(jetflow.MethodPrepare)).Return(nil, nil).Once()
+		tt.client.EXPECT().Call(ANY, match(jetflow.MethodCommit)).Return(nil, nil).Maybe() // FIXME: Async call
+
+		request := &jetflow.Request{
+			TransactionID: t.Name(),
+			RequestID:     t.Name(),
+		}
+		response := tt.worker.Handle(ctx, request)
+
+		require.NoError(t, response.Error)
+		require.Len(t, transactionTimes, 2)
+		require.NotZero(t, transactionTimes[0])
+		require.Equal(t, transactionTimes[0], transactionTimes[1])
+		require.Equal(t, transactionTimes[0], request.TransactionTime)
+	})
+
+	t.Run("ParentHandleErrorNoRetry", func(t *testing.T) {
+		storage := mocks.NewStorage(t)
+		handler := mocks.NewOperatorHandler(t)
+		client := mocks.NewOperatorClient(t)
+		worker := jetflow.NewExecutor(storage, client, jetflow.WithRetryPolicy(jetflow.NoRetry))
+
+		storage.EXPECT().Get(ANY, ANY).Return(handler, nil).Once()
+		err := errors.New("handle error")
+		handler.EXPECT().Handle(ANY, ANY, ANY).Return(nil, err).Once()
+		client.EXPECT().Call(ANY, match(jetflow.MethodRollback)).Return(nil, nil).Maybe() // ROLLBACK
+
+		request := &jetflow.Request{
+			TransactionID: t.Name(),
+			RequestID:     t.Name(),
+		}
+		response := worker.Handle(ctx, request)
+
+		require.Equal(t, t.Name(), response.RequestID)
+		require.ErrorIs(t, response.Error, err)
+	})
+
+	t.Run("ParentHandleErrorNotRetryable", func(t *testing.T) {
+		tt := setup(t)
+
+		// The policy of the request overrides the policy of the executor.
+		tt.storage.EXPECT().Get(ANY, ANY).Return(tt.handler, nil).Once()
+		tt.handler.EXPECT().Handle(ANY, ANY, ANY).Return(nil, jetflow.ErrNotFound).Once()
+		tt.client.EXPECT().Call(ANY, match(jetflow.MethodRollback)).Return(nil, nil).Maybe() // ROLLBACK
+
+		request := &jetflow.Request{
+			TransactionID: t.Name(),
+			RequestID:     t.Name(),
+			RetryPolicy:   &jetflow.RetryPolicy{MaxAttempts: 3},
+		}
+		response := tt.worker.Handle(ctx, request)
+
+		require.Equal(t, t.Name(), response.RequestID)
+		require.ErrorIs(t, response.Error, jetflow.ErrNotFound)
+	})
+
+	t.Run("ParentDeadlineExceeded", func(t *testing.T) {
+		tt := setup(t)
+
+		// The transaction outlives the deadline of the caller, so it is rolled
+		// back instead of committed.
+		tt.storage.EXPECT().Get(ANY, ANY).Return(tt.handler, nil).Once()
+		tt.handler.EXPECT().Handle(ANY, ANY, ANY).Run(func(ctx context.Context, _ jetflow.OperatorClient, _ *jetflow.Request) {
+			<-ctx.Done()
+		}).Return(nil, nil).Once()
+		tt.client.EXPECT().Call(ANY, match(jetflow.MethodPrepare)).Return(nil, nil).Once()
+		rolledBack := make(chan struct{})
+		tt.client.EXPECT().Call(ANY, match(jetflow.MethodRollback)).Run(func(context.Context, *jetflow.Request) {
+			close(rolledBack)
+		}).Return(nil, nil).Once()
+
+		request := &jetflow.Request{
+			TransactionID: t.Name(),
+			RequestID:     t.Name(),
+			Timeout:       10 * time.Millisecond,
+		}
+		response := tt.worker.Handle(ctx, request)
+
+		require.Equal(t, t.Name(), response.RequestID)
+		require.ErrorIs(t, response.Error, context.DeadlineExceeded)
+		select {
+		case <-rolledBack:
+		case <-time.After(time.Second):
+			t.Fatal("transaction was not rolled back")
+		}
+	})
+
+	t.Run("ReadOnly", func(t *testing.T) {
+		storage := mocks.NewSnapshotStorage(t)
+		handler := mocks.NewOperatorHandler(t)
+		client := mocks.NewOperatorClient(t)
+		worker := jetflow.NewExecutor(storage, client)
+
+		// The read-only call is served from a snapshot and is not prepared
+		// or committed.
+		storage.EXPECT().GetSnapshot(ANY, ANY).Return(handler, nil).Once()
+		handler.EXPECT().Handle(ANY, ANY, ANY).Return(nil, nil).Once()
+
+		request := &jetflow.Request{
+			TransactionID: t.Name(),
+			RequestID:     t.Name(),
+			ReadOnly:      true,
+		}
+		response := worker.Handle(ctx, request)
+
+		require.Equal(t, t.Name(), response.RequestID)
+		require.ErrorIs(t, response.Error, nil)
+		require.Empty(t, response.InvolvedOperators)
+	})
+
 	t.Run("ChildHandleError", func(t *testing.T) {
 		tt := setup(t)
 
@@ -137,3 +329,98 @@ func TestProcessRequest(t *testing.T) {
 		require.ErrorIs(t, response.Error, nil)
 	})
 }
+
+func TestReadOnlySerializable(t *testing.T) {
+	ctx := context.Background()
+
+	storage := memory.NewStorage(storagetest.Mapping(), memory.WithSerializable())
+	worker := jetflow.NewExecutor(storage, mocks.NewOperatorClient(t))
+
+	// The read-only call within a transaction takes part in its two-phase
+	// commit, so its read is validated.
+	read := storagetest.Request("reader", "op")
+	read.ReadOnly = true
+	read.Args = []byte{}
+	response := worker.Handle(ctx, read)
+	require.NoError(t, response.Error)
+	require.Equal(t, map[string]map[string]bool{"TestType": {"op": true}}, response.InvolvedOperators)
+
+	write := storagetest.Request("writer", "op")
+	operator, err := storage.Get(ctx, write)
+	require.NoError(t, err)
+	_, err = operator.Handle(ctx, nil, write)
+	require.NoError(t, err)
+
+	require.NoError(t, storage.Prepare(ctx, read))
+	require.ErrorIs(t, storage.Prepare(ctx, write), jetflow.ErrConflict)
+}
+
+// slowHandler takes a while to handle a call and records whether calls
+// overlapped.
+type slowHandler struct {
+	*storagetest.TestTypeHandler
+	running    *atomic.Int32
+	overlapped *atomic.Bool
+	callback   func(ctx context.Context) error
+}
+
+func (h *slowHandler) Handle(ctx context.Context, client jetflow.OperatorClient, call *jetflow.Request) ([]byte, error) {
+	if call.Method == "callback" {
+		future := jetflow.Async(ctx, func(ctx context.Context) (struct{}, error) {
+			return struct{}{}, h.callback(ctx)
+		})
+		_, err := future.Await(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if h.running.Add(1) > 1 {
+		h.overlapped.Store(true)
+	}
+	defer h.running.Add(-1)
+	time.Sleep(10 * time.Millisecond)
+	return h.TestTypeHandler.Handle(ctx, client, call)
+}
+
+func TestConcurrentCalls(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var running atomic.Int32
+	var overlapped atomic.Bool
+	var worker *jetflow.Executor
+	storage := memory.NewStorage(jetflow.HandlerFactoryMapping{
+		"TestType": func(id string) jetflow.OperatorHandler {
+			return &slowHandler{
+				TestTypeHandler: storagetest.NewTestTypeHandler(id).(*storagetest.TestTypeHandler),
+				running:         &running,
+				overlapped:      &overlapped,
+				callback: func(ctx context.Context) error {
+					// A call of the same transaction back to the operator.
+					return worker.Handle(ctx, storagetest.Request("tx", id)).Error
+				},
+			}
+		},
+	})
+	worker = jetflow.NewExecutor(storage, mocks.NewOperatorClient(t))
+
+	// Calls of a transaction that are made with Async arrive at the same
+	// time, and take turns.
+	var wg sync.WaitGroup
+	for _, method := range []string{"", "", "callback"} {
+		wg.Add(1)
+		go func(method string) {
+			defer wg.Done()
+			call := storagetest.Request("tx", "op")
+			call.Method = method
+			require.NoError(t, worker.Handle(ctx, call).Error)
+		}(method)
+	}
+	wg.Wait()
+	require.False(t, overlapped.Load())
+
+	operator, err := storage.Get(ctx, storagetest.Request("tx", "op"))
+	require.NoError(t, err)
+	require.Equal(t, 5, storagetest.Field(t, operator.(*slowHandler).TestTypeHandler))
+}